@@ -0,0 +1,57 @@
+package consumer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MaxNumberOfMessages returns the number of messages currently requested on each receive:
+// the configured MaxNumberOfMessages, unless AdaptiveMaxNumberOfMessages is enabled.
+func (s *SQS) MaxNumberOfMessages() int64 {
+	if n := atomic.LoadInt64(&s.maxNumberOfMessages); n != 0 {
+		return n
+	}
+	return s.config.MaxNumberOfMessages
+}
+
+// adaptMaxNumberOfMessages tunes the number of messages requested on each receive according to how long
+// it took to process the last ones: as they share the same VisibilityTimeout a slow cycle risks making
+// the last messages visible again before being processed, so the size is halved when a cycle takes more
+// than half of the VisibilityTimeout and increased by one when it takes less than a quarter.
+func (s *SQS) adaptMaxNumberOfMessages(processed int, elapsed time.Duration) {
+	if !s.config.AdaptiveMaxNumberOfMessages || processed == 0 {
+		return
+	}
+
+	s.adaptLock.Lock()
+	defer s.adaptLock.Unlock()
+
+	current := s.MaxNumberOfMessages()
+	visibility := time.Duration(s.config.VisibilityTimeout) * time.Second
+	next := current
+
+	switch {
+	case elapsed > visibility/2:
+		next = current / 2
+	case elapsed < visibility/4 && int64(processed) >= current:
+		next = current + 1
+	}
+
+	if next < s.config.MinNumberOfMessages {
+		next = s.config.MinNumberOfMessages
+	}
+
+	if next > s.config.MaxNumberOfMessages {
+		next = s.config.MaxNumberOfMessages
+	}
+
+	if next == current {
+		return
+	}
+
+	atomic.StoreInt64(&s.maxNumberOfMessages, next)
+
+	if s.config.Hooks.OnMaxNumberOfMessagesChange != nil {
+		s.config.Hooks.OnMaxNumberOfMessagesChange(next)
+	}
+}
@@ -0,0 +1,158 @@
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultAuditBuffer is the number of records JSONLinesAuditSink buffers before dropping them
+const DefaultAuditBuffer = 1024
+
+// AuditOutcome is the final outcome of a processed message.
+type AuditOutcome string
+
+const (
+	// AuditProcessed messages have been processed successfully
+	AuditProcessed AuditOutcome = "processed"
+	// AuditRetried messages failed and have been made visible again for redelivery
+	AuditRetried AuditOutcome = "retried"
+	// AuditDeadLettered messages failed and have been forwarded to the DeadLetterQueue
+	AuditDeadLettered AuditOutcome = "dead_lettered"
+	// AuditFailed messages failed and have been left in the queue
+	AuditFailed AuditOutcome = "failed"
+)
+
+// AuditRecord describes the processing of a message, DeletedAt is nil when the message has not been deleted.
+type AuditRecord struct {
+	MessageId   string       `json:"message_id"`
+	ReceivedAt  time.Time    `json:"received_at"`
+	ProcessedAt time.Time    `json:"processed_at"`
+	Outcome     AuditOutcome `json:"outcome"`
+	DeletedAt   *time.Time   `json:"deleted_at,omitempty"`
+}
+
+// AuditSink receives a record for every message once its final outcome is known. Record is invoked
+// by the consumer loops, so it must not block: slow sinks should buffer or drop records.
+type AuditSink interface {
+	Record(record AuditRecord)
+}
+
+// JSONLinesAuditSink is an AuditSink writing the records as JSON lines, from a background goroutine.
+// When the buffer is full, or the sink has been closed, records are dropped (and logged) rather than
+// slowing down processing.
+type JSONLinesAuditSink struct {
+	records chan AuditRecord
+	done    chan struct{}
+	lock    sync.RWMutex
+	closed  bool
+	logger  Logger
+}
+
+// NewJSONLinesAuditSink returns a JSONLinesAuditSink writing to w, that must be closed with Close
+// to flush the buffered records. Dropped records and write errors are logged to logger, the logrus
+// standard logger when nil.
+func NewJSONLinesAuditSink(w io.Writer, logger Logger) *JSONLinesAuditSink {
+	if logger == nil {
+		logger = defaultLogger()
+	}
+
+	sink := &JSONLinesAuditSink{
+		records: make(chan AuditRecord, DefaultAuditBuffer),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+
+	go sink.write(json.NewEncoder(w))
+
+	return sink
+}
+
+func (j *JSONLinesAuditSink) Record(record AuditRecord) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	if j.closed {
+		j.logger.Warnf("audit sink closed, dropping record of message %s", record.MessageId)
+		return
+	}
+
+	select {
+	case j.records <- record:
+	default:
+		j.logger.Warnf("audit buffer full, dropping record of message %s", record.MessageId)
+	}
+}
+
+// Close stops accepting records and waits for the buffered ones to be written.
+func (j *JSONLinesAuditSink) Close() error {
+	j.lock.Lock()
+	if !j.closed {
+		j.closed = true
+		close(j.records)
+	}
+	j.lock.Unlock()
+
+	<-j.done
+	return nil
+}
+
+func (j *JSONLinesAuditSink) write(encoder *json.Encoder) {
+	defer close(j.done)
+
+	for record := range j.records {
+		if err := encoder.Encode(record); err != nil {
+			j.logger.Errorf("error writing audit record of message %s: %s", record.MessageId, err)
+		}
+	}
+}
+
+// auditTrail collects the audit records of a batch of messages, it is nil when auditing is disabled.
+type auditTrail map[*sqs.Message]*AuditRecord
+
+func (s *SQS) newAuditTrail() auditTrail {
+	if s.config.AuditSink == nil {
+		return nil
+	}
+	return make(auditTrail)
+}
+
+// outcome records that msg has been processed with outcome.
+func (s *SQS) outcome(trail auditTrail, outcome AuditOutcome, messages ...*sqs.Message) {
+	if trail == nil {
+		return
+	}
+
+	now := time.Now()
+
+	for _, msg := range messages {
+		trail[msg] = &AuditRecord{
+			MessageId:   aws.StringValue(msg.MessageId),
+			ReceivedAt:  s.receivedAt(msg),
+			ProcessedAt: now,
+			Outcome:     outcome,
+		}
+	}
+}
+
+// audit sends the records to the AuditSink, marking as deleted the messages in deleted.
+func (s *SQS) audit(trail auditTrail, deleted []*sqs.Message) {
+	if trail == nil {
+		return
+	}
+
+	now := time.Now()
+
+	for _, msg := range deleted {
+		if record, found := trail[msg]; found {
+			record.DeletedAt = &now
+		}
+	}
+
+	for _, record := range trail {
+		s.config.AuditSink.Record(*record)
+	}
+}
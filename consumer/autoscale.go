@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultScaleInterval and DefaultScaleCooldown drive Autoscale
+	DefaultScaleInterval = 30 * time.Second
+	DefaultScaleCooldown = 1 * time.Minute
+)
+
+// autoscale scales the active workers to the queue depth every ScaleInterval until ctx is done, leaving
+// at least ScaleCooldown between two changes.
+func (s *SQS) autoscale(ctx context.Context) {
+	var lastChange time.Time
+
+	for {
+		if depth, err := s.queueDepth(ctx); err != nil {
+			if ctx.Err() == nil {
+				s.config.Logger.Warnf("%s", s.queueError("error getting the queue depth", err))
+			}
+		} else if next := s.scaledConcurrency(depth); next != s.Concurrency() && time.Since(lastChange) >= s.config.ScaleCooldown {
+			s.setConcurrency(next)
+			lastChange = time.Now()
+
+			if s.config.Hooks.OnAutoscale != nil {
+				s.config.Hooks.OnAutoscale(next, depth)
+			}
+		}
+
+		if !sleep(ctx, s.config.ScaleInterval) {
+			return
+		}
+	}
+}
+
+// scaledConcurrency returns the workers needed to consume depth messages, ScaleTarget messages per worker,
+// between MinConcurrency and Concurrency.
+func (s *SQS) scaledConcurrency(depth int) int {
+	next := (depth + s.config.ScaleTarget - 1) / s.config.ScaleTarget
+
+	if next < s.config.MinConcurrency {
+		next = s.config.MinConcurrency
+	}
+
+	if next > s.config.Concurrency {
+		next = s.config.Concurrency
+	}
+
+	return next
+}
+
+// queueDepth returns the ApproximateNumberOfMessages of the queue.
+func (s *SQS) queueDepth(ctx context.Context) (int, error) {
+	out, err := s.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(s.queueURL()),
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameApproximateNumberOfMessages}),
+	}, s.config.RequestOptions...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(aws.StringValue(out.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+}
@@ -0,0 +1,45 @@
+package consumer
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultEmptyReceiveBackoff is the wait before polling again after an empty receive or a transient error
+	DefaultEmptyReceiveBackoff = 1 * time.Second
+	// DefaultReceiveBackoff and DefaultMaxReceiveBackoff bound the wait before retrying a transient receive error
+	DefaultReceiveBackoff    = 100 * time.Millisecond
+	DefaultMaxReceiveBackoff = 20 * time.Second
+)
+
+// Backoff is an exponential backoff policy: the first wait is Min, doubled on every consecutive attempt up to Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// delay returns the wait before the attempt-th consecutive retry, starting from 1.
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Min
+
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+
+	if d > b.Max {
+		d = b.Max
+	}
+
+	return d
+}
+
+// jittered returns a random wait between half and the whole delay of the attempt-th retry, so that the
+// workers failing together don't retry together.
+func (b Backoff) jittered(attempt int) time.Duration {
+	d := b.delay(attempt)
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
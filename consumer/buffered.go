@@ -0,0 +1,134 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"time"
+)
+
+// StartBuffered consumes the queue invoking consumeFn with batches of messages accumulated across
+// multiple receives, up to BatchSize messages or BatchWait, whichever comes first. It gets fuller
+// batches on sparse queues than StartBatched, without the need of an external batcher.
+func (s *SQS) StartBuffered(ctx context.Context, consumeFn ConsumerBatchFn) error {
+	ctx, done, err := s.run(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	received := make(chan []*sqs.Message)
+	receiveErr := make(chan error, 1)
+
+	go func() {
+		receiveErr <- s.supervise(ctx, "receiver", func() error {
+			return s.receiveBuffered(ctx, received)
+		})
+	}()
+
+	wait := s.batchWait()
+	timer := time.NewTimer(wait)
+	timer.Stop()
+
+	buffer := make([]*sqs.Message, 0, s.config.BatchSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if len(buffer) > 0 {
+				return s.consumeBatch(buffer, consumeFn)
+			}
+			return nil
+
+		case err := <-receiveErr:
+			if err == nil {
+				// the receiver stopped because ctx is done or MaxRuntime elapsed
+				if len(buffer) > 0 {
+					return s.consumeBatch(buffer, consumeFn)
+				}
+				return nil
+			}
+			s.release(buffer)
+			return err
+
+		case messages := <-received:
+			if len(buffer) == 0 {
+				timer.Reset(wait)
+			}
+
+			buffer = append(buffer, messages...)
+
+			for len(buffer) >= s.config.BatchSize {
+				batch := buffer[:s.config.BatchSize:s.config.BatchSize]
+				buffer = buffer[s.config.BatchSize:]
+
+				if err := s.consumeBatch(batch, consumeFn); err != nil {
+					s.release(buffer)
+					return err
+				}
+			}
+
+			if len(buffer) == 0 && !timer.Stop() {
+				// drain without blocking: since Go 1.23 a stopped timer doesn't deliver a stale tick
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+		case <-timer.C:
+			batch := buffer
+			buffer = make([]*sqs.Message, 0, s.config.BatchSize)
+
+			if err := s.consumeBatch(batch, consumeFn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiveBuffered receives messages sending them to received until ctx is done or MaxRuntime elapsed.
+func (s *SQS) receiveBuffered(ctx context.Context, received chan<- []*sqs.Message) error {
+	if !sleep(ctx, s.config.InitialDelay) {
+		return nil
+	}
+
+	empties := 0
+
+	for ctx.Err() == nil && !s.expired() {
+		messages, acquired, err := s.receiveAcquired(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			empties++
+			sleep(ctx, s.config.EmptyReceiveBackoff.delay(empties))
+			continue
+		}
+		empties = 0
+
+		if len(acquired) == 0 {
+			continue
+		}
+
+		select {
+		case received <- acquired:
+		case <-ctx.Done():
+			s.release(acquired)
+		}
+	}
+
+	return nil
+}
+
+// batchWait returns BatchWait capped to half of the VisibilityTimeout.
+func (s *SQS) batchWait() time.Duration {
+	limit := time.Duration(s.config.VisibilityTimeout) * time.Second / 2
+
+	if s.config.BatchWait > limit {
+		return limit
+	}
+
+	return s.config.BatchWait
+}
@@ -0,0 +1,285 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCircuitOpenTimeout, DefaultCircuitWindow and DefaultCircuitProbeMessages drive the CircuitBreaker
+	DefaultCircuitOpenTimeout   = 30 * time.Second
+	DefaultCircuitWindow        = 20
+	DefaultCircuitProbeMessages = 1
+)
+
+// CircuitState is the state of the CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed receives messages as usual
+	CircuitClosed CircuitState = iota
+	// CircuitOpen stops receiving messages until OpenTimeout elapses
+	CircuitOpen
+	// CircuitHalfOpen receives a single probe of ProbeMessages messages, closing the circuit if none of them fails
+	CircuitHalfOpen
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops receiving messages when the consumer function keeps failing, e.g. because a downstream
+// dependency is down, instead of burning the receive counts of the messages. The circuit opens after Failures
+// consecutive failed messages or when more than FailureRate of the last Window (default DefaultCircuitWindow)
+// processed messages failed. After OpenTimeout (default DefaultCircuitOpenTimeout) a probe of ProbeMessages
+// (default DefaultCircuitProbeMessages) messages is received: the circuit closes if none of them fails, otherwise
+// it opens again. It is disabled when both Failures and FailureRate are 0.
+type CircuitBreaker struct {
+	Failures      int
+	FailureRate   float64
+	Window        int
+	OpenTimeout   time.Duration
+	ProbeMessages int64
+}
+
+func (c CircuitBreaker) enabled() bool {
+	return c.Failures > 0 || c.FailureRate > 0
+}
+
+// circuit is the state of the CircuitBreaker of a consumer.
+type circuit struct {
+	lock            sync.Mutex
+	state           CircuitState
+	openedAt        time.Time
+	consecutive     int
+	windowProcessed int
+	windowFailed    int
+	// probe are the messages of the probe being processed, nil when no probe is in flight
+	probe map[*sqs.Message]struct{}
+	// changes are the state changes to notify once the lock is released
+	changes []CircuitState
+}
+
+// circuitWait returns how long a worker must wait before receiving, and whether its receive is the probe.
+func (s *SQS) circuitWait() (time.Duration, bool) {
+	if !s.config.CircuitBreaker.enabled() {
+		return 0, false
+	}
+
+	s.circuit.lock.Lock()
+	defer s.unlockCircuit()
+
+	switch s.circuit.state {
+	case CircuitOpen:
+		if wait := s.config.CircuitBreaker.OpenTimeout - time.Since(s.circuit.openedAt); wait > 0 {
+			return wait, false
+		}
+		s.setCircuitState(CircuitHalfOpen)
+		return 0, true
+	case CircuitHalfOpen:
+		// another worker is probing
+		return ParkedWorkerPoll, false
+	}
+
+	return 0, false
+}
+
+// circuitProbing records the messages acquired by the probe, the circuit closes when none was acquired.
+func (s *SQS) circuitProbing(messages []*sqs.Message) {
+	s.circuit.lock.Lock()
+	defer s.unlockCircuit()
+
+	if len(messages) == 0 {
+		s.setCircuitState(CircuitClosed)
+		return
+	}
+
+	s.circuit.probe = make(map[*sqs.Message]struct{}, len(messages))
+	for _, msg := range messages {
+		s.circuit.probe[msg] = struct{}{}
+	}
+}
+
+// circuitReleased opens the circuit again when the messages of the probe are released without having been
+// settled, e.g. on shutdown, so that the circuit never stays half-open.
+func (s *SQS) circuitReleased(messages []*sqs.Message) {
+	if !s.config.CircuitBreaker.enabled() {
+		return
+	}
+
+	s.circuit.lock.Lock()
+	defer s.unlockCircuit()
+
+	if s.circuit.state == CircuitHalfOpen && s.probing(messages) {
+		s.setCircuitState(CircuitOpen)
+	}
+}
+
+// probing reports whether any of the messages belongs to the probe, it must be invoked holding the circuit lock.
+func (s *SQS) probing(messages []*sqs.Message) bool {
+	for _, msg := range messages {
+		if _, found := s.circuit.probe[msg]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveAcquired receives messages once the CircuitBreaker allows it, returning the received messages and
+// the ones prepared and acquired for processing. Nothing is received when ctx is done or MaxRuntime elapsed
+// while the circuit is open.
+func (s *SQS) receiveAcquired(ctx context.Context) ([]*sqs.Message, []*sqs.Message, error) {
+	wait, probe := s.circuitWait()
+	for wait > 0 {
+		if !s.backoff(ctx, wait) || s.expired() {
+			return nil, nil, nil
+		}
+		wait, probe = s.circuitWait()
+	}
+
+	messages, err := s.receiveMessages(ctx)
+	if err != nil {
+		if probe {
+			s.circuitProbeFailed()
+		}
+		return nil, nil, err
+	}
+
+	acquired := s.acquire(s.prepare(messages))
+
+	if probe {
+		s.circuitProbing(acquired)
+	}
+
+	return messages, acquired, nil
+}
+
+// circuitProbeFailed opens the circuit again when the probe could not be received.
+func (s *SQS) circuitProbeFailed() {
+	s.circuit.lock.Lock()
+	defer s.unlockCircuit()
+
+	s.setCircuitState(CircuitOpen)
+}
+
+// receiveSize returns the number of messages to request on the next receive, ProbeMessages when probing.
+func (s *SQS) receiveSize() int64 {
+	size := s.MaxNumberOfMessages()
+
+	if !s.config.CircuitBreaker.enabled() {
+		return size
+	}
+
+	s.circuit.lock.Lock()
+	defer s.circuit.lock.Unlock()
+
+	if s.circuit.state == CircuitHalfOpen && s.config.CircuitBreaker.ProbeMessages < size {
+		return s.config.CircuitBreaker.ProbeMessages
+	}
+
+	return size
+}
+
+// recordCircuit records the outcome of the processing of messages: it opens the circuit when the failures
+// exceed the thresholds, and closes or opens it again according to the outcome of the probe.
+func (s *SQS) recordCircuit(messages []*sqs.Message, failed int) {
+	if !s.config.CircuitBreaker.enabled() || len(messages) == 0 {
+		return
+	}
+
+	s.circuit.lock.Lock()
+	defer s.unlockCircuit()
+
+	if s.circuit.state == CircuitHalfOpen && s.probing(messages) {
+		if failed > 0 {
+			s.setCircuitState(CircuitOpen)
+		} else {
+			s.setCircuitState(CircuitClosed)
+		}
+		return
+	}
+
+	// outcomes of messages received before opening the circuit
+	if s.circuit.state != CircuitClosed {
+		return
+	}
+
+	conf := s.config.CircuitBreaker
+
+	if failed == len(messages) {
+		s.circuit.consecutive += failed
+	} else {
+		s.circuit.consecutive = 0
+	}
+
+	if conf.Failures > 0 && s.circuit.consecutive >= conf.Failures {
+		s.setCircuitState(CircuitOpen)
+		return
+	}
+
+	if conf.FailureRate <= 0 {
+		return
+	}
+
+	s.circuit.windowProcessed += len(messages)
+	s.circuit.windowFailed += failed
+
+	if s.circuit.windowProcessed < conf.Window {
+		return
+	}
+
+	errorRate := float64(s.circuit.windowFailed) / float64(s.circuit.windowProcessed)
+	s.circuit.windowProcessed, s.circuit.windowFailed = 0, 0
+
+	if errorRate > conf.FailureRate {
+		s.setCircuitState(CircuitOpen)
+	}
+}
+
+// setCircuitState must be invoked holding the circuit lock.
+func (s *SQS) setCircuitState(state CircuitState) {
+	s.circuit.state = state
+	s.circuit.probe = nil
+
+	switch state {
+	case CircuitOpen:
+		s.circuit.openedAt = time.Now()
+		s.config.Logger.Warnf("circuit breaker of queue %s open, receiving again in %s", s.config.Queue, s.config.CircuitBreaker.OpenTimeout)
+	case CircuitClosed:
+		s.circuit.consecutive, s.circuit.windowProcessed, s.circuit.windowFailed = 0, 0, 0
+	}
+
+	s.circuit.changes = append(s.circuit.changes, state)
+}
+
+// unlockCircuit releases the circuit lock, then notifies the state changes to Hooks.OnCircuitChange.
+func (s *SQS) unlockCircuit() {
+	changes := s.circuit.changes
+	s.circuit.changes = nil
+	s.circuit.lock.Unlock()
+
+	if s.config.Hooks.OnCircuitChange == nil {
+		return
+	}
+
+	for _, state := range changes {
+		s.config.Hooks.OnCircuitChange(state)
+	}
+}
+
+// CircuitState returns the current state of the CircuitBreaker, always CircuitClosed when disabled.
+func (s *SQS) CircuitState() CircuitState {
+	s.circuit.lock.Lock()
+	defer s.circuit.lock.Unlock()
+
+	return s.circuit.state
+}
@@ -0,0 +1,81 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorAction tells the consumer what to do with a message whose processing failed.
+type ErrorAction int
+
+const (
+	// Retry leaves the message in the queue, to be redelivered once its visibility timeout expires
+	Retry ErrorAction = iota
+	// DeadLetter forwards the message to the DeadLetterQueue and deletes it from the queue
+	DeadLetter
+)
+
+// ErrPermanent can be returned (or wrapped) by a consumer function to tell that the message can't ever be
+// processed, DefaultErrorClassifier forwards it to the DeadLetterQueue instead of retrying it.
+var ErrPermanent = errors.New("permanent failure")
+
+// ErrorClassifier decides what to do with a message given the error returned by the consumer function.
+type ErrorClassifier func(err error) ErrorAction
+
+// StatusError is an error carrying an HTTP-style status code, recognized by DefaultErrorClassifier.
+type StatusError interface {
+	error
+	StatusCode() int
+}
+
+type statusError struct {
+	status int
+	err    error
+}
+
+// WithStatus attaches an HTTP-style status code to err.
+func WithStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, http.StatusText(e.status), e.err.Error())
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+func (e *statusError) StatusCode() int {
+	return e.status
+}
+
+// DefaultErrorClassifier dead letters the messages failed with ErrPermanent or a 4xx StatusError, as retrying
+// them would fail again, except for 408 (Request Timeout) and 429 (Too Many Requests). Any other error is retried.
+func DefaultErrorClassifier(err error) ErrorAction {
+	if errors.Is(err, ErrPermanent) {
+		return DeadLetter
+	}
+
+	var statusErr StatusError
+
+	if !errors.As(err, &statusErr) {
+		return Retry
+	}
+
+	status := statusErr.StatusCode()
+
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return DeadLetter
+	}
+
+	return Retry
+}
+
+func (s *SQS) classify(err error) ErrorAction {
+	if s.config.ErrorClassifier != nil {
+		return s.config.ErrorClassifier(err)
+	}
+	return DefaultErrorClassifier(err)
+}
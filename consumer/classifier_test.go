@@ -0,0 +1,30 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDefaultErrorClassifier(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorAction
+	}{
+		{name: "shouldRetryPlainError", err: errors.New("boom"), want: Retry},
+		{name: "shouldDeadLetterClientError", err: WithStatus(400, errors.New("bad request")), want: DeadLetter},
+		{name: "shouldDeadLetterWrappedClientError", err: fmt.Errorf("calling api: %w", WithStatus(404, errors.New("not found"))), want: DeadLetter},
+		{name: "shouldRetryTooManyRequests", err: WithStatus(429, errors.New("slow down")), want: Retry},
+		{name: "shouldRetryRequestTimeout", err: WithStatus(408, errors.New("timeout")), want: Retry},
+		{name: "shouldDeadLetterPermanentError", err: fmt.Errorf("unknown customer: %w", ErrPermanent), want: DeadLetter},
+		{name: "shouldRetryServerError", err: WithStatus(503, errors.New("unavailable")), want: Retry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultErrorClassifier(tt.err); got != tt.want {
+				t.Errorf("DefaultErrorClassifier() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"io"
+	"io/ioutil"
+)
+
+// ContentEncodingAttribute is the message attribute naming the compression of the body, e.g. gzip.
+// Compressed bodies are base64 encoded, as SQS bodies must be valid text.
+const ContentEncodingAttribute = "Content-Encoding"
+
+// ErrDecompressedTooLarge is returned when a decompressed body exceeds SQSConf.MaxDecompressedBytes.
+var ErrDecompressedTooLarge = errors.New("decompressed body too large")
+
+// Codec compresses and decompresses message bodies, see SQSConf.Codecs.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCodec is the Codec of the gzip encoding. MaxBytes bounds the size of the decompressed data,
+// unbounded when 0.
+type GzipCodec struct {
+	MaxBytes int64
+}
+
+func (GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if g.MaxBytes <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	// read one byte more than allowed to tell the bodies at the limit from the larger ones
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, g.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decompressed)) > g.MaxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrDecompressedTooLarge, g.MaxBytes)
+	}
+	return decompressed, nil
+}
+
+// codec returns the Codec of encoding among codecs, gzip being always supported and bounded to maxBytes.
+func codec(codecs map[string]Codec, encoding string, maxBytes int64) (Codec, bool) {
+	if c, found := codecs[encoding]; found {
+		return c, true
+	}
+	if encoding == "gzip" {
+		return GzipCodec{MaxBytes: maxBytes}, true
+	}
+	return nil, false
+}
+
+// decompressBodies decompresses the bodies of the messages having a ContentEncodingAttribute, when Decompress
+// is set. The attribute is looked up after unwrapping the SNS envelope, if any. Bodies that can't be decompressed
+// fail their message, the ones exceeding MaxDecompressedBytes with a 400 status.
+func (s *SQS) decompressBodies(messages []*sqs.Message) error {
+	if !s.config.Decompress {
+		return nil
+	}
+
+	for _, msg := range messages {
+		p, _ := s.payloads.Load(msg)
+		decoded, _ := p.(payload)
+		if decoded.decompressed {
+			continue
+		}
+
+		message := s.message(msg)
+
+		encoding := message.Attributes[ContentEncodingAttribute]
+		if encoding == "" {
+			continue
+		}
+
+		c, found := codec(s.config.Codecs, encoding, s.config.MaxDecompressedBytes)
+		if !found {
+			return fmt.Errorf("error decompressing message: unsupported encoding %s", encoding)
+		}
+
+		compressed, err := base64.StdEncoding.DecodeString(string(message.Body))
+		if err == nil {
+			decoded.body, err = c.Decompress(compressed)
+		}
+		// custom codecs are not bounded while decompressing, check their output
+		if err == nil && int64(len(decoded.body)) > s.config.MaxDecompressedBytes {
+			err = fmt.Errorf("%w: more than %d bytes", ErrDecompressedTooLarge, s.config.MaxDecompressedBytes)
+		}
+		if errors.Is(err, ErrDecompressedTooLarge) {
+			return WithStatus(400, fmt.Errorf("error decompressing message: %w", err))
+		}
+		if err != nil {
+			return fmt.Errorf("error decompressing message: %w", err)
+		}
+
+		decoded.decompressed = true
+		s.payloads.Store(msg, decoded)
+	}
+
+	return nil
+}
+
+// compressBody compresses body with the Compression of the Publisher when it exceeds CompressThreshold,
+// returning the body to send and its encoding, empty when not compressed.
+func (p *Publisher) compressBody(body []byte) ([]byte, string, error) {
+	if p.conf.Compression == "" || len(body) <= p.conf.CompressThreshold {
+		return body, "", nil
+	}
+
+	c, found := codec(p.conf.Codecs, p.conf.Compression, 0)
+	if !found {
+		return nil, "", fmt.Errorf("unsupported encoding %s", p.conf.Compression)
+	}
+
+	compressed, err := c.Compress(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(compressed)), p.conf.Compression, nil
+}
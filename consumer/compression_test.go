@@ -0,0 +1,187 @@
+package consumer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturingSQS records the messages sent with SendMessage
+type capturingSQS struct {
+	*mockSQS
+	inputs []*sqs.SendMessageInput
+}
+
+func (c *capturingSQS) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	c.inputs = append(c.inputs, in)
+	return c.mockSQS.SendMessageWithContext(ctx, in, opts...)
+}
+
+func TestPublisher_SendCompressed(t *testing.T) {
+	svc := &capturingSQS{mockSQS: newMockSQS()}
+
+	p, err := NewPublisher(PublisherConf{Queue: "queue", Compression: "gzip", CompressThreshold: 100}, svc)
+	assert.NoError(t, err)
+
+	large := strings.Repeat("large body ", 100)
+
+	_, err = p.Send(context.Background(), []byte("small body"))
+	assert.NoError(t, err)
+	_, err = p.Send(context.Background(), []byte(large))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "small body", aws.StringValue(svc.inputs[0].MessageBody))
+	assert.Nil(t, svc.inputs[0].MessageAttributes[ContentEncodingAttribute])
+
+	assert.Equal(t, "gzip", aws.StringValue(svc.inputs[1].MessageAttributes[ContentEncodingAttribute].StringValue))
+	assert.Less(t, len(aws.StringValue(svc.inputs[1].MessageBody)), len(large))
+
+	p, err = NewPublisher(PublisherConf{Queue: "queue", Compression: "zstd"}, svc)
+	assert.NoError(t, err)
+	_, err = p.Send(context.Background(), []byte(large))
+	assert.EqualError(t, err, "error compressing message: unsupported encoding zstd")
+}
+
+func TestSQS_processMessagesDecompress(t *testing.T) {
+	large := strings.Repeat("large body ", 100)
+	compressed, err := GzipCodec{}.Compress([]byte(large))
+	assert.NoError(t, err)
+
+	encoded := func(msg *sqs.Message, encoding string) *sqs.Message {
+		msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+			ContentEncodingAttribute: {DataType: aws.String("String"), StringValue: aws.String(encoding)},
+		}
+		return msg
+	}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, Decompress: true}, newMockSQS())
+	assert.NoError(t, err)
+
+	messages := s.acquire([]*sqs.Message{
+		encoded(mockMessage("msg1", "handle1", base64.StdEncoding.EncodeToString(compressed)), "gzip"),
+		mockMessage("msg2", "handle2", "plain body"),
+		encoded(mockMessage("msg3", "handle3", "not base64!"), "gzip"),
+		encoded(mockMessage("msg4", "handle4", "body"), "zstd"),
+	})
+
+	var lock sync.Mutex
+	bodies := make(map[string]string)
+
+	err = s.processMessages(context.Background(), messages, func(ctx context.Context, msg Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		bodies[msg.MessageId] = string(msg.Body)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// bodies that can't be decompressed fail their message
+	assert.Equal(t, map[string]string{"msg1": large, "msg2": "plain body"}, bodies)
+
+	_, decompressed := s.payloadBody(messages[0])
+	assert.False(t, decompressed)
+}
+
+func TestSQS_processMessagesDecompressLimit(t *testing.T) {
+	compressed, err := GzipCodec{}.Compress([]byte(strings.Repeat("a", 2048)))
+	assert.NoError(t, err)
+	body := base64.StdEncoding.EncodeToString(compressed)
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:                "queue",
+		Logger:               NoopLogger{},
+		Decompress:           true,
+		MaxDecompressedBytes: 1024,
+		DeadLetterQueue:      "dlq",
+	}, svc)
+	assert.NoError(t, err)
+
+	msg := mockMessage("msg1", "handle1", body)
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		ContentEncodingAttribute: {DataType: aws.String("String"), StringValue: aws.String("gzip")},
+	}
+
+	consumed := false
+	err = s.processMessages(context.Background(), s.acquire([]*sqs.Message{msg}), func(ctx context.Context, msg Message) error {
+		consumed = true
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// too large bodies are dead lettered
+	assert.False(t, consumed)
+	assert.Equal(t, []string{body}, svc.sentBodies("dlq"))
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+
+	_, err = GzipCodec{MaxBytes: 2048}.Decompress(compressed)
+	assert.NoError(t, err)
+	_, err = GzipCodec{MaxBytes: 2047}.Decompress(compressed)
+	assert.True(t, errors.Is(err, ErrDecompressedTooLarge))
+}
+
+func TestSQS_processMessagesDecompressSNS(t *testing.T) {
+	compressed, err := GzipCodec{}.Compress([]byte("payload"))
+	assert.NoError(t, err)
+
+	envelope, err := json.Marshal(map[string]interface{}{
+		"Type":     "Notification",
+		"TopicArn": "arn:aws:sns:eu-west-1:123456789012:topic",
+		"Message":  base64.StdEncoding.EncodeToString(compressed),
+		"MessageAttributes": map[string]interface{}{
+			ContentEncodingAttribute: map[string]string{"Type": "String", "Value": "gzip"},
+		},
+	})
+	assert.NoError(t, err)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", UnwrapSNS: true, Decompress: true}, newMockSQS())
+	assert.NoError(t, err)
+
+	var received string
+	err = s.processMessages(context.Background(), s.acquire([]*sqs.Message{mockMessage("msg1", "handle1", string(envelope))}), func(ctx context.Context, msg Message) error {
+		received = string(msg.Body)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", received)
+}
+
+func TestSQS_StartWithBatchResultDecompress(t *testing.T) {
+	compressed, err := GzipCodec{}.Compress([]byte("payload"))
+	assert.NoError(t, err)
+
+	msg := mockMessage("msg1", "handle1", base64.StdEncoding.EncodeToString(compressed))
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		ContentEncodingAttribute: {DataType: aws.String("String"), StringValue: aws.String("gzip")},
+	}
+
+	svc := newMockSQS([]*sqs.Message{msg, mockMessage("msg2", "handle2", "plain body")})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Decompress: true}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var bodies []string
+	err = s.StartWithBatchFailures(ctx, func(ctx context.Context, msgs []Message) ([]string, error) {
+		for _, msg := range msgs {
+			bodies = append(bodies, string(msg.Body))
+		}
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"payload", "plain body"}, bodies)
+	assert.Equal(t, []string{"handle1", "handle2"}, svc.deletedHandles())
+}
@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ParkedWorkerPoll is how often a worker parked by AdaptiveConcurrency checks whether it can resume
+const ParkedWorkerPoll = 1 * time.Second
+
+// Concurrency returns the number of workers currently consuming the queue: the configured
+// Concurrency, unless AdaptiveConcurrency or Autoscale is enabled.
+func (s *SQS) Concurrency() int {
+	if n := atomic.LoadInt32(&s.concurrency); n != 0 {
+		return int(n)
+	}
+	return s.config.Concurrency
+}
+
+// setConcurrency changes the number of active workers, waking up the invocations waiting for a handler slot.
+func (s *SQS) setConcurrency(n int) {
+	atomic.StoreInt32(&s.concurrency, int32(n))
+	s.slots.wake()
+}
+
+// active reports whether worker is allowed to receive messages.
+func (s *SQS) active(worker int) bool {
+	return worker < s.Concurrency()
+}
+
+// adaptConcurrency tunes the number of active workers according to the consumer error rate, AIMD style:
+// every ConcurrencyWindow processed messages the workers are halved when the error rate of the window
+// exceeds ConcurrencyErrorRate, reducing the pressure on a struggling downstream, and increased by one otherwise.
+func (s *SQS) adaptConcurrency(processed, failed int) {
+	if !s.config.AdaptiveConcurrency || processed == 0 {
+		return
+	}
+
+	s.concurrencyLock.Lock()
+	defer s.concurrencyLock.Unlock()
+
+	s.windowProcessed += processed
+	s.windowFailed += failed
+
+	if s.windowProcessed < s.config.ConcurrencyWindow {
+		return
+	}
+
+	errorRate := float64(s.windowFailed) / float64(s.windowProcessed)
+	s.windowProcessed, s.windowFailed = 0, 0
+
+	current := s.Concurrency()
+	next := current + 1
+
+	if errorRate > s.config.ConcurrencyErrorRate {
+		next = current / 2
+	}
+
+	if next < s.config.MinConcurrency {
+		next = s.config.MinConcurrency
+	}
+
+	if next > s.config.Concurrency {
+		next = s.config.Concurrency
+	}
+
+	if next == current {
+		return
+	}
+
+	s.setConcurrency(next)
+
+	if s.config.Hooks.OnConcurrencyChange != nil {
+		s.config.Hooks.OnConcurrencyChange(next, errorRate)
+	}
+}
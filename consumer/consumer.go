@@ -1,11 +1,46 @@
 package consumer
 
-import "context"
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
 
 type ConsumerFn func(data []byte) error
 
+// ConsumerFnWithMeta is a consumer function receiving the whole message, ctx is done when the
+// message should not be processed anymore (e.g. its deadline passed or the Shutdown drain timed out).
+type ConsumerFnWithMeta func(ctx context.Context, msg Message) error
+
 type ConsumerBatchFn func(data [][]byte) error
 
+// SQSClient is the subset of the SQS API used by the consumer, satisfied by *sqs.SQS and sqsiface.SQSAPI.
+// It can be implemented to inject mocks or instrumented clients.
+type SQSClient interface {
+	ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatchWithContext(ctx aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatchWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+	SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error)
+	SendMessageBatchWithContext(ctx aws.Context, in *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error)
+	GetQueueAttributesWithContext(ctx aws.Context, in *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error)
+}
+
 type DataSource interface {
 	Start(ctx context.Context, consumeFn ConsumerFn) error
 }
+
+// RetryNow can be returned (or wrapped) by a consumer function to ask for an immediate
+// redelivery of the message: its visibility timeout is set to 0 instead of waiting for
+// the configured VisibilityTimeout to expire.
+// A handler that keeps returning RetryNow will be redelivered in a tight loop, bounded only
+// by the queue redrive policy.
+var RetryNow = errors.New("retry now")
+
+// ErrClosed is returned when starting a consumer that has been closed.
+var ErrClosed = errors.New("consumer closed")
+
+// ErrGroupFailed fails the messages of a FIFO message group following a failed one in the same receive:
+// they are not processed and left in the queue, to be redelivered in order after the failed one.
+var ErrGroupFailed = errors.New("previous message of the group failed")
@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"unicode/utf8"
+)
+
+const (
+	// FailureReasonAttribute is the message attribute holding the error a message has been dead lettered for
+	FailureReasonAttribute = "FailureReason"
+	// SourceQueueAttribute is the message attribute holding the queue a message has been dead lettered from
+	SourceQueueAttribute = "SourceQueue"
+
+	// maxMessageAttributes is the maximum number of attributes of an SQS message
+	maxMessageAttributes = 10
+	// maxFailureReasonBytes bounds the size of the FailureReasonAttribute
+	maxFailureReasonBytes = 1024
+)
+
+// deadLettered tells whether a message failed with err has to be forwarded to the DeadLetterQueue.
+func (s *SQS) deadLettered(err error) bool {
+	return s.config.DeadLetterQueue != "" && s.classify(err) == DeadLetter
+}
+
+// poisoned tells whether msg, that failed, has been received MaxReceiveCount times and must not be redelivered.
+func (s *SQS) poisoned(msg *sqs.Message) bool {
+	return s.config.MaxReceiveCount > 0 && receiveCount(msg) >= s.config.MaxReceiveCount
+}
+
+// dropPoisoned logs that msg is going to be deleted without being forwarded, no DeadLetterQueue being set.
+func (s *SQS) dropPoisoned(msg *sqs.Message) {
+	s.config.Logger.Warnf("message %s on queue %s received %d times, dropping it",
+		aws.StringValue(msg.MessageId), s.config.Queue, receiveCount(msg))
+}
+
+// deadLetterMessages forwards the messages to the DeadLetterQueue, returning the ones successfully forwarded
+// that can be deleted from the queue. The forwarded copies carry the FailureReasonAttribute and the
+// SourceQueueAttribute, as long as the message attributes limit allows.
+func (s *SQS) deadLetterMessages(messages []*sqs.Message, failures map[*sqs.Message]error) []*sqs.Message {
+	if len(messages) == 0 {
+		return messages
+	}
+
+	originals := make(map[*sqs.Message]*sqs.Message, len(messages))
+	annotated := make([]*sqs.Message, len(messages))
+
+	for i, msg := range messages {
+		annotated[i] = s.annotateFailure(msg, failures[msg])
+		originals[annotated[i]] = msg
+	}
+
+	forwarded := s.forward(s.config.DeadLetterQueue, annotated)
+
+	deadLettered := make([]*sqs.Message, len(forwarded))
+	for i, msg := range forwarded {
+		deadLettered[i] = originals[msg]
+	}
+
+	return deadLettered
+}
+
+// truncate cuts s to at most n bytes on a rune boundary, so that a valid UTF-8 string stays valid.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// annotateFailure returns a copy of msg whose attributes are extended with the failure reason and the source queue.
+func (s *SQS) annotateFailure(msg *sqs.Message, err error) *sqs.Message {
+	annotated := *msg
+	annotated.MessageAttributes = copyAttributes(msg.MessageAttributes)
+
+	if err != nil && len(annotated.MessageAttributes) < maxMessageAttributes {
+		annotated.MessageAttributes[FailureReasonAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(truncate(err.Error(), maxFailureReasonBytes)),
+		}
+	}
+
+	if len(annotated.MessageAttributes) < maxMessageAttributes {
+		annotated.MessageAttributes[SourceQueueAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(s.config.Queue),
+		}
+	}
+
+	return &annotated
+}
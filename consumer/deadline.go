@@ -0,0 +1,66 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"time"
+)
+
+// deadline returns the deadline carried by the DeadlineAttribute message attribute, either a unix
+// timestamp in seconds or an RFC3339 date. A zero time is returned when the message has no deadline.
+func (s *SQS) deadline(msg *sqs.Message) (time.Time, error) {
+	if s.config.DeadlineAttribute == "" {
+		return time.Time{}, nil
+	}
+
+	attribute, found := msg.MessageAttributes[s.config.DeadlineAttribute]
+
+	if !found || attribute == nil || attribute.StringValue == nil {
+		return time.Time{}, nil
+	}
+
+	value := *attribute.StringValue
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	deadline, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s attribute %q: %w", s.config.DeadlineAttribute, value, err)
+	}
+
+	return deadline, nil
+}
+
+// skipExpired deletes the messages whose deadline passed and returns the others,
+// messages with a malformed deadline are left in the queue.
+func (s *SQS) skipExpired(messages []*sqs.Message) []*sqs.Message {
+	if s.config.DeadlineAttribute == "" {
+		return messages
+	}
+
+	valid := make([]*sqs.Message, 0, len(messages))
+	expired := make([]*sqs.Message, 0)
+
+	for _, msg := range messages {
+		deadline, err := s.deadline(msg)
+
+		switch {
+		case err != nil:
+			s.malformed(msg, err)
+		case !deadline.IsZero() && time.Now().After(deadline):
+			s.config.Logger.Warnf("message %s deadline %s passed, skipping it", aws.StringValue(msg.MessageId), deadline)
+			expired = append(expired, msg)
+		default:
+			valid = append(valid, msg)
+		}
+	}
+
+	s.deleteSqsMessages(expired)
+
+	return valid
+}
@@ -0,0 +1,184 @@
+package consumer
+
+import (
+	"container/list"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupeStore remembers the keys of the messages already processed, so that messages delivered
+// more than once (SQS standard queues are at-least-once) are processed only once.
+type DedupeStore interface {
+	// Seen reports whether key has been marked and its ttl has not elapsed yet
+	Seen(key string) (bool, error)
+	// Mark records key as processed for ttl
+	Mark(key string, ttl time.Duration) error
+}
+
+// MemoryDedupeStore is a DedupeStore keeping the keys in memory, suitable for single instance consumers.
+// Expired keys are pruned as new ones are marked and, when the store has a capacity, the least recently
+// used (seen or marked) keys are evicted once it is full.
+type MemoryDedupeStore struct {
+	lock     sync.Mutex
+	keys     map[string]*list.Element
+	order    *list.List
+	capacity int
+	now      func() time.Time
+}
+
+// dedupeEntry is a key of a MemoryDedupeStore, ordered by last use.
+type dedupeEntry struct {
+	key        string
+	expiration time.Time
+}
+
+// NewMemoryDedupeStore returns a MemoryDedupeStore without capacity limits.
+func NewMemoryDedupeStore() *MemoryDedupeStore {
+	return NewLRUDedupeStore(0)
+}
+
+// NewLRUDedupeStore returns a MemoryDedupeStore remembering up to capacity keys, bounding its memory on busy
+// queues. A capacity smaller than the keys marked within the TTL lets some duplicates through.
+func NewLRUDedupeStore(capacity int) *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		keys:     make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+		now:      time.Now,
+	}
+}
+
+func (m *MemoryDedupeStore) Seen(key string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	element, found := m.keys[key]
+	if found && !m.now().Before(element.Value.(*dedupeEntry).expiration) {
+		m.remove(element)
+		return false, nil
+	}
+
+	if found {
+		m.order.MoveToBack(element)
+	}
+
+	return found, nil
+}
+
+func (m *MemoryDedupeStore) Mark(key string, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+
+	if element, found := m.keys[key]; found {
+		m.remove(element)
+	}
+	m.keys[key] = m.order.PushBack(&dedupeEntry{key: key, expiration: now.Add(ttl)})
+
+	// prune the expired keys from the least recently used, until a live one
+	for element := m.order.Front(); element != nil && !now.Before(element.Value.(*dedupeEntry).expiration); element = m.order.Front() {
+		m.remove(element)
+	}
+
+	for m.capacity > 0 && m.order.Len() > m.capacity {
+		m.remove(m.order.Front())
+	}
+
+	return nil
+}
+
+// Len returns the number of keys in the store, expired ones included until pruned.
+func (m *MemoryDedupeStore) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.order.Len()
+}
+
+func (m *MemoryDedupeStore) remove(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.keys, element.Value.(*dedupeEntry).key)
+}
+
+// dedupeKeySeparator separates the attribute values composing a dedupe key
+const dedupeKeySeparator = "\x1f"
+
+// dedupeKey returns the dedupe key of msg: the one returned by DedupeKey, the values of the
+// DedupeKeyAttributes when set, otherwise its MessageId.
+func (s *SQS) dedupeKey(msg *sqs.Message) string {
+	if s.config.DedupeKey != nil {
+		return s.config.DedupeKey(s.message(msg))
+	}
+
+	if len(s.config.DedupeKeyAttributes) == 0 {
+		return aws.StringValue(msg.MessageId)
+	}
+
+	values := make([]string, len(s.config.DedupeKeyAttributes))
+
+	for i, name := range s.config.DedupeKeyAttributes {
+		if attribute, found := msg.MessageAttributes[name]; found && attribute != nil {
+			values[i] = aws.StringValue(attribute.StringValue)
+		}
+	}
+
+	return strings.Join(values, dedupeKeySeparator)
+}
+
+// skipDuplicates deletes the messages already processed and returns the others. Store failures
+// are logged and the message is processed anyway.
+func (s *SQS) skipDuplicates(messages []*sqs.Message) []*sqs.Message {
+	if s.config.DedupeStore == nil {
+		return messages
+	}
+
+	unseen := make([]*sqs.Message, 0, len(messages))
+	duplicates := make([]*sqs.Message, 0)
+
+	for _, msg := range messages {
+		key := s.dedupeKey(msg)
+		if key == "" {
+			unseen = append(unseen, msg)
+			continue
+		}
+
+		seen, err := s.config.DedupeStore.Seen(key)
+
+		switch {
+		case err != nil:
+			s.config.Logger.Errorf("%s", s.messageError(msg, err))
+			unseen = append(unseen, msg)
+		case seen:
+			s.config.Logger.Warnf("message %s already processed, skipping it", aws.StringValue(msg.MessageId))
+			duplicates = append(duplicates, msg)
+		default:
+			unseen = append(unseen, msg)
+		}
+	}
+
+	s.deleteSqsMessages(duplicates)
+
+	return unseen
+}
+
+// markProcessed records the messages as processed in the DedupeStore.
+func (s *SQS) markProcessed(messages []*sqs.Message) {
+	if s.config.DedupeStore == nil {
+		return
+	}
+
+	for _, msg := range messages {
+		key := s.dedupeKey(msg)
+		if key == "" {
+			continue
+		}
+
+		if err := s.config.DedupeStore.Mark(key, s.config.DedupeTTL); err != nil {
+			s.config.Logger.Errorf("%s", s.messageError(msg, err))
+		}
+	}
+}
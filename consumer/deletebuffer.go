@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"sync"
+	"time"
+)
+
+// maxDeleteBatch is the maximum number of entries of a DeleteMessageBatch request
+const maxDeleteBatch = 10
+
+// deleteBuffer accumulates the deletions of the workers when DeleteFlushInterval is set.
+type deleteBuffer struct {
+	lock    sync.Mutex
+	pending []pendingDelete
+	timer   *time.Timer
+}
+
+// pendingDelete is a buffered deletion, done receives whether the message has been deleted.
+type pendingDelete struct {
+	msg  *sqs.Message
+	done chan bool
+}
+
+// bufferDeletes buffers the deletion of msg, flushing full batches right away and the others after
+// DeleteFlushInterval, and returns the deleted messages once all of them have been flushed.
+func (s *SQS) bufferDeletes(msg []*sqs.Message) []*sqs.Message {
+	if len(msg) == 0 {
+		return nil
+	}
+
+	pending := make([]pendingDelete, len(msg))
+	for i, v := range msg {
+		pending[i] = pendingDelete{msg: v, done: make(chan bool, 1)}
+	}
+
+	var full [][]pendingDelete
+
+	s.deletes.lock.Lock()
+	if len(s.deletes.pending) == 0 {
+		s.deletes.timer = time.AfterFunc(s.config.DeleteFlushInterval, s.flushDeletes)
+	}
+	s.deletes.pending = append(s.deletes.pending, pending...)
+	for len(s.deletes.pending) >= maxDeleteBatch {
+		full = append(full, s.deletes.pending[:maxDeleteBatch])
+		s.deletes.pending = s.deletes.pending[maxDeleteBatch:]
+	}
+	if len(full) > 0 && len(s.deletes.pending) == 0 {
+		s.deletes.timer.Stop()
+	}
+	s.deletes.lock.Unlock()
+
+	for _, batch := range full {
+		s.deletePending(batch)
+	}
+
+	deleted := make([]*sqs.Message, 0, len(msg))
+	for _, p := range pending {
+		if <-p.done {
+			deleted = append(deleted, p.msg)
+		}
+	}
+
+	return deleted
+}
+
+// flushDeletes deletes all the buffered messages, it is invoked when DeleteFlushInterval elapsed.
+func (s *SQS) flushDeletes() {
+	s.deletes.lock.Lock()
+	pending := s.deletes.pending
+	s.deletes.pending = nil
+	s.deletes.lock.Unlock()
+
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > maxDeleteBatch {
+			n = maxDeleteBatch
+		}
+		s.deletePending(pending[:n])
+		pending = pending[n:]
+	}
+}
+
+// deletePending deletes a batch of buffered deletions and notifies their outcome.
+func (s *SQS) deletePending(batch []pendingDelete) {
+	msg := make([]*sqs.Message, len(batch))
+	for i, p := range batch {
+		msg[i] = p.msg
+	}
+
+	deleted := make(map[*sqs.Message]struct{}, len(batch))
+	for _, v := range s.deleteNow(msg) {
+		deleted[v] = struct{}{}
+	}
+
+	for _, p := range batch {
+		_, ok := deleted[p.msg]
+		p.done <- ok
+	}
+}
@@ -0,0 +1,42 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// queueError adds the queue to err, wrapping it so that errors.Is and errors.As keep working.
+func (s *SQS) queueError(op string, err error) error {
+	return &queueErr{op: op, queue: s.config.Queue, err: err}
+}
+
+// wrapQueueError is queueError, unless err already carries the queue.
+func (s *SQS) wrapQueueError(op string, err error) error {
+	var qe *queueErr
+	if errors.As(err, &qe) {
+		return err
+	}
+	return s.queueError(op, err)
+}
+
+// queueErr is an error built by queueError.
+type queueErr struct {
+	op    string
+	queue string
+	err   error
+}
+
+func (e *queueErr) Error() string {
+	return fmt.Sprintf("%s on queue %s: %s", e.op, e.queue, e.err)
+}
+
+func (e *queueErr) Unwrap() error {
+	return e.err
+}
+
+// messageError adds the queue and the message id to err, wrapping it so that errors.Is and errors.As keep working.
+func (s *SQS) messageError(msg *sqs.Message, err error) error {
+	return fmt.Errorf("message %s on queue %s: %w", aws.StringValue(msg.MessageId), s.config.Queue, err)
+}
@@ -0,0 +1,148 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"io/ioutil"
+	"strings"
+)
+
+// S3Client is the subset of the S3 API used to fetch the payloads of the SQS Extended Client, satisfied by *s3.S3.
+type S3Client interface {
+	GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error)
+}
+
+// S3Pointer is the location of a payload offloaded to S3 by the SQS Extended Client.
+type S3Pointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// parseS3Pointer parses the body written by the SQS Extended Client in place of an offloaded payload,
+// e.g. ["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"key"}].
+func parseS3Pointer(body []byte) (S3Pointer, bool) {
+	var pointer []json.RawMessage
+	if err := json.Unmarshal(body, &pointer); err != nil || len(pointer) != 2 {
+		return S3Pointer{}, false
+	}
+
+	var class string
+	if err := json.Unmarshal(pointer[0], &class); err != nil || !strings.HasSuffix(class, "S3Pointer") {
+		return S3Pointer{}, false
+	}
+
+	var location S3Pointer
+	if err := json.Unmarshal(pointer[1], &location); err != nil || location.Bucket == "" || location.Key == "" {
+		return S3Pointer{}, false
+	}
+
+	return location, true
+}
+
+// payload is the body of a message fetched from S3 and/or decompressed, kept until its message is released.
+type payload struct {
+	pointer      S3Pointer
+	body         []byte
+	decompressed bool
+}
+
+// fetchPayloads fetches from S3 the payloads of the messages offloaded by the SQS Extended Client, so that the
+// consumer function receives them in place of their pointer. It is a no-op when S3Client is not set.
+func (s *SQS) fetchPayloads(ctx context.Context, messages []*sqs.Message) error {
+	if s.config.S3Client == nil {
+		return nil
+	}
+
+	for _, msg := range messages {
+		if _, fetched := s.payloads.Load(msg); fetched {
+			continue
+		}
+
+		pointer, ok := parseS3Pointer(s.message(msg).Body)
+		if !ok {
+			continue
+		}
+
+		out, err := s.config.S3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(pointer.Bucket),
+			Key:    aws.String(pointer.Key),
+		})
+		if err != nil {
+			return fmt.Errorf("error fetching payload s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+		}
+
+		body, err := ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error reading payload s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+		}
+
+		s.payloads.Store(msg, payload{pointer: pointer, body: body})
+	}
+
+	return nil
+}
+
+// payloadBody returns the payload fetched from S3 for msg, if any.
+func (s *SQS) payloadBody(msg *sqs.Message) ([]byte, bool) {
+	p, ok := s.payloads.Load(msg)
+	if !ok {
+		return nil, false
+	}
+	return p.(payload).body, true
+}
+
+// decodeBodies fetches the payloads from S3 and decompresses the bodies of messages.
+func (s *SQS) decodeBodies(ctx context.Context, messages []*sqs.Message) error {
+	if err := s.fetchPayloads(ctx, messages); err != nil {
+		return err
+	}
+
+	return s.decompressBodies(messages)
+}
+
+// deletePayloads deletes from S3 the payloads of the deleted messages among the processed ones, unless
+// KeepS3Payloads is set. The payloads of the dead lettered messages are kept, their copies still point to them.
+func (s *SQS) deletePayloads(processed []*sqs.Message, deleted []*sqs.Message) {
+	if s.config.S3Client == nil || s.config.KeepS3Payloads {
+		return
+	}
+
+	succeeded := make(map[*sqs.Message]struct{}, len(processed))
+	for _, msg := range processed {
+		succeeded[msg] = struct{}{}
+	}
+
+	for _, msg := range deleted {
+		p, ok := s.payloads.Load(msg)
+		if _, processed := succeeded[msg]; !ok || !processed || p.(payload).pointer.Key == "" {
+			continue
+		}
+
+		pointer := p.(payload).pointer
+		_, err := s.config.S3Client.DeleteObjectWithContext(aws.BackgroundContext(), &s3.DeleteObjectInput{
+			Bucket: aws.String(pointer.Bucket),
+			Key:    aws.String(pointer.Key),
+		})
+		if err != nil {
+			s.config.Logger.Warnf("%s", s.messageError(msg, fmt.Errorf("error deleting payload s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)))
+		}
+	}
+}
+
+// forgetPayloads drops the payloads fetched for messages.
+func (s *SQS) forgetPayloads(messages []*sqs.Message) {
+	if s.config.S3Client == nil && !s.config.Decompress {
+		return
+	}
+
+	for _, msg := range messages {
+		s.payloads.Delete(msg)
+	}
+}
@@ -0,0 +1,150 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in memory bucket keyed by bucket/key
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]string
+	deleted []string
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	object, found := f.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !found {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewBufferString(object))}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(_ aws.Context, in *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.deleted = append(f.deleted, aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestSQS_processMessagesExtendedPayloads(t *testing.T) {
+	store := &fakeS3{objects: map[string]string{
+		"bucket/key1": "large payload 1",
+		"bucket/key2": "large payload 2",
+	}}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, S3Client: store}, newMockSQS())
+	assert.NoError(t, err)
+
+	messages := s.acquire([]*sqs.Message{
+		mockMessage("msg1", "handle1", `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"key1"}]`),
+		mockMessage("msg2", "handle2", `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"key2"}]`),
+		mockMessage("msg3", "handle3", `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"missing"}]`),
+		mockMessage("msg4", "handle4", `["not", "a pointer"]`),
+	})
+
+	var lock sync.Mutex
+	bodies := make(map[string]string)
+
+	err = s.processMessages(context.Background(), messages, func(ctx context.Context, msg Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		bodies[msg.MessageId] = string(msg.Body)
+		if msg.MessageId == "msg2" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"msg1": "large payload 1",
+		"msg2": "large payload 2",
+		"msg4": `["not", "a pointer"]`,
+	}, bodies)
+	// payloads of failed messages are kept for their redelivery
+	assert.Equal(t, []string{"bucket/key1"}, store.deleted)
+
+	_, fetched := s.payloadBody(messages[0])
+	assert.False(t, fetched)
+}
+
+func TestSQS_StartWithBatchResultExtendedPayloads(t *testing.T) {
+	pointer := func(key string) string {
+		return `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"` + key + `"}]`
+	}
+
+	starts := map[string]func(s *SQS, ctx context.Context, consumed func(msgs []Message)) error{
+		"batch result": func(s *SQS, ctx context.Context, consumed func(msgs []Message)) error {
+			return s.StartWithBatchResult(ctx, func(ctx context.Context, msgs []Message) ([]Result, error) {
+				consumed(msgs)
+				return []Result{{Ack: true}, {Ack: false, RetryAfter: time.Minute}}, nil
+			})
+		},
+		"batch failures": func(s *SQS, ctx context.Context, consumed func(msgs []Message)) error {
+			return s.StartWithBatchFailures(ctx, func(ctx context.Context, msgs []Message) ([]string, error) {
+				consumed(msgs)
+				return []string{"msg2"}, nil
+			})
+		},
+	}
+
+	for name, start := range starts {
+		t.Run(name, func(t *testing.T) {
+			store := &fakeS3{objects: map[string]string{
+				"bucket/key1": "large payload 1",
+				"bucket/key2": "large payload 2",
+			}}
+
+			svc := newMockSQS(
+				[]*sqs.Message{mockMessage("msg1", "handle1", pointer("key1")), mockMessage("msg2", "handle2", pointer("key2"))},
+				[]*sqs.Message{mockMessage("msg3", "handle3", pointer("missing")), mockMessage("msg4", "handle4", "msg4")},
+			)
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, S3Client: store}, svc)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			var bodies []string
+			err = start(s, ctx, func(msgs []Message) {
+				for _, msg := range msgs {
+					bodies = append(bodies, string(msg.Body))
+				}
+			})
+			assert.NoError(t, err)
+
+			// a payload that can't be fetched fails the whole batch without invoking the consumer function
+			assert.Equal(t, []string{"large payload 1", "large payload 2"}, bodies)
+			assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+			assert.Equal(t, []string{"bucket/key1"}, store.deleted)
+		})
+	}
+}
+
+func TestParseS3Pointer(t *testing.T) {
+	pointer, ok := parseS3Pointer([]byte(`["com.amazon.sqs.javamessaging.MessageS3Pointer",{"s3BucketName":"bucket","s3Key":"key"}]`))
+	assert.True(t, ok)
+	assert.Equal(t, S3Pointer{Bucket: "bucket", Key: "key"}, pointer)
+
+	_, ok = parseS3Pointer([]byte(`{"s3BucketName":"bucket","s3Key":"key"}`))
+	assert.False(t, ok)
+
+	_, ok = parseS3Pointer([]byte(`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket"}]`))
+	assert.False(t, ok)
+}
@@ -0,0 +1,31 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// logFailedMessage logs the whole message failed with err, with the body passed to the consumer function (e.g.
+// fetched from S3 or decompressed), redacted by the Redactor and truncated to MaxLoggedBodyBytes.
+func (s *SQS) logFailedMessage(msg *sqs.Message, err error) {
+	if !s.config.LogMessageOnFailure {
+		return
+	}
+
+	decoded := *msg
+	decoded.Body = aws.String(string(s.message(msg).Body))
+	msg = s.redact(&decoded)
+
+	body := aws.StringValue(msg.Body)
+	if len(body) > s.config.MaxLoggedBodyBytes {
+		body = truncate(body, s.config.MaxLoggedBodyBytes) + "...(truncated)"
+	}
+
+	attributes := make(map[string]string, len(msg.MessageAttributes))
+	for name, value := range msg.MessageAttributes {
+		attributes[name] = value.String()
+	}
+
+	s.logger(EventHandlerError, msg, err).Errorf("failed %s body=%q attributes=%v message_attributes=%v",
+		s.messageError(msg, err), body, aws.StringValueMap(msg.Attributes), attributes)
+}
@@ -0,0 +1,22 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strings"
+)
+
+// fifoSuffix is the suffix of the FIFO queues names
+const fifoSuffix = ".fifo"
+
+func isFIFO(queue string) bool {
+	return strings.HasSuffix(queue, fifoSuffix)
+}
+
+// fifoGroup returns the MessageGroupId of msg when consuming a FIFO queue, the empty string otherwise.
+func (s *SQS) fifoGroup(msg *sqs.Message) string {
+	if !s.config.FIFO {
+		return ""
+	}
+	return aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+}
@@ -0,0 +1,81 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// FollowUp is a message produced by a ConsumerFnWithFollowUp, enqueued before deleting the consumed message.
+type FollowUp struct {
+	// Queue is the url of the queue receiving the message, defaults to SQSConf.NextQueue
+	Queue string
+	Body  []byte
+	// Attributes are sent as String message attributes
+	Attributes   map[string]string
+	DelaySeconds int64
+}
+
+// ConsumerFnWithFollowUp is a consumer function that can chain a follow-up message to the consumed one,
+// e.g. to build lightweight pipeline stages. A nil FollowUp behaves like a ConsumerFnWithMeta.
+type ConsumerFnWithFollowUp func(ctx context.Context, msg Message) (*FollowUp, error)
+
+// StartWithFollowUp consumes the queue like StartWithMeta, sending the follow-up messages returned by consumeFn.
+// The follow-up is sent before deleting the consumed message, so that a crash can't break the chain: when
+// sending fails the consumed message is not deleted and will be processed again.
+func (s *SQS) StartWithFollowUp(ctx context.Context, consumeFn ConsumerFnWithFollowUp) error {
+	return s.StartWithMeta(ctx, s.withFollowUp(consumeFn))
+}
+
+func (s *SQS) withFollowUp(consumeFn ConsumerFnWithFollowUp) ConsumerFnWithMeta {
+	return func(ctx context.Context, msg Message) error {
+		followUp, err := consumeFn(ctx, msg)
+
+		if err != nil || followUp == nil {
+			return err
+		}
+
+		return s.sendFollowUp(ctx, followUp)
+	}
+}
+
+func (s *SQS) sendFollowUp(ctx context.Context, followUp *FollowUp) error {
+	queue := followUp.Queue
+	if queue == "" {
+		queue = s.config.NextQueue
+	}
+
+	if queue == "" {
+		return errors.New("follow-up message without queue and NextQueue not set")
+	}
+
+	attributes := make(map[string]*sqs.MessageAttributeValue, len(followUp.Attributes))
+
+	for name, value := range followUp.Attributes {
+		attributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queue),
+		MessageBody:       aws.String(string(followUp.Body)),
+		MessageAttributes: attributes,
+	}
+
+	// per message delays are not supported by fifo queues: don't send it unless requested
+	if followUp.DelaySeconds > 0 {
+		input.DelaySeconds = aws.Int64(followUp.DelaySeconds)
+	}
+
+	_, err := s.sqs.SendMessageWithContext(ctx, input, s.config.RequestOptions...)
+
+	if err != nil {
+		return fmt.Errorf("error sending follow-up message to %s: %w", queue, err)
+	}
+
+	return nil
+}
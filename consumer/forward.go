@@ -0,0 +1,127 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"time"
+)
+
+// forward sends a copy (body and attributes) of the messages to queue with SendMessageBatch, retrying the
+// failed entries up to SendRetries times, and returns the messages successfully forwarded. Messages forwarded
+// to a FIFO queue keep their MessageGroupId and are deduplicated by their MessageId.
+// Callers must never delete a message that has not been forwarded.
+func (s *SQS) forward(queue string, messages []*sqs.Message) []*sqs.Message {
+	forwarded := make([]*sqs.Message, 0, len(messages))
+
+	for _, chunk := range sendChunks(messages) {
+		sent, pending, err := s.sendBatch(queue, chunk)
+		forwarded = append(forwarded, sent...)
+
+		for attempt := 1; len(pending) > 0 && attempt <= s.config.SendRetries; attempt++ {
+			time.Sleep(time.Duration(attempt) * SendRetryBackoff)
+			sent, pending, err = s.sendBatch(queue, pending)
+			forwarded = append(forwarded, sent...)
+		}
+
+		for _, msg := range pending {
+			s.config.Logger.Errorf("%s", s.messageError(msg, fmt.Errorf("error forwarding message to %s: %w", queue, err)))
+		}
+	}
+
+	return forwarded
+}
+
+// sendBatch sends up to 10 messages to queue, returning the ones sent, the ones worth retrying and the error
+// that made them fail. Entries failed because of the sender are not retried.
+func (s *SQS) sendBatch(queue string, messages []*sqs.Message) ([]*sqs.Message, []*sqs.Message, error) {
+	batch := make([]*sqs.SendMessageBatchRequestEntry, len(messages))
+
+	for i, msg := range messages {
+		batch[i] = &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       msg.Body,
+			MessageAttributes: copyAttributes(msg.MessageAttributes),
+		}
+
+		if isFIFO(queue) {
+			group := msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+			if aws.StringValue(group) == "" {
+				// messages of standard queues have no group: don't order them
+				group = msg.MessageId
+			}
+			batch[i].MessageGroupId = group
+			batch[i].MessageDeduplicationId = msg.MessageId
+		}
+	}
+
+	out, err := s.sqs.SendMessageBatchWithContext(aws.BackgroundContext(), &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(queue),
+		Entries:  batch,
+	}, s.config.RequestOptions...)
+
+	if err != nil {
+		return nil, messages, err
+	}
+
+	sent := make([]*sqs.Message, 0, len(out.Successful))
+	for _, ok := range out.Successful {
+		i, _ := strconv.Atoi(aws.StringValue(ok.Id))
+		sent = append(sent, messages[i])
+	}
+
+	retry := make([]*sqs.Message, 0)
+	for _, failed := range out.Failed {
+		i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+		err = fmt.Errorf("%s %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+
+		if aws.BoolValue(failed.SenderFault) {
+			s.config.Logger.Errorf("%s", s.messageError(messages[i], fmt.Errorf("error forwarding message to %s: %w", queue, err)))
+			continue
+		}
+
+		retry = append(retry, messages[i])
+	}
+
+	return sent, retry, err
+}
+
+// sendChunks splits messages into batches of up to 10 messages whose size doesn't exceed the 256KB payload
+// of a SendMessageBatch. A message exceeding it alone is sent alone.
+func sendChunks(messages []*sqs.Message) [][]*sqs.Message {
+	chunks := make([][]*sqs.Message, 0, len(messages)/10+1)
+	current, size := make([]*sqs.Message, 0, 10), 0
+
+	for _, msg := range messages {
+		msgSize := entrySize(msg.Body, msg.MessageAttributes)
+
+		if len(current) == 10 || (len(current) > 0 && size+msgSize > maxBatchBytes) { //max batch size for sqs is 10
+			chunks = append(chunks, current)
+			current, size = make([]*sqs.Message, 0, 10), 0
+		}
+
+		current = append(current, msg)
+		size += msgSize
+	}
+
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+func copyAttributes(attributes map[string]*sqs.MessageAttributeValue) map[string]*sqs.MessageAttributeValue {
+	copied := make(map[string]*sqs.MessageAttributeValue, len(attributes))
+
+	for name, value := range attributes {
+		copied[name] = &sqs.MessageAttributeValue{
+			DataType:    value.DataType,
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
+		}
+	}
+
+	return copied
+}
@@ -0,0 +1,78 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+)
+
+// groupLimiter bounds the number of messages of the same group processed concurrently, semaphores are
+// created on demand and dropped as soon as no message of the group is in flight.
+type groupLimiter struct {
+	lock   sync.Mutex
+	groups map[string]*groupSemaphore
+}
+
+type groupSemaphore struct {
+	slots chan struct{}
+	users int
+}
+
+// acquire blocks until a slot of group is available or ctx is done, the returned function releases it.
+func (g *groupLimiter) acquire(ctx context.Context, group string, limit int) (func(), error) {
+	sem := g.join(group, limit)
+
+	select {
+	case sem.slots <- struct{}{}:
+		return g.releaser(group, sem), nil
+	case <-ctx.Done():
+		g.leave(group, sem)
+		return nil, ctx.Err()
+	}
+}
+
+// tryAcquire acquires a slot of group only when one is available right away.
+func (g *groupLimiter) tryAcquire(group string, limit int) (func(), bool) {
+	sem := g.join(group, limit)
+
+	select {
+	case sem.slots <- struct{}{}:
+		return g.releaser(group, sem), true
+	default:
+		g.leave(group, sem)
+		return nil, false
+	}
+}
+
+func (g *groupLimiter) join(group string, limit int) *groupSemaphore {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.groups == nil {
+		g.groups = make(map[string]*groupSemaphore)
+	}
+	sem, found := g.groups[group]
+	if !found {
+		sem = &groupSemaphore{slots: make(chan struct{}, limit)}
+		g.groups[group] = sem
+	}
+	sem.users++
+
+	return sem
+}
+
+func (g *groupLimiter) releaser(group string, sem *groupSemaphore) func() {
+	return func() {
+		<-sem.slots
+		g.leave(group, sem)
+	}
+}
+
+func (g *groupLimiter) leave(group string, sem *groupSemaphore) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	sem.users--
+	if sem.users == 0 {
+		delete(g.groups, group)
+	}
+}
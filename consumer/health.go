@@ -0,0 +1,60 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHealthReceiveErrors is the default number of consecutive failed receives making the consumer unhealthy
+const DefaultHealthReceiveErrors = 3
+
+// ErrNotStarted is returned by Healthy when the consumer has not been started yet.
+var ErrNotStarted = errors.New("consumer not started")
+
+// Healthy returns nil when the consumer is working, otherwise an error explaining why it is not, e.g. to
+// back a liveness probe. A consumer is unhealthy when closed, not started, after HealthReceiveErrors
+// consecutive failed receives (e.g. expired credentials or missing permissions) and, when HealthReceiveTimeout
+// is set, when no receive succeeded for that long while some workers were idle. Paused consumers and open
+// circuit breakers are not reported as unhealthy.
+func (s *SQS) Healthy() error {
+	s.lifecycle.Lock()
+	closed, startedAt := s.closed, s.startedAt
+	s.lifecycle.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	if startedAt.IsZero() {
+		return ErrNotStarted
+	}
+
+	s.stats.lock.Lock()
+	receiveErrors, lastErr, lastReceive := s.stats.receiveErrors, s.stats.lastReceiveError, s.stats.lastReceive
+	s.stats.lock.Unlock()
+
+	if receiveErrors >= s.config.HealthReceiveErrors {
+		return fmt.Errorf("%d consecutive receive errors: %w", receiveErrors, lastErr)
+	}
+
+	if s.config.HealthReceiveTimeout <= 0 || s.Paused() || s.CircuitState() != CircuitClosed {
+		return nil
+	}
+
+	// workers busy with slow messages don't receive
+	if int(atomic.LoadInt32(&s.busyWorkers)) >= s.Concurrency() {
+		return nil
+	}
+
+	if lastReceive.IsZero() {
+		lastReceive = startedAt.Add(s.config.InitialDelay)
+	}
+
+	if elapsed := time.Since(lastReceive); elapsed > s.config.HealthReceiveTimeout {
+		return fmt.Errorf("no successful receive since %s", elapsed.Truncate(time.Second))
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"sync"
+	"time"
+)
+
+// heartbeat extends the visibility of the messages by VisibilityTimeout every HeartbeatInterval, so that
+// they don't become visible again while being processed. The heartbeat stops when ctx is done or when
+// the returned function is invoked, once it returns no more extensions are issued.
+func (s *SQS) heartbeat(ctx context.Context, messages []*sqs.Message) func() {
+	if s.config.HeartbeatInterval <= 0 || len(messages) == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(s.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.changeSqsMessagesVisibility(messages, s.config.VisibilityTimeout); err != nil {
+					s.logger(EventVisibilityError, nil, err).Warnf("%s", s.queueError("error extending messages visibility", err))
+					continue
+				}
+				s.config.Metrics.IncVisibilityExtended(len(messages))
+				s.logger(EventVisibilityExtended, nil, nil).Debugf("extended the visibility of %d messages on queue %s", len(messages), s.config.Queue)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,59 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"time"
+)
+
+// Hooks are optional callbacks invoked by the consumer on notable events, nil hooks are skipped.
+type Hooks struct {
+	// OnReceive is invoked for every message received from the queue, before it is processed.
+	OnReceive func(msg Message)
+	// OnSuccess is invoked for every message processed successfully, elapsed is the time since it was received.
+	OnSuccess func(msg Message, elapsed time.Duration)
+	// OnFailure is invoked for every message the consumer function failed with err, like OnError, elapsed
+	// being the time since it was received.
+	OnFailure func(msg Message, err error, elapsed time.Duration)
+	// OnDelete is invoked for every message deleted from the queue, elapsed is the time since it was received
+	// and is 0 when the message was not in flight.
+	OnDelete func(msg Message, elapsed time.Duration)
+	// OnRestart is invoked when a supervised loop died unexpectedly and is going to be restarted,
+	// recovered is the value the loop panicked with.
+	OnRestart func(loop string, recovered interface{})
+	// OnActivity is invoked when the queue turns from idle to active: the first time a receive
+	// returns messages after one or more empty receives.
+	OnActivity func()
+	// OnError is invoked for every message the consumer function failed with err, e.g. to count or route
+	// the failures. Batch consumers invoke it for every message of the failed batch.
+	OnError func(msg Message, err error)
+	// OnPanic is invoked for every message whose consumer function panicked with recovered, the message
+	// is then failed with a PanicError.
+	OnPanic func(msg Message, recovered interface{})
+	// OnPoisoned is invoked when a message failed with err after being received MaxReceiveCount times,
+	// right before it is forwarded to the DeadLetterQueue or dropped.
+	OnPoisoned func(msg Message, err error)
+	// OnMalformed is invoked when a message can't be processed because of its metadata, e.g. an unparsable
+	// deadline attribute. The message is left in the queue, subject to the queue redrive policy.
+	OnMalformed func(msg Message, err error)
+	// OnMaxNumberOfMessagesChange is invoked when AdaptiveMaxNumberOfMessages changes the number of
+	// messages requested on each receive.
+	OnMaxNumberOfMessagesChange func(n int64)
+	// OnConcurrencyChange is invoked when AdaptiveConcurrency changes the number of active workers,
+	// errorRate is the error rate of the window that drove the decision.
+	OnConcurrencyChange func(n int, errorRate float64)
+	// OnAutoscale is invoked when Autoscale changes the number of active workers to n, depth being
+	// the queue depth that drove the decision.
+	OnAutoscale func(n int, depth int)
+	// OnCircuitChange is invoked when the CircuitBreaker changes state, e.g. to alert when it opens.
+	OnCircuitChange func(state CircuitState)
+	// OnFatal is invoked when a receive fails with an error that retrying can't fix, e.g. AccessDenied or
+	// a queue that does not exist, right before the worker stops with it.
+	OnFatal func(err error)
+	// BeforeDelete is invoked right before a message is deleted from the queue, so its state can be
+	// captured (e.g. for auditing) even if the deletion fails. Returning an error vetoes the deletion:
+	// the message is kept and redelivered once visible again.
+	BeforeDelete func(msg *sqs.Message) error
+	// OnDeleteFailed is invoked when a message could not be deleted even after DeleteRetries retries,
+	// it can be used as a sink to investigate undeletable messages: they will be redelivered and reprocessed.
+	OnDeleteFailed func(msg *sqs.Message, err error)
+}
@@ -0,0 +1,74 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// IdempotencyKeyFn returns the idempotency key of a message, messages with an empty key are always processed.
+type IdempotencyKeyFn func(msg Message) string
+
+// IdempotencyConf configures Idempotent.
+type IdempotencyConf struct {
+	// Key returns the idempotency key of a message, required
+	Key IdempotencyKeyFn
+	// Store records the keys of the processed messages, defaults to a new MemoryDedupeStore. Shared
+	// stores (e.g. Redis with SET NX EX) make the idempotency hold across consumer instances.
+	Store DedupeStore
+	// TTL is how long a processed key is remembered, defaults to DefaultDedupeTTL
+	TTL time.Duration
+	// Logger receives the logs, defaults to the logrus standard logger
+	Logger Logger
+	// FailClosed decides what happens when the Store can't tell whether a key has been processed:
+	// by default (fail-open) the message is processed anyway, risking a duplicate; when set the message
+	// is not processed and left in the queue to be retried, risking a delay.
+	FailClosed bool
+}
+
+// Idempotent wraps consumeFn so that messages whose key has already been processed successfully are
+// not processed again, and deleted. Keys are recorded only when consumeFn succeeds, failing to record
+// them is logged and doesn't fail the message, that has been processed anyway.
+func Idempotent(conf IdempotencyConf, consumeFn ConsumerFnWithMeta) ConsumerFnWithMeta {
+	if conf.Store == nil {
+		conf.Store = NewMemoryDedupeStore()
+	}
+
+	if conf.TTL == 0 {
+		conf.TTL = DefaultDedupeTTL
+	}
+
+	if conf.Logger == nil {
+		conf.Logger = defaultLogger()
+	}
+
+	return func(ctx context.Context, msg Message) error {
+		key := conf.Key(msg)
+		if key == "" {
+			return consumeFn(ctx, msg)
+		}
+
+		seen, err := conf.Store.Seen(key)
+		if err != nil {
+			if conf.FailClosed {
+				return fmt.Errorf("error checking idempotency key %s: %w", key, err)
+			}
+			conf.Logger.Errorf("error checking idempotency key %s of message %s, processing it: %s", key, msg.MessageId, err)
+		}
+
+		if seen {
+			conf.Logger.Warnf("message %s with idempotency key %s already processed, skipping it", msg.MessageId, key)
+			return nil
+		}
+
+		if err := consumeFn(ctx, msg); err != nil {
+			return err
+		}
+
+		if err := conf.Store.Mark(key, conf.TTL); err != nil {
+			conf.Logger.Errorf("error recording idempotency key %s of message %s: %s", key, msg.MessageId, err)
+		}
+
+		return nil
+	}
+}
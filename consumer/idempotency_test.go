@@ -0,0 +1,86 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type failingDedupeStore struct{}
+
+func (failingDedupeStore) Seen(string) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func (failingDedupeStore) Mark(string, time.Duration) error {
+	return errors.New("store unavailable")
+}
+
+func TestIdempotent(t *testing.T) {
+	byOrder := func(msg Message) string { return msg.Attributes["order"] }
+
+	tests := []struct {
+		name          string
+		conf          IdempotencyConf
+		messages      []Message
+		wantProcessed []string
+		wantErr       bool
+	}{
+		{
+			name: "shouldSkipAlreadyProcessedKeys",
+			conf: IdempotencyConf{Key: byOrder},
+			messages: []Message{
+				{MessageId: "msg1", Attributes: map[string]string{"order": "1"}},
+				{MessageId: "msg2", Attributes: map[string]string{"order": "1"}},
+				{MessageId: "msg3", Attributes: map[string]string{"order": "2"}},
+			},
+			wantProcessed: []string{"msg1", "msg3"},
+		},
+		{
+			name: "shouldAlwaysProcessEmptyKeys",
+			conf: IdempotencyConf{Key: byOrder},
+			messages: []Message{
+				{MessageId: "msg1"},
+				{MessageId: "msg2"},
+			},
+			wantProcessed: []string{"msg1", "msg2"},
+		},
+		{
+			name: "shouldProcessOnStoreFailureWhenFailOpen",
+			conf: IdempotencyConf{Key: byOrder, Store: failingDedupeStore{}},
+			messages: []Message{
+				{MessageId: "msg1", Attributes: map[string]string{"order": "1"}},
+			},
+			wantProcessed: []string{"msg1"},
+		},
+		{
+			name: "shouldNotProcessOnStoreFailureWhenFailClosed",
+			conf: IdempotencyConf{Key: byOrder, Store: failingDedupeStore{}, FailClosed: true},
+			messages: []Message{
+				{MessageId: "msg1", Attributes: map[string]string{"order": "1"}},
+			},
+			wantProcessed: []string{},
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processed := make([]string, 0)
+
+			consumeFn := Idempotent(tt.conf, func(ctx context.Context, msg Message) error {
+				processed = append(processed, msg.MessageId)
+				return nil
+			})
+
+			for _, msg := range tt.messages {
+				err := consumeFn(context.Background(), msg)
+				assert.Equal(t, tt.wantErr, err != nil)
+			}
+
+			assert.Equal(t, tt.wantProcessed, processed)
+		})
+	}
+}
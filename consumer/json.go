@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DecodeError is returned by the JSON consumers when a message body can't be decoded. It reports
+// a 400 status, so that DefaultErrorClassifier forwards the message to the DeadLetterQueue, if any,
+// instead of retrying it forever.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("error decoding message: %s", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecodeError) StatusCode() int {
+	return 400
+}
+
+// JSONConsumer returns a ConsumerFn decoding the message body into T and invoking fn with it, fn is not
+// invoked when the body can't be decoded and a *DecodeError is returned instead.
+func JSONConsumer[T any](fn func(ctx context.Context, v T) error) ConsumerFn {
+	return func(data []byte) error {
+		return decodeJSON(context.Background(), data, fn)
+	}
+}
+
+// JSONConsumerWithMeta is JSONConsumer for StartWithMeta, fn gets the message context.
+func JSONConsumerWithMeta[T any](fn func(ctx context.Context, v T) error) ConsumerFnWithMeta {
+	return func(ctx context.Context, msg Message) error {
+		return decodeJSON(ctx, msg.Body, fn)
+	}
+}
+
+// HandleJSON consumes the queue like StartWithMeta, invoking fn with each message body decoded into T.
+// Malformed bodies fail with a *DecodeError going through the error path, e.g. Hooks.OnError and the DeadLetterQueue.
+func HandleJSON[T any](ctx context.Context, s *SQS, fn func(ctx context.Context, v T) error) error {
+	return s.StartWithMeta(ctx, JSONConsumerWithMeta(fn))
+}
+
+func decodeJSON[T any](ctx context.Context, data []byte, fn func(ctx context.Context, v T) error) error {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return fn(ctx, v)
+}
@@ -0,0 +1,81 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type testOrder struct {
+	Id     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+func TestJSONConsumer(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		want          []testOrder
+		wantDecodeErr bool
+	}{
+		{name: "shouldDecodeValidPayload", body: `{"id":"o1","amount":3}`, want: []testOrder{{Id: "o1", Amount: 3}}},
+		{name: "shouldFailMalformedPayload", body: `{"id":`, want: []testOrder{}, wantDecodeErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]testOrder, 0)
+
+			err := JSONConsumer(func(ctx context.Context, order testOrder) error {
+				got = append(got, order)
+				return nil
+			})([]byte(tt.body))
+
+			var decodeErr *DecodeError
+			assert.Equal(t, tt.wantDecodeErr, errors.As(err, &decodeErr))
+			assert.Equal(t, tt.want, got)
+
+			if tt.wantDecodeErr {
+				assert.Equal(t, DeadLetter, DefaultErrorClassifier(err))
+			}
+		})
+	}
+}
+
+func TestHandleJSON(t *testing.T) {
+	failures := make(map[string]error)
+
+	svc := newMockSQS([]*sqs.Message{
+		mockMessage("msg1", "handle1", `{"id":"o1","amount":3}`),
+		mockMessage("msg2", "handle2", `{"id":`),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:           "queue",
+		DeadLetterQueue: "dlq",
+		Hooks: Hooks{
+			OnError: func(msg Message, err error) {
+				failures[msg.MessageId] = err
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	got := make([]testOrder, 0)
+	err = HandleJSON(ctx, s, func(ctx context.Context, order testOrder) error {
+		got = append(got, order)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []testOrder{{Id: "o1", Amount: 3}}, got)
+	var decodeErr *DecodeError
+	assert.True(t, errors.As(failures["msg2"], &decodeErr))
+	assert.Equal(t, []string{`{"id":`}, svc.sentBodies("dlq"))
+	assert.ElementsMatch(t, []string{"handle1", "handle2"}, svc.deletedHandles())
+}
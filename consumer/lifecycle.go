@@ -0,0 +1,47 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"time"
+)
+
+// received notifies Hooks.OnReceive of the acquired messages.
+func (s *SQS) received(messages []*sqs.Message) {
+	if s.config.Hooks.OnReceive == nil {
+		return
+	}
+
+	for _, msg := range messages {
+		s.config.Hooks.OnReceive(s.message(msg))
+	}
+}
+
+// succeeded counts msg as processed and notifies Hooks.OnSuccess.
+func (s *SQS) succeeded(msg *sqs.Message) {
+	s.config.Metrics.IncProcessed()
+
+	if s.config.Hooks.OnSuccess != nil {
+		s.config.Hooks.OnSuccess(s.message(msg), s.sinceReceived(msg))
+	}
+}
+
+// deletedMessages notifies Hooks.OnDelete of the deleted messages.
+func (s *SQS) deletedMessages(messages []*sqs.Message) {
+	if s.config.Hooks.OnDelete == nil {
+		return
+	}
+
+	for _, msg := range messages {
+		s.config.Hooks.OnDelete(s.message(msg), s.sinceReceived(msg))
+	}
+}
+
+// sinceReceived returns the time elapsed since msg was received, 0 when it is not in flight.
+func (s *SQS) sinceReceived(msg *sqs.Message) time.Duration {
+	receivedAt := s.receivedAt(msg)
+	if receivedAt.IsZero() {
+		return 0
+	}
+
+	return time.Since(receivedAt)
+}
@@ -0,0 +1,77 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/sirupsen/logrus"
+)
+
+// Log events, the value of the "event" field of the structured logs
+const (
+	EventReceiveError       = "receive_error"
+	EventHandlerError       = "handler_error"
+	EventRetry              = "retry"
+	EventDeleteError        = "delete_error"
+	EventVisibilityError    = "visibility_error"
+	EventVisibilityExtended = "visibility_extended"
+	EventShutdown           = "shutdown"
+)
+
+// Logger receives the consumer internal logs, it is satisfied by *logrus.Logger and can be easily
+// implemented on top of other logging libraries.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Fields are the structured fields of a log event.
+type Fields map[string]interface{}
+
+// FieldLogger is a Logger accepting structured fields, e.g. backed by log/slog or zap: the events of the consumer
+// are logged with fields identifying them (event, queue, message_id, receive_count and error). *logrus.Logger
+// is recognized as well.
+type FieldLogger interface {
+	Logger
+	WithFields(fields Fields) Logger
+}
+
+// NoopLogger is a Logger discarding all the logs.
+type NoopLogger struct{}
+
+func (NoopLogger) Debugf(string, ...interface{}) {}
+
+func (NoopLogger) Infof(string, ...interface{}) {}
+
+func (NoopLogger) Warnf(string, ...interface{}) {}
+
+func (NoopLogger) Errorf(string, ...interface{}) {}
+
+// logger returns the Logger of event, adding its fields when the Logger is structured: msg and err are optional.
+func (s *SQS) logger(event string, msg *sqs.Message, err error) Logger {
+	fields := Fields{"event": event, "queue": s.config.Queue}
+
+	if msg != nil {
+		fields["message_id"] = aws.StringValue(msg.MessageId)
+		fields["receive_count"] = receiveCount(msg)
+	}
+
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+
+	switch logger := s.config.Logger.(type) {
+	case FieldLogger:
+		return logger.WithFields(fields)
+	case logrus.FieldLogger:
+		return logger.WithFields(logrus.Fields(fields))
+	}
+
+	return s.config.Logger
+}
+
+// defaultLogger is the Logger used when none is configured, the logrus standard logger
+func defaultLogger() Logger {
+	return logrus.StandardLogger()
+}
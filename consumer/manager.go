@@ -0,0 +1,169 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"sync"
+)
+
+// Route is a queue consumed by a Manager along with its handler.
+type Route struct {
+	Conf    *SQSConf
+	Handler ConsumerFnWithMeta
+	// Weight is the share of ManagerConf.Concurrency given to the queue, defaults to 1.
+	Weight int
+}
+
+// ManagerConf configures a Manager.
+type ManagerConf struct {
+	// Concurrency, when set, is the total number of workers polling the queues, split among them according
+	// to the Route weights (at least one per queue) and overriding their own Concurrency.
+	Concurrency int
+	// Metrics is shared by the consumers not having their own MetricsCollector, it is closed once by
+	// Shutdown when it implements io.Closer.
+	Metrics MetricsCollector
+}
+
+// Manager runs the consumers of multiple queues with a shared lifecycle.
+type Manager struct {
+	conf      ManagerConf
+	routes    []Route
+	consumers []*SQS
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// sharedMetrics hides the io.Closer of the Manager metrics to the consumers, so that only the Manager closes it.
+type sharedMetrics struct {
+	MetricsCollector
+}
+
+// NewManager returns a Manager consuming the routes with svc.
+func NewManager(conf ManagerConf, svc SQSClient, routes ...Route) (*Manager, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("no route set")
+	}
+
+	// the routes and their confs are copied, leaving the caller ones untouched
+	routes = append([]Route(nil), routes...)
+
+	totalWeight := 0
+	for i := range routes {
+		if routes[i].Conf == nil || routes[i].Handler == nil {
+			return nil, fmt.Errorf("route %d: conf and handler must be set", i)
+		}
+		if routes[i].Weight <= 0 {
+			routes[i].Weight = 1
+		}
+		totalWeight += routes[i].Weight
+
+		conf := *routes[i].Conf
+		routes[i].Conf = &conf
+	}
+
+	m := &Manager{conf: conf, routes: routes}
+
+	for _, route := range routes {
+		if conf.Concurrency > 0 {
+			route.Conf.Concurrency = conf.Concurrency * route.Weight / totalWeight
+			if route.Conf.Concurrency < 1 {
+				route.Conf.Concurrency = 1
+			}
+		}
+
+		if route.Conf.Metrics == nil && conf.Metrics != nil {
+			route.Conf.Metrics = sharedMetrics{conf.Metrics}
+		}
+
+		s, err := NewSQSConsumer(route.Conf, svc)
+		if err != nil {
+			return nil, fmt.Errorf("queue %s: %w", route.Conf.Queue, err)
+		}
+
+		m.consumers = append(m.consumers, s)
+	}
+
+	return m, nil
+}
+
+// Consumers returns the consumers of the routes, in the same order.
+func (m *Manager) Consumers() []*SQS {
+	return m.consumers
+}
+
+// Start consumes all the queues until ctx is done or one of the consumers fails, in which case the
+// others are stopped and its error is returned.
+func (m *Manager) Start(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	for i, s := range m.consumers {
+		s, handler := s, m.routes[i].Handler
+		g.Go(func() error {
+			if err := s.StartWithMeta(ctx, handler); err != nil {
+				return s.wrapQueueError("error consuming", err)
+			}
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// Shutdown shuts down all the consumers concurrently, see SQS.Shutdown, then closes the shared Metrics once
+// they are all drained.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	return m.stop(func(s *SQS) error {
+		return s.Shutdown(ctx)
+	})
+}
+
+// Close closes all the consumers concurrently, each one draining its in flight messages within its DrainTimeout,
+// then closes the shared Metrics once they are all drained.
+func (m *Manager) Close() error {
+	return m.stop(func(s *SQS) error {
+		return s.Close()
+	})
+}
+
+// stop stops the consumers concurrently with stopFn, returning the first error and how many consumers failed.
+func (m *Manager) stop(stopFn func(s *SQS) error) error {
+	errs := make([]error, len(m.consumers))
+
+	var wg sync.WaitGroup
+	for i, s := range m.consumers {
+		wg.Add(1)
+		go func(i int, s *SQS) {
+			defer wg.Done()
+			if err := stopFn(s); err != nil {
+				errs[i] = s.wrapQueueError("error stopping consumer", err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	var first error
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("%d of %d consumers failed to stop: %w", failed, len(m.consumers), first)
+	}
+
+	m.closeOnce.Do(func() {
+		if closer, ok := m.conf.Metrics.(io.Closer); ok {
+			m.closeErr = closer.Close()
+		}
+	})
+
+	return m.closeErr
+}
@@ -0,0 +1,138 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueRouter dispatches the requests to the mock of their queue
+type queueRouter map[string]*mockSQS
+
+func (r queueRouter) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return r[aws.StringValue(in.QueueUrl)].ReceiveMessageWithContext(ctx, in, opts...)
+}
+
+func (r queueRouter) DeleteMessageBatchWithContext(ctx aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	return r[aws.StringValue(in.QueueUrl)].DeleteMessageBatchWithContext(ctx, in, opts...)
+}
+
+func (r queueRouter) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return r[aws.StringValue(in.QueueUrl)].ChangeMessageVisibilityBatchWithContext(ctx, in, opts...)
+}
+
+func (r queueRouter) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	return r[aws.StringValue(in.QueueUrl)].SendMessageWithContext(ctx, in, opts...)
+}
+
+func (r queueRouter) SendMessageBatchWithContext(ctx aws.Context, in *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	return r[aws.StringValue(in.QueueUrl)].SendMessageBatchWithContext(ctx, in, opts...)
+}
+
+func (r queueRouter) GetQueueAttributesWithContext(ctx aws.Context, in *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	return r[aws.StringValue(in.QueueUrl)].GetQueueAttributesWithContext(ctx, in, opts...)
+}
+
+type closingMetrics struct {
+	fakeMetrics
+	closed int
+}
+
+func (c *closingMetrics) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestManager(t *testing.T) {
+	svc := queueRouter{
+		"orders":   newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "order1"), mockMessage("msg2", "handle2", "order2")}),
+		"invoices": newMockSQS([]*sqs.Message{mockMessage("msg3", "handle3", "invoice1")}),
+	}
+
+	metrics := &closingMetrics{}
+
+	var lock sync.Mutex
+	consumed := make(map[string][]string)
+	handler := func(queue string) ConsumerFnWithMeta {
+		return func(ctx context.Context, msg Message) error {
+			lock.Lock()
+			defer lock.Unlock()
+			consumed[queue] = append(consumed[queue], string(msg.Body))
+			return nil
+		}
+	}
+
+	m, err := NewManager(ManagerConf{Concurrency: 4, Metrics: metrics}, svc,
+		Route{Conf: &SQSConf{Queue: "orders"}, Handler: handler("orders"), Weight: 3},
+		Route{Conf: &SQSConf{Queue: "invoices"}, Handler: handler("invoices")},
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, m.Consumers()[0].config.Concurrency)
+	assert.Equal(t, 1, m.Consumers()[1].config.Concurrency)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, m.Start(ctx))
+
+	assert.ElementsMatch(t, []string{"order1", "order2"}, consumed["orders"])
+	assert.Equal(t, []string{"invoice1"}, consumed["invoices"])
+	assert.Equal(t, 3, metrics.processed)
+	assert.ElementsMatch(t, []string{"handle1", "handle2"}, svc["orders"].deletedHandles())
+	assert.Equal(t, []string{"handle3"}, svc["invoices"].deletedHandles())
+
+	assert.NoError(t, m.Close())
+	assert.NoError(t, m.Close())
+	assert.Equal(t, 1, metrics.closed)
+
+	assert.True(t, errors.Is(m.Start(context.Background()), ErrClosed))
+}
+
+func TestNewManager(t *testing.T) {
+	_, err := NewManager(ManagerConf{}, newMockSQS())
+	assert.EqualError(t, err, "no route set")
+
+	_, err = NewManager(ManagerConf{}, newMockSQS(), Route{Conf: &SQSConf{}, Handler: func(ctx context.Context, msg Message) error {
+		return nil
+	}})
+	assert.EqualError(t, err, "queue : queue not set")
+
+	// the caller routes are left untouched
+	conf := &SQSConf{Queue: "queue"}
+	routes := []Route{{Conf: conf, Handler: func(ctx context.Context, msg Message) error {
+		return nil
+	}}}
+
+	m, err := NewManager(ManagerConf{Concurrency: 4}, newMockSQS(), routes...)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, m.Consumers()[0].config.Concurrency)
+	assert.Equal(t, 0, routes[0].Weight)
+	assert.Equal(t, 0, conf.Concurrency)
+}
+
+func TestManager_StartError(t *testing.T) {
+	svc := newMockSQS()
+	svc.receiveErrors = []error{awserr.New("AccessDenied", "access denied", nil)}
+
+	m, err := NewManager(ManagerConf{}, svc, Route{Conf: &SQSConf{Queue: "queue", Logger: NoopLogger{}}, Handler: func(ctx context.Context, msg Message) error {
+		return nil
+	}})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the queue is named once
+	err = m.Start(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 1, strings.Count(err.Error(), "queue queue"))
+}
@@ -0,0 +1,89 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+)
+
+// Message is a message received from the queue along with its metadata.
+type Message struct {
+	Body          []byte
+	MessageId     string
+	ReceiptHandle string
+	// Attributes holds the string values of the message attributes
+	Attributes map[string]string
+	// ReceiveCount is the number of times the message has been received (ApproximateReceiveCount),
+	// it can drive custom poison message handling.
+	ReceiveCount int
+	// SystemAttributes holds the received system attributes: SentTimestamp, ApproximateReceiveCount,
+	// AWSTraceHeader when traced and, on FIFO queues, MessageGroupId
+	SystemAttributes map[string]string
+	// Raw is the received message, exposing what is not mapped above (e.g. binary attributes). It is
+	// shared with the consumer and must not be modified.
+	Raw *sqs.Message
+	// SNS is the metadata of the SNS envelope the body has been unwrapped from, nil when UnwrapSNS
+	// is not set or the message is not an SNS notification.
+	SNS *SNSNotification
+}
+
+func newMessage(msg *sqs.Message) Message {
+	attributes := make(map[string]string, len(msg.MessageAttributes))
+
+	for name, value := range msg.MessageAttributes {
+		if value != nil && value.StringValue != nil {
+			attributes[name] = *value.StringValue
+		}
+	}
+
+	systemAttributes := make(map[string]string, len(msg.Attributes))
+
+	for name, value := range msg.Attributes {
+		if value != nil {
+			systemAttributes[name] = *value
+		}
+	}
+
+	return Message{
+		Body:             []byte(aws.StringValue(msg.Body)),
+		MessageId:        aws.StringValue(msg.MessageId),
+		ReceiptHandle:    aws.StringValue(msg.ReceiptHandle),
+		Attributes:       attributes,
+		ReceiveCount:     receiveCount(msg),
+		SystemAttributes: systemAttributes,
+		Raw:              msg,
+	}
+}
+
+// receiveCount returns the ApproximateReceiveCount of msg, 0 when unknown.
+func receiveCount(msg *sqs.Message) int {
+	count, _ := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	return count
+}
+
+// messageAttributeNames returns the message attributes to receive: MessageAttributeNames plus the ones
+// the consumer relies on, or all of them when MessageAttributeNames is not set.
+func (s *SQS) messageAttributeNames() []*string {
+	if len(s.config.MessageAttributeNames) == 0 {
+		return []*string{aws.String(sqs.QueueAttributeNameAll)}
+	}
+
+	names := append([]string{}, s.config.MessageAttributeNames...)
+	names = append(names, s.config.DedupeKeyAttributes...)
+
+	if s.config.Tracer != nil {
+		names = append(names, TraceAttributes...)
+	}
+
+	if s.config.Decompress {
+		names = append(names, ContentEncodingAttribute)
+	}
+
+	for _, name := range []string{s.config.DeadlineAttribute, s.config.DurationAttribute, s.config.GroupAttribute} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return aws.StringSlice(names)
+}
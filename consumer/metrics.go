@@ -0,0 +1,59 @@
+package consumer
+
+import "time"
+
+// MetricsCollector receives the consumer metrics, it can be implemented to export them
+// to the preferred monitoring system.
+type MetricsCollector interface {
+	// IncReceived counts the messages received
+	IncReceived(n int)
+	// IncProcessed counts the messages processed successfully
+	IncProcessed()
+	// IncFailed counts the messages the consumer function failed to process
+	IncFailed()
+	// IncDeleted counts the messages deleted from the queue
+	IncDeleted(n int)
+	// ObserveHandlerDuration records how long an invocation of the consumer function took
+	ObserveHandlerDuration(d time.Duration)
+	// IncEmptyReceive counts the receives returning no messages
+	IncEmptyReceive()
+	// IncVisibilityExtended counts the visibility extensions issued by the heartbeat
+	IncVisibilityExtended(n int)
+	// IncDeleteExhausted counts the messages that could not be deleted even after retrying
+	IncDeleteExhausted()
+	// ObserveReceiveBatchSize records the number of messages returned by a ReceiveMessage
+	ObserveReceiveBatchSize(n int)
+	// SetBackingOff reports whether the consumer is backing off because of errors
+	SetBackingOff(backingOff bool)
+	// SetLatencyEMA reports the smoothed processing latency in seconds, see Stats.LatencyEMA
+	SetLatencyEMA(seconds float64)
+	// SetThroughputEMA reports the smoothed number of messages processed per second, see Stats.ThroughputEMA
+	SetThroughputEMA(perSecond float64)
+}
+
+// NoopMetrics is a MetricsCollector discarding all the metrics.
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncReceived(int) {}
+
+func (NoopMetrics) IncProcessed() {}
+
+func (NoopMetrics) IncFailed() {}
+
+func (NoopMetrics) IncDeleted(int) {}
+
+func (NoopMetrics) ObserveHandlerDuration(time.Duration) {}
+
+func (NoopMetrics) IncEmptyReceive() {}
+
+func (NoopMetrics) IncVisibilityExtended(int) {}
+
+func (NoopMetrics) IncDeleteExhausted() {}
+
+func (NoopMetrics) ObserveReceiveBatchSize(int) {}
+
+func (NoopMetrics) SetBackingOff(bool) {}
+
+func (NoopMetrics) SetLatencyEMA(float64) {}
+
+func (NoopMetrics) SetThroughputEMA(float64) {}
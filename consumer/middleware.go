@@ -0,0 +1,51 @@
+package consumer
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a consumer function to add a cross-cutting concern, e.g. recovery, timeouts, logging or tracing.
+type Middleware func(next ConsumerFnWithMeta) ConsumerFnWithMeta
+
+// RecoverMiddleware turns a panic of the consumer function into a returned PanicError. Panics are always
+// recovered by the consumer, the middleware lets the outer middlewares observe the error.
+func RecoverMiddleware(next ConsumerFnWithMeta) ConsumerFnWithMeta {
+	return func(ctx context.Context, msg Message) (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				err = &PanicError{Recovered: recovered, Stack: debug.Stack()}
+			}
+		}()
+
+		return next(ctx, msg)
+	}
+}
+
+// TimeoutMiddleware cancels the context of the consumer function after d, the function is expected
+// to honor the cancellation and return.
+func TimeoutMiddleware(d time.Duration) Middleware {
+	return func(next ConsumerFnWithMeta) ConsumerFnWithMeta {
+		return func(ctx context.Context, msg Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Use appends middlewares to the configured Middlewares, they wrap the consumer function of every start
+// and must be added before the consumer is started.
+func (s *SQS) Use(middlewares ...Middleware) {
+	s.config.Middlewares = append(s.config.Middlewares, middlewares...)
+}
+
+// middleware wraps consumeFn with the configured Middlewares, the first one being the outermost.
+func (s *SQS) middleware(consumeFn ConsumerFnWithMeta) ConsumerFnWithMeta {
+	for i := len(s.config.Middlewares) - 1; i >= 0; i-- {
+		consumeFn = s.config.Middlewares[i](consumeFn)
+	}
+	return consumeFn
+}
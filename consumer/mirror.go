@@ -0,0 +1,21 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// mirrorMessages sends a copy of the messages to the MirrorQueue and returns the ones that can be processed:
+// when MirrorFatal is set the messages that could not be mirrored are left in the queue to be retried.
+func (s *SQS) mirrorMessages(messages []*sqs.Message) []*sqs.Message {
+	if s.config.MirrorQueue == "" || len(messages) == 0 {
+		return messages
+	}
+
+	mirrored := s.forward(s.config.MirrorQueue, messages)
+
+	if s.config.MirrorFatal {
+		return mirrored
+	}
+
+	return messages
+}
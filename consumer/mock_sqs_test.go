@@ -0,0 +1,230 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"sync"
+)
+
+// mockSQS is an in memory SQSClient returning the queued receive outputs in order,
+// and an empty output once they are exhausted.
+type mockSQS struct {
+	lock     sync.Mutex
+	receives []*sqs.ReceiveMessageOutput
+	// receiveErrors are returned, in order, by the receives preceding the queued outputs
+	receiveErrors []error
+	receiveSizes  []int64
+	deletes       []*sqs.DeleteMessageBatchInput
+	visibility    []*sqs.ChangeMessageVisibilityBatchInput
+	// visibilityErr fails every ChangeMessageVisibilityBatch
+	visibilityErr error
+	sent          map[string][]string
+	sendBatches   []*sqs.SendMessageBatchInput
+	// deleteFailures are the receipt handles whose deletion fails because of the sender
+	deleteFailures map[string]bool
+	// sendFailures is the number of times sending a message body fails before succeeding, in batches or alone
+	sendFailures map[string]int
+	// depths are returned, in order, as ApproximateNumberOfMessages, the last one once exhausted
+	depths []int
+}
+
+func newMockSQS(receives ...[]*sqs.Message) *mockSQS {
+	m := &mockSQS{}
+	for _, messages := range receives {
+		m.receives = append(m.receives, &sqs.ReceiveMessageOutput{Messages: messages})
+	}
+	return m
+}
+
+// withOutputs queues raw receive outputs, nil ones included
+func (m *mockSQS) withOutputs(outputs ...*sqs.ReceiveMessageOutput) *mockSQS {
+	m.receives = append(m.receives, outputs...)
+	return m
+}
+
+// apply runs opts against a request of operation, as the SDK would do
+func (m *mockSQS) apply(operation string, opts []request.Option) {
+	r := &request.Request{Operation: &request.Operation{Name: operation}}
+	r.ApplyOptions(opts...)
+}
+
+func (m *mockSQS) ReceiveMessageWithContext(_ aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	m.apply("ReceiveMessage", opts)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.receiveSizes = append(m.receiveSizes, aws.Int64Value(in.MaxNumberOfMessages))
+
+	if len(m.receiveErrors) > 0 {
+		err := m.receiveErrors[0]
+		m.receiveErrors = m.receiveErrors[1:]
+		return nil, err
+	}
+
+	if len(m.receives) == 0 {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+
+	out := m.receives[0]
+	m.receives = m.receives[1:]
+	return out, nil
+}
+
+func (m *mockSQS) DeleteMessageBatchWithContext(_ aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	m.apply("DeleteMessageBatch", opts)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.deletes = append(m.deletes, in)
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		if m.deleteFailures[aws.StringValue(entry.ReceiptHandle)] {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String(sqs.ErrCodeReceiptHandleIsInvalid),
+				SenderFault: aws.Bool(true),
+			})
+			continue
+		}
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+func (m *mockSQS) ChangeMessageVisibilityBatchWithContext(_ aws.Context, in *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	m.apply("ChangeMessageVisibilityBatch", opts)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.visibility = append(m.visibility, in)
+
+	if m.visibilityErr != nil {
+		return nil, m.visibilityErr
+	}
+
+	out := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, entry := range in.Entries {
+		out.Successful = append(out.Successful, &sqs.ChangeMessageVisibilityBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+func (m *mockSQS) SendMessageBatchWithContext(_ aws.Context, in *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	m.apply("SendMessageBatch", opts)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.sent == nil {
+		m.sent = make(map[string][]string)
+	}
+
+	m.sendBatches = append(m.sendBatches, in)
+
+	out := &sqs.SendMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		body := aws.StringValue(entry.MessageBody)
+
+		if m.sendFailures[body] > 0 {
+			m.sendFailures[body]--
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String(sqs.ErrCodeQueueDoesNotExist),
+				SenderFault: aws.Bool(false),
+			})
+			continue
+		}
+
+		queue := aws.StringValue(in.QueueUrl)
+		m.sent[queue] = append(m.sent[queue], body)
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+func (m *mockSQS) SendMessageWithContext(_ aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	m.apply("SendMessage", opts)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.sent == nil {
+		m.sent = make(map[string][]string)
+	}
+
+	body := aws.StringValue(in.MessageBody)
+
+	if m.sendFailures[body] > 0 {
+		m.sendFailures[body]--
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil)
+	}
+
+	queue := aws.StringValue(in.QueueUrl)
+	m.sent[queue] = append(m.sent[queue], body)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (m *mockSQS) GetQueueAttributesWithContext(_ aws.Context, _ *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	m.apply("GetQueueAttributes", opts)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	depth := 0
+	if len(m.depths) > 0 {
+		depth = m.depths[0]
+	}
+	if len(m.depths) > 1 {
+		m.depths = m.depths[1:]
+	}
+
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages: aws.String(strconv.Itoa(depth)),
+	}}, nil
+}
+
+func (m *mockSQS) sentBodies(queue string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.sent[queue]
+}
+
+func (m *mockSQS) deletedHandles() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	handles := make([]string, 0)
+	for _, in := range m.deletes {
+		for _, entry := range in.Entries {
+			handles = append(handles, aws.StringValue(entry.ReceiptHandle))
+		}
+	}
+	return handles
+}
+
+func mockMessage(id, handle, body string) *sqs.Message {
+	return &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String(handle),
+		Body:          aws.String(body),
+	}
+}
+
+func withAttribute(msg *sqs.Message, name, value string) *sqs.Message {
+	if msg.MessageAttributes == nil {
+		msg.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+	}
+	msg.MessageAttributes[name] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+	return msg
+}
@@ -0,0 +1,131 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SQS limits on the receive requests
+const (
+	MaxMaxNumberOfMessages = 10
+	MaxWaitTimeSeconds     = 20
+)
+
+// Option configures the consumer built by NewSQSConsumerWithOptions.
+type Option func(conf *SQSConf)
+
+func WithQueue(queue string) Option {
+	return func(conf *SQSConf) {
+		conf.Queue = queue
+	}
+}
+
+func WithConcurrency(concurrency int) Option {
+	return func(conf *SQSConf) {
+		conf.Concurrency = concurrency
+	}
+}
+
+func WithMaxNumberOfMessages(n int64) Option {
+	return func(conf *SQSConf) {
+		conf.MaxNumberOfMessages = n
+	}
+}
+
+func WithVisibilityTimeout(seconds int64) Option {
+	return func(conf *SQSConf) {
+		conf.VisibilityTimeout = seconds
+	}
+}
+
+func WithWaitTimeSeconds(seconds int64) Option {
+	return func(conf *SQSConf) {
+		conf.WaitTimeSeconds = seconds
+	}
+}
+
+func WithPollTimeout(timeout time.Duration) Option {
+	return func(conf *SQSConf) {
+		conf.PollTimeout = timeout
+	}
+}
+
+func WithHooks(hooks Hooks) Option {
+	return func(conf *SQSConf) {
+		conf.Hooks = hooks
+	}
+}
+
+func WithMetrics(metrics MetricsCollector) Option {
+	return func(conf *SQSConf) {
+		conf.Metrics = metrics
+	}
+}
+
+// WithConf applies fn to the configuration, for the settings without a dedicated Option.
+func WithConf(fn func(conf *SQSConf)) Option {
+	return Option(fn)
+}
+
+// NewSQSConsumerWithOptions builds a consumer configured by opts, failing like NewSQSConsumer when
+// the configuration is not valid.
+func NewSQSConsumerWithOptions(svc SQSClient, opts ...Option) (*SQS, error) {
+	conf := &SQSConf{}
+
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	return NewSQSConsumer(conf, svc)
+}
+
+// validate checks the configuration, defaults included, against the SQS limits rather than
+// letting SQS reject every request.
+func validate(conf *SQSConf) error {
+	if conf.Concurrency < 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", conf.Concurrency)
+	}
+
+	if conf.MaxNumberOfMessages < 1 || conf.MaxNumberOfMessages > MaxMaxNumberOfMessages {
+		return fmt.Errorf("max number of messages must be between 1 and %d, got %d", MaxMaxNumberOfMessages, conf.MaxNumberOfMessages)
+	}
+
+	if conf.WaitTimeSeconds < 0 || conf.WaitTimeSeconds > MaxWaitTimeSeconds {
+		return fmt.Errorf("wait time seconds must be between 0 and %d, got %d", MaxWaitTimeSeconds, conf.WaitTimeSeconds)
+	}
+
+	if maxVisibility := int64(MaxVisibilityTimeout / time.Second); conf.VisibilityTimeout < 0 || conf.VisibilityTimeout > maxVisibility {
+		return fmt.Errorf("visibility timeout must be between 0 and %d seconds, got %d", maxVisibility, conf.VisibilityTimeout)
+	}
+
+	if conf.HeartbeatInterval >= time.Duration(conf.VisibilityTimeout)*time.Second {
+		return fmt.Errorf("heartbeat interval must be shorter than the visibility timeout, got %s", conf.HeartbeatInterval)
+	}
+
+	if conf.AdaptiveConcurrency && conf.Autoscale {
+		return errors.New("adaptive concurrency and autoscale can't be combined")
+	}
+
+	if conf.CircuitBreaker.FailureRate < 0 || conf.CircuitBreaker.FailureRate >= 1 {
+		return fmt.Errorf("circuit breaker failure rate must be between 0 and 1, got %f", conf.CircuitBreaker.FailureRate)
+	}
+
+	if conf.HandlerTimeout < 0 && conf.HandlerTimeout != VisibilityHandlerTimeout {
+		return fmt.Errorf("handler timeout must be positive, got %s", conf.HandlerTimeout)
+	}
+
+	if conf.PollerCount < 0 {
+		return fmt.Errorf("poller count must be positive, got %d", conf.PollerCount)
+	}
+
+	if conf.RateLimit < 0 {
+		return fmt.Errorf("rate limit must be positive, got %f", conf.RateLimit)
+	}
+
+	if conf.Autoscale && conf.ScaleTarget < 0 {
+		return fmt.Errorf("scale target must be positive, got %d", conf.ScaleTarget)
+	}
+
+	return nil
+}
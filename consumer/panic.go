@@ -0,0 +1,42 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"runtime/debug"
+)
+
+// PanicError is the error the messages are failed with when the consumer function panicked, they are
+// then retried or dead lettered like for any other error.
+type PanicError struct {
+	Recovered interface{}
+	Stack     []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("consumer function panicked: %v", e.Recovered)
+}
+
+// recovering invokes fn, turning a panic into a PanicError: the stack trace is logged and Hooks.OnPanic
+// is invoked for every message processed by fn.
+func (s *SQS) recovering(messages []*sqs.Message, fn func() error) (err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		panicErr := &PanicError{Recovered: recovered, Stack: debug.Stack()}
+		s.logger(EventHandlerError, nil, panicErr).Errorf("%s\n%s", s.queueError("error processing messages", panicErr), panicErr.Stack)
+
+		if s.config.Hooks.OnPanic != nil {
+			for _, msg := range messages {
+				s.config.Hooks.OnPanic(s.message(msg), recovered)
+			}
+		}
+
+		err = panicErr
+	}()
+
+	return fn()
+}
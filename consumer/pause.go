@@ -0,0 +1,62 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+)
+
+// pauser holds the pause state of a consumer, resumed is open while paused and nil otherwise.
+type pauser struct {
+	lock    sync.Mutex
+	resumed chan struct{}
+}
+
+// Pause stops receiving messages until Resume is invoked, e.g. during a maintenance window of a downstream
+// service: the messages in flight are still processed, like the ones of the receives already issued.
+func (s *SQS) Pause() {
+	s.pause.lock.Lock()
+	defer s.pause.lock.Unlock()
+
+	if s.pause.resumed == nil {
+		s.pause.resumed = make(chan struct{})
+		s.config.Logger.Infof("consumer of queue %s paused", s.config.Queue)
+	}
+}
+
+// Resume resumes receiving messages after Pause.
+func (s *SQS) Resume() {
+	s.pause.lock.Lock()
+	defer s.pause.lock.Unlock()
+
+	if s.pause.resumed != nil {
+		close(s.pause.resumed)
+		s.pause.resumed = nil
+		s.config.Logger.Infof("consumer of queue %s resumed", s.config.Queue)
+	}
+}
+
+// Paused reports whether the consumer has been paused.
+func (s *SQS) Paused() bool {
+	s.pause.lock.Lock()
+	defer s.pause.lock.Unlock()
+
+	return s.pause.resumed != nil
+}
+
+// waitResumed blocks while the consumer is paused, returning false if ctx is done before it is resumed.
+func (s *SQS) waitResumed(ctx context.Context) bool {
+	s.pause.lock.Lock()
+	resumed := s.pause.resumed
+	s.pause.lock.Unlock()
+
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,82 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/sync/errgroup"
+	"sync"
+)
+
+// pipeline runs in g PollerCount pollers receiving messages and Concurrency workers processing them with
+// process. The handoff is unbuffered: pollers block until a worker is free, applying backpressure. The workers
+// stop once all the pollers are done, e.g. when MaxRuntime elapsed.
+func (s *SQS) pipeline(ctx context.Context, g *errgroup.Group, process func(ctx context.Context, messages []*sqs.Message) error, keepPolling func(ctx context.Context, loop func() error) error) {
+	received := make(chan []*sqs.Message)
+
+	handoff := func(_ context.Context, messages []*sqs.Message) error {
+		select {
+		case received <- messages:
+		case <-ctx.Done():
+			// never processed, the messages will be visible again after their visibility timeout
+			s.release(messages)
+		}
+		return nil
+	}
+
+	var pollers sync.WaitGroup
+	pollers.Add(s.config.PollerCount)
+
+	for i := 0; i < s.config.PollerCount; i++ {
+		g.Go(func() error {
+			defer pollers.Done()
+			return s.supervise(ctx, "poller", func() error {
+				// pollers are never parked, workers are
+				return keepPolling(ctx, func() error {
+					return s.poll(ctx, handoff, 0)
+				})
+			})
+		})
+	}
+
+	go func() {
+		pollers.Wait()
+		close(received)
+	}()
+
+	for i := 0; i < s.config.Concurrency; i++ {
+		worker := i
+		g.Go(func() error {
+			return s.supervise(ctx, "consumer", func() error {
+				return s.work(ctx, received, process, worker)
+			})
+		})
+	}
+}
+
+// work is the loop of a worker fed by the pollers.
+func (s *SQS) work(ctx context.Context, received <-chan []*sqs.Message, process func(ctx context.Context, messages []*sqs.Message) error, worker int) error {
+	for {
+		if s.expired() {
+			return nil
+		}
+
+		if !s.active(worker) {
+			if !sleep(ctx, ParkedWorkerPoll) {
+				return nil
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case messages, ok := <-received:
+			if !ok {
+				return nil
+			}
+			if err := process(handlerContext(ctx), messages); err != nil {
+				return err
+			}
+		}
+	}
+}
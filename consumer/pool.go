@@ -0,0 +1,133 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"sync"
+)
+
+// handlerSlots bounds the number of consumer function invocations running at once across all the
+// workers, the limit is read on every acquire so that it follows AdaptiveConcurrency.
+type handlerSlots struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	running int
+}
+
+// acquire blocks until less than limit() invocations are running.
+func (h *handlerSlots) acquire(limit func() int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.cond == nil {
+		h.cond = sync.NewCond(&h.lock)
+	}
+
+	for h.running >= limit() {
+		h.cond.Wait()
+	}
+
+	h.running++
+}
+
+func (h *handlerSlots) release() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.running--
+
+	if h.cond != nil {
+		h.cond.Broadcast()
+	}
+}
+
+// wake wakes up the waiters so that they read the limit again, e.g. once it has been increased.
+func (h *handlerSlots) wake() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.cond != nil {
+		h.cond.Broadcast()
+	}
+}
+
+// acquireGroup acquires a slot of group for a caller holding a handler slot. The handler slot is given back
+// while waiting for a busy group, so that the messages of a single group can't hold all the slots needed by
+// the other groups, and held again once the group slot is acquired.
+func (s *SQS) acquireGroup(ctx context.Context, groups *groupLimiter, group string, limit int) (func(), error) {
+	if release, ok := groups.tryAcquire(group, limit); ok {
+		return release, nil
+	}
+
+	s.slots.release()
+	release, err := groups.acquire(ctx, group, limit)
+	s.slots.acquire(s.Concurrency)
+
+	return release, err
+}
+
+// consumeAll invokes consumeFn on the messages concurrently, bounded by Concurrency across all the workers,
+// and returns the errors in the messages order. Messages of the same FIFO message group are consumed
+// sequentially and in order, holding a single slot, so that the ordering guarantees of FIFO queues still hold:
+// once a message of a group failed the following ones are failed with ErrGroupFailed without being consumed.
+func (s *SQS) consumeAll(ctx context.Context, messages []*sqs.Message, consumeFn ConsumerFnWithMeta) []error {
+	errs := make([]error, len(messages))
+
+	var wg sync.WaitGroup
+
+	// chains are dispatched in order as slots become available, so that with a single slot
+	// the messages are still consumed in the order they have been received
+	for _, chain := range messageGroupChains(messages, s.fifoGroup) {
+		s.slots.acquire(s.Concurrency)
+
+		wg.Add(1)
+		go func(chain []int) {
+			defer wg.Done()
+			defer s.slots.release()
+
+			for n, i := range chain {
+				errs[i] = s.consume(ctx, messages[i], consumeFn)
+				if errs[i] == nil {
+					continue
+				}
+
+				for _, next := range chain[n+1:] {
+					errs[next] = fmt.Errorf("%w: %s", ErrGroupFailed, aws.StringValue(messages[i].MessageId))
+				}
+				break
+			}
+		}(chain)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// messageGroupChains splits the indexes of the messages in chains to be consumed sequentially: one per FIFO
+// message group, while messages without a group (standard queues) get a chain each.
+func messageGroupChains(messages []*sqs.Message, groupOf func(*sqs.Message) string) [][]int {
+	chains := make([][]int, 0, len(messages))
+	groups := make(map[string]int)
+
+	for i, msg := range messages {
+		group := groupOf(msg)
+
+		if group == "" {
+			chains = append(chains, []int{i})
+			continue
+		}
+
+		if chain, found := groups[group]; found {
+			chains[chain] = append(chains[chain], i)
+			continue
+		}
+
+		groups[group] = len(chains)
+		chains = append(chains, []int{i})
+	}
+
+	return chains
+}
@@ -0,0 +1,369 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPublishBatchWait is how long SendAsync waits for a batch to fill up before sending it
+	DefaultPublishBatchWait = 50 * time.Millisecond
+	// maxBatchBytes is the maximum payload of a SendMessageBatch, the sum of its messages sizes
+	maxBatchBytes = 256 * 1024
+)
+
+// ErrPublisherClosed is returned when sending with a closed Publisher.
+var ErrPublisherClosed = errors.New("publisher closed")
+
+// PublisherConf configures a Publisher.
+type PublisherConf struct {
+	// Queue is the url of the queue receiving the messages
+	Queue string
+	// BatchWait is how long SendAsync waits for a batch of 10 messages to fill up before sending it,
+	// defaults to DefaultPublishBatchWait.
+	BatchWait time.Duration
+	// SendRetries is the number of times a throttled or otherwise retryable send is retried, defaults to
+	// DefaultSendRetries. Negative values disable retries.
+	SendRetries int
+	// RequestOptions are applied to every request issued by the publisher
+	RequestOptions []request.Option
+	// Compression, e.g. gzip, compresses the bodies longer than CompressThreshold bytes, setting their
+	// ContentEncodingAttribute. Codecs adds encodings to the built-in gzip one.
+	Compression       string
+	CompressThreshold int
+	Codecs            map[string]Codec
+}
+
+// SendOption customizes a message sent by a Publisher.
+type SendOption func(entry *sqs.SendMessageBatchRequestEntry)
+
+// WithGroupID sets the MessageGroupId of a message sent to a FIFO queue.
+func WithGroupID(id string) SendOption {
+	return func(entry *sqs.SendMessageBatchRequestEntry) {
+		entry.MessageGroupId = aws.String(id)
+	}
+}
+
+// WithDeduplicationID sets the MessageDeduplicationId of a message sent to a FIFO queue.
+func WithDeduplicationID(id string) SendOption {
+	return func(entry *sqs.SendMessageBatchRequestEntry) {
+		entry.MessageDeduplicationId = aws.String(id)
+	}
+}
+
+// WithAttributes adds String message attributes to a message.
+func WithAttributes(attributes map[string]string) SendOption {
+	return func(entry *sqs.SendMessageBatchRequestEntry) {
+		if entry.MessageAttributes == nil {
+			entry.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(attributes))
+		}
+		for name, value := range attributes {
+			entry.MessageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+}
+
+// WithDelay delays the delivery of a message, not supported by FIFO queues.
+func WithDelay(delay time.Duration) SendOption {
+	return func(entry *sqs.SendMessageBatchRequestEntry) {
+		entry.DelaySeconds = aws.Int64(int64(delay / time.Second))
+	}
+}
+
+// SendResult is the outcome of a message sent by SendAsync.
+type SendResult struct {
+	MessageId string
+	Err       error
+}
+
+// Publisher sends messages to a queue, one at a time with Send or batched with SendAsync.
+type Publisher struct {
+	conf PublisherConf
+	sqs  SQSClient
+
+	lock         sync.Mutex
+	pending      []pendingSend
+	pendingBytes int
+	timer        *time.Timer
+	closed       bool
+	sending      sync.WaitGroup
+}
+
+// pendingSend is a message buffered by SendAsync, result receives its outcome.
+type pendingSend struct {
+	entry  *sqs.SendMessageBatchRequestEntry
+	result chan SendResult
+}
+
+// NewPublisher returns a Publisher sending to conf.Queue with svc.
+func NewPublisher(conf PublisherConf, svc SQSClient) (*Publisher, error) {
+	if conf.Queue == "" {
+		return nil, errors.New("queue not set")
+	}
+
+	if conf.BatchWait == 0 {
+		conf.BatchWait = DefaultPublishBatchWait
+	}
+
+	if conf.SendRetries == 0 {
+		conf.SendRetries = DefaultSendRetries
+	}
+
+	return &Publisher{conf: conf, sqs: svc}, nil
+}
+
+// Send sends a message with body right away, returning its MessageId. Throttled sends are retried.
+func (p *Publisher) Send(ctx context.Context, body []byte, opts ...SendOption) (string, error) {
+	entry, err := p.newSendEntry(body, opts)
+	if err != nil {
+		return "", err
+	}
+
+	var out *sqs.SendMessageOutput
+	err = p.retrying(ctx, func() (err error) {
+		out, err = p.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:               aws.String(p.conf.Queue),
+			MessageBody:            entry.MessageBody,
+			MessageAttributes:      entry.MessageAttributes,
+			MessageGroupId:         entry.MessageGroupId,
+			MessageDeduplicationId: entry.MessageDeduplicationId,
+			DelaySeconds:           entry.DelaySeconds,
+		}, p.conf.RequestOptions...)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error sending message to %s: %w", p.conf.Queue, err)
+	}
+
+	return aws.StringValue(out.MessageId), nil
+}
+
+// SendAsync buffers a message with body, sending it along with the others with SendMessageBatch once
+// 10 messages are buffered, they would exceed the 256KB payload of a batch or BatchWait elapsed. The returned
+// channel receives the outcome of the send.
+func (p *Publisher) SendAsync(body []byte, opts ...SendOption) <-chan SendResult {
+	entry, err := p.newSendEntry(body, opts)
+	pending := pendingSend{entry: entry, result: make(chan SendResult, 1)}
+
+	if err != nil {
+		pending.result <- SendResult{Err: err}
+		return pending.result
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		pending.result <- SendResult{Err: ErrPublisherClosed}
+		return pending.result
+	}
+
+	size := entrySize(entry.MessageBody, entry.MessageAttributes)
+	if p.pendingBytes+size > maxBatchBytes {
+		p.flushPending()
+	}
+
+	if len(p.pending) == 0 {
+		p.timer = time.AfterFunc(p.conf.BatchWait, p.Flush)
+	}
+
+	p.pending = append(p.pending, pending)
+	p.pendingBytes += size
+
+	if len(p.pending) >= 10 { //max batch size for sqs is 10
+		p.flushPending()
+	}
+
+	return pending.result
+}
+
+// Flush sends the buffered messages without waiting for BatchWait.
+func (p *Publisher) Flush() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.flushPending()
+}
+
+// Close sends the buffered messages and waits for all the batches in flight, later sends fail with
+// ErrPublisherClosed.
+func (p *Publisher) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	p.flushPending()
+	p.lock.Unlock()
+
+	p.sending.Wait()
+	return nil
+}
+
+// flushPending sends the buffered messages, it must be invoked holding the lock.
+func (p *Publisher) flushPending() {
+	if len(p.pending) == 0 {
+		return
+	}
+
+	p.timer.Stop()
+	p.sendPending(p.pending)
+	p.pending, p.pendingBytes = nil, 0
+}
+
+// sendPending sends a batch in background, it must be invoked holding the lock.
+func (p *Publisher) sendPending(batch []pendingSend) {
+	p.sending.Add(1)
+	go func() {
+		defer p.sending.Done()
+		p.sendBatch(batch)
+	}()
+}
+
+// sendBatch sends up to 10 messages with SendMessageBatch, retrying the failed entries not caused by the sender.
+func (p *Publisher) sendBatch(batch []pendingSend) {
+	for attempt := 0; len(batch) > 0; attempt++ {
+		retry, err := p.trySendBatch(batch)
+
+		if len(retry) == 0 {
+			return
+		}
+
+		if attempt >= p.conf.SendRetries {
+			for _, pending := range retry {
+				pending.result <- SendResult{Err: fmt.Errorf("error sending message to %s: %w", p.conf.Queue, err)}
+			}
+			return
+		}
+
+		time.Sleep(time.Duration(attempt+1) * SendRetryBackoff)
+		batch = retry
+	}
+}
+
+// trySendBatch sends the batch once, notifying the sent messages and the ones failed because of the sender.
+// It returns the messages worth retrying along with the error that made them fail.
+func (p *Publisher) trySendBatch(batch []pendingSend) ([]pendingSend, error) {
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(batch))
+	for i, pending := range batch {
+		entry := *pending.entry
+		entry.Id = aws.String(strconv.Itoa(i))
+		entries[i] = &entry
+	}
+
+	out, err := p.sqs.SendMessageBatchWithContext(aws.BackgroundContext(), &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(p.conf.Queue),
+		Entries:  entries,
+	}, p.conf.RequestOptions...)
+
+	if err != nil {
+		if !retryableSend(err) {
+			for _, pending := range batch {
+				pending.result <- SendResult{Err: fmt.Errorf("error sending message to %s: %w", p.conf.Queue, err)}
+			}
+			return nil, err
+		}
+		return batch, err
+	}
+
+	// answered tells the entries the response has a result for, ignoring unknown and repeated ids
+	answered := make([]bool, len(batch))
+	answer := func(id *string) (int, bool) {
+		i, err := strconv.Atoi(aws.StringValue(id))
+		if err != nil || i < 0 || i >= len(batch) || answered[i] {
+			return 0, false
+		}
+		answered[i] = true
+		return i, true
+	}
+
+	for _, ok := range out.Successful {
+		if i, found := answer(ok.Id); found {
+			batch[i].result <- SendResult{MessageId: aws.StringValue(ok.MessageId)}
+		}
+	}
+
+	retry := make([]pendingSend, 0)
+	for _, failed := range out.Failed {
+		i, found := answer(failed.Id)
+		if !found {
+			continue
+		}
+		err = fmt.Errorf("%s %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+
+		if aws.BoolValue(failed.SenderFault) {
+			batch[i].result <- SendResult{Err: fmt.Errorf("error sending message to %s: %w", p.conf.Queue, err)}
+			continue
+		}
+
+		retry = append(retry, batch[i])
+	}
+
+	// entries missing from the response may have been sent or not: they are failed rather than retried
+	for i, pending := range batch {
+		if !answered[i] {
+			pending.result <- SendResult{Err: fmt.Errorf("error sending message to %s: no result in the batch response", p.conf.Queue)}
+		}
+	}
+
+	return retry, err
+}
+
+// retrying invokes send retrying the throttled and retryable errors up to SendRetries times.
+func (p *Publisher) retrying(ctx context.Context, send func() error) error {
+	err := send()
+
+	for attempt := 1; err != nil && retryableSend(err) && attempt <= p.conf.SendRetries; attempt++ {
+		if !sleep(ctx, time.Duration(attempt)*SendRetryBackoff) {
+			return ctx.Err()
+		}
+		err = send()
+	}
+
+	return err
+}
+
+// entrySize returns the size of a message as accounted by SQS: its body plus the names, types and values
+// of its attributes.
+func entrySize(body *string, attributes map[string]*sqs.MessageAttributeValue) int {
+	size := len(aws.StringValue(body))
+
+	for name, value := range attributes {
+		if value == nil {
+			continue
+		}
+		size += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue)) + len(value.BinaryValue)
+	}
+
+	return size
+}
+
+func retryableSend(err error) bool {
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// newSendEntry returns the entry of a message with body, compressed if needed.
+func (p *Publisher) newSendEntry(body []byte, opts []SendOption) (*sqs.SendMessageBatchRequestEntry, error) {
+	body, encoding, err := p.compressBody(body)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing message: %w", err)
+	}
+
+	entry := &sqs.SendMessageBatchRequestEntry{MessageBody: aws.String(string(body))}
+	for _, opt := range opts {
+		opt(entry)
+	}
+
+	if encoding != "" {
+		WithAttributes(map[string]string{ContentEncodingAttribute: encoding})(entry)
+	}
+
+	return entry, nil
+}
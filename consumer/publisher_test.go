@@ -0,0 +1,179 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttlingSQS throttles the first throttled sends
+type throttlingSQS struct {
+	*mockSQS
+	throttled int
+}
+
+func (t *throttlingSQS) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	if t.throttled > 0 {
+		t.throttled--
+		return nil, awserr.New("ThrottlingException", "rate exceeded", nil)
+	}
+	return t.mockSQS.SendMessageWithContext(ctx, in, opts...)
+}
+
+// shortResponseSQS omits the last entry from the SendMessageBatch responses
+type shortResponseSQS struct {
+	*mockSQS
+}
+
+func (s *shortResponseSQS) SendMessageBatchWithContext(ctx aws.Context, in *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	out, err := s.mockSQS.SendMessageBatchWithContext(ctx, in, opts...)
+	if err == nil && len(out.Successful) > 0 {
+		out.Successful = out.Successful[:len(out.Successful)-1]
+	}
+	return out, err
+}
+
+func TestPublisher_Send(t *testing.T) {
+	svc := &throttlingSQS{mockSQS: newMockSQS(), throttled: 2}
+
+	p, err := NewPublisher(PublisherConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	_, err = p.Send(context.Background(), []byte("body"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"body"}, svc.sent["queue"])
+
+	svc.throttled = 4
+	_, err = p.Send(context.Background(), []byte("body"))
+	assert.EqualError(t, err, "error sending message to queue: ThrottlingException: rate exceeded")
+
+	_, err = NewPublisher(PublisherConf{}, svc)
+	assert.EqualError(t, err, "queue not set")
+}
+
+func TestPublisher_SendAsync(t *testing.T) {
+	svc := newMockSQS()
+	svc.sendFailures = map[string]int{"msg3": 1}
+
+	p, err := NewPublisher(PublisherConf{Queue: "queue.fifo", BatchWait: 20 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	results := make([]<-chan SendResult, 12)
+	for i := range results {
+		results[i] = p.SendAsync([]byte(fmt.Sprintf("msg%d", i)), WithGroupID("group"), WithDeduplicationID(fmt.Sprint(i)), WithAttributes(map[string]string{"n": fmt.Sprint(i)}))
+	}
+
+	for _, result := range results {
+		assert.NoError(t, (<-result).Err)
+	}
+
+	assert.NoError(t, p.Close())
+	assert.Equal(t, ErrPublisherClosed, (<-p.SendAsync([]byte("late"))).Err)
+
+	// a full batch, the remaining messages after BatchWait and the retry of msg3
+	assert.Len(t, svc.sendBatches, 3)
+	assert.Len(t, svc.sendBatches[0].Entries, 10)
+	assert.Len(t, svc.sendBatches[1].Entries, 2)
+	assert.Equal(t, "msg3", aws.StringValue(svc.sendBatches[2].Entries[0].MessageBody))
+	assert.Len(t, svc.sent["queue.fifo"], 12)
+
+	entry := svc.sendBatches[0].Entries[1]
+	assert.Equal(t, "group", aws.StringValue(entry.MessageGroupId))
+	assert.Equal(t, "1", aws.StringValue(entry.MessageDeduplicationId))
+	assert.Equal(t, "1", aws.StringValue(entry.MessageAttributes["n"].StringValue))
+}
+
+func TestPublisher_SendAsyncShortResponse(t *testing.T) {
+	svc := &shortResponseSQS{mockSQS: newMockSQS()}
+
+	p, err := NewPublisher(PublisherConf{Queue: "queue", BatchWait: 50 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	first := p.SendAsync([]byte("msg1"))
+	second := p.SendAsync([]byte("msg2"))
+
+	// the entry missing from the response is failed instead of blocking its caller
+	select {
+	case result := <-first:
+		assert.NoError(t, result.Err)
+	case <-time.After(time.Second):
+		t.Fatal("no result for msg1")
+	}
+
+	select {
+	case result := <-second:
+		assert.EqualError(t, result.Err, "error sending message to queue: no result in the batch response")
+	case <-time.After(time.Second):
+		t.Fatal("no result for msg2")
+	}
+
+	assert.NoError(t, p.Close())
+}
+
+func TestPublisher_SendAsyncBatchSize(t *testing.T) {
+	svc := newMockSQS()
+
+	p, err := NewPublisher(PublisherConf{Queue: "queue", BatchWait: time.Hour}, svc)
+	assert.NoError(t, err)
+
+	body := strings.Repeat("x", 30*1024)
+
+	results := make([]<-chan SendResult, 10)
+	for i := range results {
+		results[i] = p.SendAsync([]byte(body))
+	}
+
+	// Close flushes the last partial batch right away
+	assert.NoError(t, p.Close())
+
+	for _, result := range results {
+		assert.NoError(t, (<-result).Err)
+	}
+
+	// 8 messages of 30KB fit in the 256KB of a batch
+	sizes := make([]int, 0)
+	for _, batch := range svc.sendBatches {
+		sizes = append(sizes, len(batch.Entries))
+	}
+	assert.ElementsMatch(t, []int{8, 2}, sizes)
+}
+
+func TestPublisher_CloseConcurrentSendAsync(t *testing.T) {
+	svc := newMockSQS()
+
+	p, err := NewPublisher(PublisherConf{Queue: "queue", BatchWait: time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	results := make(chan SendResult, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- <-p.SendAsync([]byte(fmt.Sprintf("msg%d", i)))
+		}(i)
+	}
+
+	assert.NoError(t, p.Close())
+	wg.Wait()
+	close(results)
+
+	// every message is either sent before returning from Close or rejected
+	sent := 0
+	for result := range results {
+		if result.Err == nil {
+			sent++
+			continue
+		}
+		assert.Equal(t, ErrPublisherClosed, result.Err)
+	}
+	assert.Len(t, svc.sentBodies("queue"), sent)
+}
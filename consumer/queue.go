@@ -0,0 +1,139 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strings"
+	"sync"
+)
+
+// QueueURLClient is the subset of the SQS API resolving the queue URLs, satisfied by *sqs.SQS. When the client
+// of the consumer implements it, SQSConf.Queue can be a queue name or ARN instead of a URL.
+type QueueURLClient interface {
+	GetQueueUrlWithContext(ctx aws.Context, in *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error)
+	CreateQueueWithContext(ctx aws.Context, in *sqs.CreateQueueInput, opts ...request.Option) (*sqs.CreateQueueOutput, error)
+}
+
+// queueURL is the URL of the queue resolved from its name or ARN.
+type queueURL struct {
+	lock sync.RWMutex
+	url  string
+}
+
+// isQueueURL tells whether queue is already a URL.
+func isQueueURL(queue string) bool {
+	return strings.HasPrefix(queue, "https://") || strings.HasPrefix(queue, "http://")
+}
+
+// queueURL returns the URL of the queue: the resolved one, or SQSConf.Queue when it doesn't need resolution.
+func (s *SQS) queueURL() string {
+	s.queue.lock.RLock()
+	defer s.queue.lock.RUnlock()
+
+	if s.queue.url != "" {
+		return s.queue.url
+	}
+
+	return s.config.Queue
+}
+
+// resolvesQueue tells whether SQSConf.Queue is a name or ARN to resolve.
+func (s *SQS) resolvesQueue() bool {
+	_, ok := s.sqs.(QueueURLClient)
+	return ok && !isQueueURL(s.config.Queue)
+}
+
+// resolveQueue resolves the URL of the queue with GetQueueUrl, caching it. When refresh is set (e.g. the queue
+// has been recreated) the cached URL is resolved again.
+func (s *SQS) resolveQueue(ctx context.Context, refresh bool) error {
+	if !s.resolvesQueue() {
+		return nil
+	}
+
+	s.queue.lock.Lock()
+	defer s.queue.lock.Unlock()
+
+	if s.queue.url != "" && !refresh {
+		return nil
+	}
+
+	client := s.sqs.(QueueURLClient)
+
+	name, owner := s.config.Queue, s.config.QueueOwnerAWSAccountId
+	if parsed, err := arn.Parse(s.config.Queue); err == nil {
+		name = parsed.Resource
+		if owner == "" {
+			owner = parsed.AccountID
+		}
+	}
+
+	in := &sqs.GetQueueUrlInput{QueueName: aws.String(name)}
+	if owner != "" {
+		in.QueueOwnerAWSAccountId = aws.String(owner)
+	}
+
+	out, err := client.GetQueueUrlWithContext(ctx, in, s.config.RequestOptions...)
+
+	var awsErr awserr.Error
+	if err != nil && s.config.CreateIfNotExists && errors.As(err, &awsErr) && awsErr.Code() == sqs.ErrCodeQueueDoesNotExist {
+		var created *sqs.CreateQueueOutput
+		created, err = client.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{
+			QueueName:  aws.String(name),
+			Attributes: s.queueAttributes(),
+		}, s.config.RequestOptions...)
+		if err == nil {
+			s.config.Logger.Infof("created queue %s", name)
+			out = &sqs.GetQueueUrlOutput{QueueUrl: created.QueueUrl}
+		}
+	}
+
+	if err != nil {
+		return s.queueError("error resolving queue url", err)
+	}
+
+	s.queue.url = aws.StringValue(out.QueueUrl)
+
+	return nil
+}
+
+// queueAttributes returns the QueueAttributes of the queue to create, marking FIFO queues as such.
+func (s *SQS) queueAttributes() map[string]*string {
+	attributes := aws.StringMap(s.config.QueueAttributes)
+
+	if s.config.FIFO && attributes[sqs.QueueAttributeNameFifoQueue] == nil {
+		if attributes == nil {
+			attributes = make(map[string]*string)
+		}
+		attributes[sqs.QueueAttributeNameFifoQueue] = aws.String("true")
+	}
+
+	return attributes
+}
+
+// refreshQueue resolves the queue URL again when err tells the queue does not exist, e.g. because it has
+// been recreated, and returns whether the request is worth retrying.
+func (s *SQS) refreshQueue(ctx context.Context, err error) bool {
+	var awsErr awserr.Error
+	if !s.resolvesQueue() || !errors.As(err, &awsErr) || awsErr.Code() != sqs.ErrCodeQueueDoesNotExist {
+		return false
+	}
+
+	previous := s.queueURL()
+
+	if err := s.resolveQueue(ctx, true); err != nil {
+		s.config.Logger.Warnf("%s", err)
+		return false
+	}
+
+	if url := s.queueURL(); url != previous {
+		s.config.Logger.Infof("queue %s resolved again to %s", s.config.Queue, url)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// resolvingSQS is a mockSQS resolving the queue urls, in order, the last one once exhausted
+type resolvingSQS struct {
+	*mockSQS
+	urls    []string
+	lookups []*sqs.GetQueueUrlInput
+	creates []*sqs.CreateQueueInput
+}
+
+func (r *resolvingSQS) GetQueueUrlWithContext(_ aws.Context, in *sqs.GetQueueUrlInput, _ ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	r.lookups = append(r.lookups, in)
+
+	url := r.urls[0]
+	if len(r.urls) > 1 {
+		r.urls = r.urls[1:]
+	}
+
+	if url == "" {
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil)
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(url)}, nil
+}
+
+func (r *resolvingSQS) CreateQueueWithContext(_ aws.Context, in *sqs.CreateQueueInput, _ ...request.Option) (*sqs.CreateQueueOutput, error) {
+	r.creates = append(r.creates, in)
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String("https://sqs/created")}, nil
+}
+
+func TestSQS_resolveQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        SQSConf
+		urls        []string
+		receiveErrs []error
+		wantURL     string
+		wantLookups []*sqs.GetQueueUrlInput
+		wantCreates []*sqs.CreateQueueInput
+	}{
+		{
+			name:        "shouldResolveTheQueueName",
+			conf:        SQSConf{Queue: "orders"},
+			urls:        []string{"https://sqs/orders"},
+			wantURL:     "https://sqs/orders",
+			wantLookups: []*sqs.GetQueueUrlInput{{QueueName: aws.String("orders")}},
+		},
+		{
+			name:    "shouldResolveTheQueueArnOfAnotherAccount",
+			conf:    SQSConf{Queue: "arn:aws:sqs:eu-west-1:123456789012:orders"},
+			urls:    []string{"https://sqs/123456789012/orders"},
+			wantURL: "https://sqs/123456789012/orders",
+			wantLookups: []*sqs.GetQueueUrlInput{
+				{QueueName: aws.String("orders"), QueueOwnerAWSAccountId: aws.String("123456789012")},
+			},
+		},
+		{
+			name:    "shouldResolveTheQueueAgainWhenItDoesNotExist",
+			conf:    SQSConf{Queue: "orders"},
+			urls:    []string{"https://sqs/orders", "https://sqs/orders-recreated"},
+			wantURL: "https://sqs/orders-recreated",
+			receiveErrs: []error{
+				awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil),
+			},
+			wantLookups: []*sqs.GetQueueUrlInput{{QueueName: aws.String("orders")}, {QueueName: aws.String("orders")}},
+		},
+		{
+			name:        "shouldCreateTheQueueWhenItDoesNotExist",
+			conf:        SQSConf{Queue: "orders.fifo", CreateIfNotExists: true, QueueAttributes: map[string]string{"DelaySeconds": "5"}},
+			urls:        []string{""},
+			wantURL:     "https://sqs/created",
+			wantLookups: []*sqs.GetQueueUrlInput{{QueueName: aws.String("orders.fifo")}},
+			wantCreates: []*sqs.CreateQueueInput{{
+				QueueName:  aws.String("orders.fifo"),
+				Attributes: aws.StringMap(map[string]string{"DelaySeconds": "5", "FifoQueue": "true"}),
+			}},
+		},
+		{
+			name:    "shouldUseTheQueueUrl",
+			conf:    SQSConf{Queue: "https://sqs/orders"},
+			wantURL: "https://sqs/orders",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "body")})
+			mock.receiveErrors = tt.receiveErrs
+			svc := &resolvingSQS{mockSQS: mock, urls: tt.urls}
+
+			conf := tt.conf
+			conf.Logger = NoopLogger{}
+			s, err := NewSQSConsumer(&conf, svc)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			err = s.Start(ctx, func(data []byte) error {
+				return nil
+			})
+			assert.NoError(t, err)
+
+			assert.Equal(t, tt.wantLookups, svc.lookups)
+			assert.Equal(t, tt.wantCreates, svc.creates)
+			assert.Len(t, mock.deletes, 1)
+			assert.Equal(t, tt.wantURL, aws.StringValue(mock.deletes[0].QueueUrl))
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter bounds the rate of the messages processed, it is satisfied by the *rate.Limiter of golang.org/x/time/rate.
+// Limiters having a Burst() int method, like *rate.Limiter, are never asked for more than Burst() messages at once:
+// batches larger than that wait in chunks.
+type RateLimiter interface {
+	// WaitN blocks until n messages can be processed, or ctx is done
+	WaitN(ctx context.Context, n int) error
+}
+
+// burstLimiter is a RateLimiter failing the waits of more than Burst() messages.
+type burstLimiter interface {
+	Burst() int
+}
+
+// tokenBucket is a RateLimiter refilled with perSecond tokens every second, holding up to burst of them.
+type tokenBucket struct {
+	perSecond float64
+	burst     int
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a token bucket RateLimiter allowing perSecond messages per second on average and
+// bursts of up to burst messages (at least 1), it can be shared by multiple consumers to bound their total rate.
+func NewRateLimiter(perSecond float64, burst int) RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{perSecond: perSecond, burst: burst, tokens: float64(burst)}
+}
+
+// WaitN takes n tokens, waiting for the missing ones: waiting callers are served in order, bursts larger
+// than the bucket are taken in chunks.
+func (b *tokenBucket) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		take := n
+		if take > b.burst {
+			take = b.burst
+		}
+		n -= take
+
+		if !sleep(ctx, b.reserve(take)) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// reserve takes n tokens, possibly going in debt, and returns how long to wait for the debt to be repaid.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.perSecond
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.perSecond * float64(time.Second))
+}
+
+// limit waits for n messages to be allowed by the RateLimiter, if any, in chunks of up to its Burst().
+func (s *SQS) limit(ctx context.Context, n int) error {
+	if s.config.RateLimiter == nil {
+		return nil
+	}
+
+	chunk := n
+	if limiter, ok := s.config.RateLimiter.(burstLimiter); ok && limiter.Burst() > 0 && limiter.Burst() < n {
+		chunk = limiter.Burst()
+	}
+
+	for n > 0 {
+		take := chunk
+		if take > n {
+			take = n
+		}
+		n -= take
+
+		if err := s.config.RateLimiter.WaitN(ctx, take); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
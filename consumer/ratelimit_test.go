@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100, 5)
+
+	start := time.Now()
+	assert.NoError(t, limiter.WaitN(context.Background(), 5))
+	assert.Less(t, time.Since(start).Milliseconds(), int64(10))
+
+	// larger than the burst, taken in chunks
+	assert.NoError(t, limiter.WaitN(context.Background(), 10))
+	assert.GreaterOrEqual(t, time.Since(start).Milliseconds(), int64(90))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, limiter.WaitN(ctx, 50))
+}
+
+// burstyLimiter fails the waits exceeding its burst, like *rate.Limiter
+type burstyLimiter struct {
+	burst int
+	waits []int
+}
+
+func (b *burstyLimiter) WaitN(_ context.Context, n int) error {
+	if n > b.burst {
+		return fmt.Errorf("rate: Wait(n=%d) exceeds limiter's burst %d", n, b.burst)
+	}
+	b.waits = append(b.waits, n)
+	return nil
+}
+
+func (b *burstyLimiter) Burst() int {
+	return b.burst
+}
+
+func TestSQS_limitBurst(t *testing.T) {
+	limiter := &burstyLimiter{burst: 4}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", RateLimiter: limiter}, newMockSQS())
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.limit(context.Background(), 10))
+	assert.NoError(t, s.limit(context.Background(), 3))
+	assert.Equal(t, []int{4, 4, 2, 3}, limiter.waits)
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// RedactedValue replaces the values masked by MaskFields
+const RedactedValue = "[REDACTED]"
+
+// Redactor returns the version of msg safe to be logged, e.g. with the PII removed. It must not modify msg,
+// that is still being processed, but return a copy of it.
+type Redactor func(msg *sqs.Message) *sqs.Message
+
+// MaskFields returns a Redactor replacing with RedactedValue the message attributes with the given names
+// and, when the body is JSON, the values of the object fields with the given names at any depth.
+func MaskFields(fields ...string) Redactor {
+	masked := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		masked[field] = struct{}{}
+	}
+
+	return func(msg *sqs.Message) *sqs.Message {
+		redacted := *msg
+
+		redacted.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(msg.MessageAttributes))
+		for name, value := range msg.MessageAttributes {
+			if _, found := masked[name]; found {
+				value = &sqs.MessageAttributeValue{
+					DataType:    value.DataType,
+					StringValue: aws.String(RedactedValue),
+				}
+			}
+			redacted.MessageAttributes[name] = value
+		}
+
+		var body interface{}
+		if err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), &body); err == nil {
+			if data, err := json.Marshal(maskValue(body, masked)); err == nil {
+				redacted.Body = aws.String(string(data))
+			}
+		}
+
+		return &redacted
+	}
+}
+
+func maskValue(value interface{}, masked map[string]struct{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, fieldValue := range v {
+			if _, found := masked[field]; found {
+				v[field] = RedactedValue
+				continue
+			}
+			v[field] = maskValue(fieldValue, masked)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = maskValue(item, masked)
+		}
+	}
+	return value
+}
+
+// redact applies the Redactor, if any, to msg before its content is logged.
+func (s *SQS) redact(msg *sqs.Message) *sqs.Message {
+	if s.config.Redactor == nil {
+		return msg
+	}
+	return s.config.Redactor(msg)
+}
@@ -0,0 +1,38 @@
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"testing"
+)
+
+func TestMaskFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "shouldMaskTopLevelField", body: `{"email":"a@b.c","id":1}`, want: `{"email":"[REDACTED]","id":1}`},
+		{name: "shouldMaskNestedFields", body: `{"user":{"email":"a@b.c"},"items":[{"email":"d@e.f"}]}`, want: `{"items":[{"email":"[REDACTED]"}],"user":{"email":"[REDACTED]"}}`},
+		{name: "shouldKeepNonJsonBody", body: `email=a@b.c`, want: `email=a@b.c`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := withAttribute(mockMessage("msg1", "handle1", tt.body), "email", "a@b.c")
+
+			got := MaskFields("email")(msg)
+
+			if body := aws.StringValue(got.Body); body != tt.want {
+				t.Errorf("MaskFields() body = %v, want %v", body, tt.want)
+			}
+			if value := aws.StringValue(got.MessageAttributes["email"].StringValue); value != RedactedValue {
+				t.Errorf("MaskFields() attribute = %v, want %v", value, RedactedValue)
+			}
+			if body := aws.StringValue(msg.Body); body != tt.body {
+				t.Errorf("MaskFields() modified the message body: %v", body)
+			}
+			if value := aws.StringValue(msg.MessageAttributes["email"].StringValue); value != "a@b.c" {
+				t.Errorf("MaskFields() modified the message attribute: %v", value)
+			}
+		})
+	}
+}
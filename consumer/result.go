@@ -0,0 +1,147 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"time"
+)
+
+// Result tells the consumer what to do with a message: acknowledged messages are deleted, the others are
+// made visible again after RetryAfter or, when RetryAfter is 0, handled like any failure (see ErrRejected).
+type Result struct {
+	Ack        bool
+	RetryAfter time.Duration
+}
+
+// ErrRejected is the failure of the messages rejected without RetryAfter: like the errors of the consumer
+// functions it goes through the ErrorClassifier and the RetryBackoff, if any.
+var ErrRejected = errors.New("message rejected")
+
+// ConsumerResultFn is a consumer function explicitly acknowledging or rejecting each message with a Result,
+// e.g. to acknowledge a message whose processing failed unrecoverably or to requeue it with a custom delay.
+type ConsumerResultFn func(ctx context.Context, msg Message) Result
+
+// ConsumerBatchResultFn is a consumer function processing the messages of a receive together, e.g. in a single
+// database transaction, returning a Result per message in the same order. When it returns an error none of the
+// messages is deleted.
+type ConsumerBatchResultFn func(ctx context.Context, msgs []Message) ([]Result, error)
+
+// ConsumerBatchFailuresFn is a consumer function processing the messages of a receive together, returning the
+// ids of the failed ones like the partial batch responses of Lambda. When it returns an error none of the
+// messages is deleted.
+type ConsumerBatchFailuresFn func(ctx context.Context, msgs []Message) (failed []string, err error)
+
+// StartWithResult consumes the queue like StartWithMeta, handling each message according to the
+// Result returned by consumeFn. Rejected messages are reported as failed, e.g. to Hooks.OnError.
+func (s *SQS) StartWithResult(ctx context.Context, consumeFn ConsumerResultFn) error {
+	return s.StartWithMeta(ctx, s.withResult(consumeFn))
+}
+
+// withResult adapts consumeFn to a ConsumerFnWithMeta, turning the rejections into errors.
+func (s *SQS) withResult(consumeFn ConsumerResultFn) ConsumerFnWithMeta {
+	return func(ctx context.Context, msg Message) error {
+		return s.resultError(consumeFn(ctx, msg))
+	}
+}
+
+// resultError returns nil for the acknowledged results, a RetryAfterError for the ones rejected with a delay
+// and ErrRejected for the others.
+func (s *SQS) resultError(result Result) error {
+	if result.Ack {
+		return nil
+	}
+
+	if result.RetryAfter <= 0 {
+		return ErrRejected
+	}
+
+	return RetryAfterError(result.RetryAfter)
+}
+
+// StartWithBatchResult consumes the queue like StartWithResult, but consumeFn is invoked once per receive
+// with all the received messages: the acknowledged ones are batch deleted, the others redelivered.
+func (s *SQS) StartWithBatchResult(ctx context.Context, consumeFn ConsumerBatchResultFn) error {
+	return s.start(ctx, func(ctx context.Context, messages []*sqs.Message) error {
+		return s.settle(messages, nil, func(prepared []*sqs.Message) []error {
+			return s.consumeBatchResult(ctx, prepared, consumeFn)
+		})
+	})
+}
+
+// StartWithBatchFailures consumes the queue like StartWithBatchResult, the messages reported as failed
+// by consumeFn are left in the queue while the others are batch deleted.
+func (s *SQS) StartWithBatchFailures(ctx context.Context, consumeFn ConsumerBatchFailuresFn) error {
+	return s.StartWithBatchResult(ctx, withBatchFailures(consumeFn))
+}
+
+// withBatchFailures adapts consumeFn to a ConsumerBatchResultFn acknowledging the messages not failed.
+func withBatchFailures(consumeFn ConsumerBatchFailuresFn) ConsumerBatchResultFn {
+	return func(ctx context.Context, msgs []Message) ([]Result, error) {
+		failed, err := consumeFn(ctx, msgs)
+		if err != nil {
+			return nil, err
+		}
+
+		failures := make(map[string]bool, len(failed))
+		for _, id := range failed {
+			failures[id] = true
+		}
+
+		results := make([]Result, len(msgs))
+		for i, msg := range msgs {
+			results[i].Ack = !failures[msg.MessageId]
+		}
+
+		return results, nil
+	}
+}
+
+// consumeBatchResult processes messages with consumeFn, returning an error per message.
+func (s *SQS) consumeBatchResult(ctx context.Context, messages []*sqs.Message, consumeFn ConsumerBatchResultFn) []error {
+	errs := make([]error, len(messages))
+
+	if len(messages) == 0 {
+		return errs
+	}
+
+	stopHeartbeat := s.heartbeat(ctx, messages)
+
+	err := s.decodeBodies(ctx, messages)
+
+	msgs := make([]Message, len(messages))
+	for i, msg := range messages {
+		msgs[i] = s.message(msg)
+	}
+
+	if err == nil {
+		err = s.limit(ctx, len(messages))
+	}
+
+	start := time.Now()
+	var results []Result
+	if err == nil {
+		err = s.recovering(messages, func() (err error) {
+			results, err = consumeFn(ctx, msgs)
+			return err
+		})
+	}
+	s.observeProcessing(time.Since(start), len(messages))
+
+	stopHeartbeat()
+
+	if err == nil && len(results) != len(messages) {
+		err = fmt.Errorf("batch consumer function returned %d results for %d messages", len(results), len(messages))
+	}
+
+	for i := range messages {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = s.resultError(results[i])
+	}
+
+	return errs
+}
@@ -0,0 +1,79 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"time"
+)
+
+type retryAfterError struct {
+	after time.Duration
+}
+
+// RetryAfterError returns an error asking to redeliver the message after d, e.g. honoring the Retry-After
+// header of a rate limited downstream: the message visibility timeout is set to d instead of the configured
+// VisibilityTimeout. d is rounded up to seconds and capped to MaxVisibilityTimeout.
+func RetryAfterError(d time.Duration) error {
+	return &retryAfterError{after: d}
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("retry after %s", e.after)
+}
+
+// retryDelay returns the delay after which a message failed with err has to be redelivered,
+// when err asks for it with RetryNow or RetryAfterError.
+func retryDelay(err error) (time.Duration, bool) {
+	if errors.Is(err, RetryNow) {
+		return 0, true
+	}
+
+	var retryAfter *retryAfterError
+	if errors.As(err, &retryAfter) {
+		return retryAfter.after, true
+	}
+
+	return 0, false
+}
+
+// redeliveryDelay returns the delay after which msg, failed with err, has to be redelivered: the one asked
+// by err or, with RetryBackoff, the backoff of its receive count unless it is going to be dead lettered.
+func (s *SQS) redeliveryDelay(msg *sqs.Message, err error) (time.Duration, bool) {
+	if delay, retry := retryDelay(err); retry {
+		return delay, true
+	}
+
+	if s.config.RetryBackoff.Min <= 0 || s.deadLettered(err) {
+		return 0, false
+	}
+
+	return s.config.RetryBackoff.delay(receiveCount(msg)), true
+}
+
+// retryMessages sets the visibility timeout of each message to its redelivery delay.
+func (s *SQS) retryMessages(delays map[*sqs.Message]time.Duration) error {
+	messages := make([]*sqs.Message, 0, len(delays))
+	for msg, delay := range delays {
+		messages = append(messages, msg)
+		s.logger(EventRetry, msg, nil).Debugf("message %s on queue %s redelivered in %s", aws.StringValue(msg.MessageId), s.config.Queue, delay)
+	}
+
+	return s.changeVisibility(messages, func(msg *sqs.Message) int64 {
+		return visibilitySeconds(delays[msg])
+	})
+}
+
+// visibilitySeconds converts d to a visibility timeout accepted by SQS.
+func visibilitySeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+
+	if d > MaxVisibilityTimeout {
+		d = MaxVisibilityTimeout
+	}
+
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,65 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+)
+
+// UnroutableError is returned by a Router for a message whose routing attribute is missing or has a value
+// without handler, when no fallback is set. Value is empty when the attribute is missing. It is a StatusError.
+type UnroutableError struct {
+	Attribute string
+	Value     string
+}
+
+func (e *UnroutableError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("unroutable message: attribute %s not set", e.Attribute)
+	}
+	return fmt.Sprintf("unroutable message: no handler for %s %s", e.Attribute, e.Value)
+}
+
+func (e *UnroutableError) StatusCode() int {
+	return 400
+}
+
+// Router dispatches the messages of a queue carrying heterogeneous events to the handler registered for the
+// value of their routing message attribute, e.g. eventType. Its Consume method is the ConsumerFnWithMeta to start.
+type Router struct {
+	attribute string
+	handlers  map[string]ConsumerFnWithMeta
+	fallback  ConsumerFnWithMeta
+}
+
+// NewRouter returns a Router routing the messages on the value of the attribute message attribute.
+func NewRouter(attribute string) *Router {
+	return &Router{attribute: attribute, handlers: make(map[string]ConsumerFnWithMeta)}
+}
+
+// Handle registers handler for the messages whose routing attribute is value.
+func (r *Router) Handle(value string, handler ConsumerFnWithMeta) *Router {
+	r.handlers[value] = handler
+	return r
+}
+
+// Fallback sets the handler of the messages without a registered handler, including the ones without the
+// routing attribute. Without fallback they fail with an *UnroutableError.
+func (r *Router) Fallback(handler ConsumerFnWithMeta) *Router {
+	r.fallback = handler
+	return r
+}
+
+// Consume invokes the handler of msg.
+func (r *Router) Consume(ctx context.Context, msg Message) error {
+	value := msg.Attributes[r.attribute]
+
+	if handler, found := r.handlers[value]; found {
+		return handler(ctx, msg)
+	}
+
+	if r.fallback != nil {
+		return r.fallback(ctx, msg)
+	}
+
+	return &UnroutableError{Attribute: r.attribute, Value: value}
+}
@@ -0,0 +1,40 @@
+package consumer
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var routed []string
+	handler := func(name string) ConsumerFnWithMeta {
+		return func(ctx context.Context, msg Message) error {
+			routed = append(routed, name+" "+msg.MessageId)
+			return nil
+		}
+	}
+
+	router := NewRouter("eventType").
+		Handle("order_created", handler("created")).
+		Handle("order_shipped", handler("shipped"))
+
+	message := func(id string, attributes map[string]string) Message {
+		return Message{MessageId: id, Attributes: attributes}
+	}
+
+	assert.NoError(t, router.Consume(context.Background(), message("msg1", map[string]string{"eventType": "order_created"})))
+	assert.NoError(t, router.Consume(context.Background(), message("msg2", map[string]string{"eventType": "order_shipped"})))
+
+	err := router.Consume(context.Background(), message("msg3", map[string]string{"eventType": "order_lost"}))
+	assert.EqualError(t, err, "unroutable message: no handler for eventType order_lost")
+	assert.Equal(t, DeadLetter, DefaultErrorClassifier(err))
+
+	err = router.Consume(context.Background(), message("msg4", nil))
+	assert.EqualError(t, err, "unroutable message: attribute eventType not set")
+
+	router.Fallback(handler("fallback"))
+	assert.NoError(t, router.Consume(context.Background(), message("msg5", nil)))
+
+	assert.Equal(t, []string{"created msg1", "shipped msg2", "fallback msg5"}, routed)
+}
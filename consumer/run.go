@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"net"
+	"time"
+)
+
+// fatalErrorCodes are the AWS error codes that retrying can't fix
+var fatalErrorCodes = map[string]struct{}{
+	sqs.ErrCodeQueueDoesNotExist:  {},
+	"AccessDenied":                {},
+	"InvalidAddress":              {},
+	"InvalidClientTokenId":        {},
+	"InvalidSecurity":             {},
+	"UnrecognizedClientException": {},
+}
+
+// transientErrorCodes are the AWS error codes worth retrying besides the throttling and retryable ones,
+// e.g. credentials expired while being rotated
+var transientErrorCodes = map[string]struct{}{
+	"ExpiredToken":          {},
+	"ExpiredTokenException": {},
+	"RequestExpired":        {},
+	sqs.ErrCodeOverLimit:    {},
+}
+
+// Run consumes the queue like Start until ctx is cancelled, then it returns nil once the in flight messages
+// have been processed. Besides the transient receive errors, retried by every consumer after ReceiveBackoff,
+// it survives the other non fatal errors: they are logged and the consumer polls again after
+// EmptyReceiveBackoff, only fatal errors (e.g. the queue does not exist) are returned.
+func (s *SQS) Run(ctx context.Context, consumeFn ConsumerFn) error {
+	return s.launch(ctx, func(ctx context.Context, messages []*sqs.Message) error {
+		return s.processMessages(ctx, messages, withMeta(consumeFn))
+	}, s.keepPolling)
+}
+
+// keepPolling runs the polling loop of a worker restarting it after the transient errors, backing off by
+// EmptyReceiveBackoff. Errors are consecutive unless the loop survived longer than a poll in between.
+func (s *SQS) keepPolling(ctx context.Context, loop func() error) error {
+	failures := 0
+
+	for {
+		started := time.Now()
+		err := loop()
+
+		if err == nil || fatal(err) {
+			return err
+		}
+
+		if time.Since(started) > s.config.PollTimeout {
+			failures = 0
+		}
+		failures++
+
+		wait := s.config.EmptyReceiveBackoff.delay(failures)
+		s.logger(EventReceiveError, nil, err).Warnf("transient error, polling again in %s: %s", wait, err)
+
+		if !s.backoff(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+// fatal reports whether err is an AWS error that retrying can't fix.
+func fatal(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+
+	_, found := fatalErrorCodes[awsErr.Code()]
+	return found
+}
+
+// transient reports whether err is a throttling, expired credentials or network error, likely to go away
+// by retrying the request.
+func transient(err error) bool {
+	if fatal(err) {
+		return false
+	}
+
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if _, found := transientErrorCodes[awsErr.Code()]; found {
+			return true
+		}
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
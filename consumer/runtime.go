@@ -0,0 +1,19 @@
+package consumer
+
+import "time"
+
+// markStarted records the first time the consumer has been started, MaxRuntime is counted from it.
+func (s *SQS) markStarted() {
+	s.startOnce.Do(func() {
+		s.startedAt = time.Now()
+	})
+}
+
+// expired reports whether MaxRuntime elapsed since the consumer has been started: the loops stop
+// receiving new messages but complete the processing of the in flight ones.
+func (s *SQS) expired() bool {
+	if s.config.MaxRuntime <= 0 || s.startedAt.IsZero() {
+		return false
+	}
+	return time.Since(s.startedAt) >= s.config.MaxRuntime
+}
@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Shutdown stops receiving messages and waits for the in flight ones to be processed, then releases the
+// consumer resources like Close. When ctx is done before the consumer is drained the context of the running
+// consumer functions is cancelled and an error reporting the number of messages still in flight is returned.
+// The consumer can't be started anymore once shut down.
+func (s *SQS) Shutdown(ctx context.Context) error {
+	s.lifecycle.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.closingCh())
+	}
+	aborting := s.abortingCh()
+	s.lifecycle.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		inFlight := s.inFlightCount()
+		s.abortOnce.Do(func() {
+			close(aborting)
+		})
+		err := fmt.Errorf("shutdown with %d messages still in flight: %w", inFlight, ctx.Err())
+		s.logger(EventShutdown, nil, err).Warnf("%s", s.queueError("error draining consumer", err))
+		return err
+	}
+
+	s.closeOnce.Do(func() {
+		if closer, ok := s.config.Metrics.(io.Closer); ok {
+			s.closeErr = closer.Close()
+		}
+	})
+
+	return s.closeErr
+}
+
+// inFlightCount returns the number of messages being processed.
+func (s *SQS) inFlightCount() int {
+	s.inFlightLock.Lock()
+	defer s.inFlightLock.Unlock()
+
+	return len(s.inFlight)
+}
+
+type handlerContextKey struct{}
+
+// handlerContext returns the context of the consumer functions carried by ctx, see run.
+func handlerContext(ctx context.Context) context.Context {
+	if handlerCtx, ok := ctx.Value(handlerContextKey{}).(context.Context); ok {
+		return handlerCtx
+	}
+	return ctx
+}
+
+// detachedContext carries the values of its parent but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SNSNotification is the metadata of the SNS envelope of a message, see UnwrapSNS.
+type SNSNotification struct {
+	MessageId string
+	TopicArn  string
+	Subject   string
+	Timestamp string
+}
+
+// snsEnvelope is the JSON of an SNS notification delivered without RawMessageDelivery.
+type snsEnvelope struct {
+	Type              string
+	MessageId         string
+	TopicArn          string
+	Subject           string
+	Message           string
+	Timestamp         string
+	MessageAttributes map[string]struct {
+		Type  string
+		Value string
+	}
+}
+
+// message returns the Message of msg, unwrapping its SNS envelope when UnwrapSNS is set and replacing its
+// body with the payload fetched from S3, if any.
+func (s *SQS) message(msg *sqs.Message) Message {
+	message := newMessage(msg)
+
+	if s.config.UnwrapSNS {
+		unwrapSNS(&message)
+	}
+
+	if body, ok := s.payloadBody(msg); ok {
+		message.Body = body
+	}
+
+	return message
+}
+
+// unwrapSNS replaces the body of msg with the payload of its SNS envelope, merging the string SNS message
+// attributes into the message attributes. Bodies that are not SNS notifications are left untouched.
+func unwrapSNS(msg *Message) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal(msg.Body, &envelope); err != nil || envelope.Type != "Notification" || envelope.TopicArn == "" {
+		return
+	}
+
+	msg.Body = []byte(envelope.Message)
+	msg.SNS = &SNSNotification{
+		MessageId: envelope.MessageId,
+		TopicArn:  envelope.TopicArn,
+		Subject:   envelope.Subject,
+		Timestamp: envelope.Timestamp,
+	}
+
+	for name, value := range envelope.MessageAttributes {
+		if value.Type == "Binary" {
+			continue
+		}
+		if _, found := msg.Attributes[name]; !found {
+			msg.Attributes[name] = value.Value
+		}
+	}
+}
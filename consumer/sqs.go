@@ -3,13 +3,18 @@ package consumer
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/The-Data-Appeal-Company/batcher-go"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,25 +23,305 @@ const (
 	DefaultVisibilityTimeout   = 20
 	DefaultWaitTimeSeconds     = 5
 	DefaultConcurrency         = 1
+	DefaultRestartBackoff      = 1 * time.Second
+	MaxRestartBackoff          = 1 * time.Minute
+	// DefaultPollTimeoutSlack is added to WaitTimeSeconds to compute the default PollTimeout
+	DefaultPollTimeoutSlack = 5 * time.Second
+	DefaultDeleteRetries    = 3
+	// DeleteRetryBackoff is multiplied by the attempt number to get the wait before retrying a deletion
+	DeleteRetryBackoff        = 100 * time.Millisecond
+	DefaultSendRetries        = 3
+	DefaultMaxLoggedBodyBytes = 4096
+	DefaultBatchSize          = 10
+	DefaultBatchWait          = 1 * time.Second
+	DefaultDedupeTTL          = 10 * time.Minute
+	DefaultEMAAlpha           = 0.2
+	// DefaultConcurrencyWindow and DefaultConcurrencyErrorRate drive AdaptiveConcurrency
+	DefaultConcurrencyWindow    = 20
+	DefaultConcurrencyErrorRate = 0.5
+	// SendRetryBackoff is multiplied by the attempt number to get the wait before retrying a forward
+	SendRetryBackoff = 100 * time.Millisecond
+	// DefaultMaxDecompressedBytes bounds the decompressed bodies when Decompress is set
+	DefaultMaxDecompressedBytes = 10 * 1024 * 1024
 )
 
 type SQSConf struct {
-	Queue               string
+	// Queue is the URL of the queue or, when the client implements QueueURLClient (like *sqs.SQS), its name or
+	// ARN: the URL is then resolved with GetQueueUrl when the consumer starts, and resolved again when the
+	// queue turns out not to exist anymore.
+	Queue string
+	// QueueOwnerAWSAccountId is the account owning the queue resolved by name, for cross-account queues.
+	// It defaults to the account of the queue ARN.
+	QueueOwnerAWSAccountId string
+	// CreateIfNotExists creates the queue resolved by name, with QueueAttributes, when it does not exist,
+	// e.g. in development environments.
+	CreateIfNotExists bool
+	QueueAttributes   map[string]string
+	// Concurrency is the number of workers polling the queue and the maximum number of messages processed
+	// at once across all of them: the messages of a receive are processed concurrently.
 	Concurrency         int
 	MaxNumberOfMessages int64
 	VisibilityTimeout   int64
 	WaitTimeSeconds     int64
-	DeletionPolicy      DeletionPolicy
+	// PollTimeout caps the duration of a single receive (long poll included), when exceeded the
+	// receive is abandoned and retried. Defaults to WaitTimeSeconds plus DefaultPollTimeoutSlack.
+	PollTimeout    time.Duration
+	DeletionPolicy DeletionPolicy
+	// HeartbeatInterval enables the visibility heartbeat: while the consumer function is running the
+	// visibility of its messages is extended by VisibilityTimeout every HeartbeatInterval, so that long
+	// running handlers don't make them visible again. It must be shorter than VisibilityTimeout.
+	HeartbeatInterval time.Duration
+	// ExtendVisibility enables the visibility heartbeat, every HeartbeatInterval or, when not set, every half
+	// VisibilityTimeout.
+	ExtendVisibility bool
+	// MaxGatherReceives enables gathering: when a receive returns fewer than MaxNumberOfMessages
+	// up to MaxGatherReceives additional immediate (short polling) receives are issued in the same cycle,
+	// until MaxNumberOfMessages are collected or a receive comes back empty. 0 disables gathering.
+	MaxGatherReceives int
+	// PollerCount, when set, decouples receiving from processing: PollerCount pollers issue concurrent long
+	// polls handing the received messages to the Concurrency workers. A poller waits for a free worker before
+	// receiving again, so that at most PollerCount receives wait to be processed while their visibility
+	// timeout is running. It applies to Start and StartWithMeta.
+	PollerCount int
+	// MessageAttributeNames lists the message attributes to receive, all of them when empty. The attributes
+	// used by the consumer itself (e.g. DeadlineAttribute, GroupAttribute) are always received.
+	MessageAttributeNames []string
+	// DeadlineAttribute is the name of a message attribute holding the deadline after which the message
+	// is not worth processing anymore (unix seconds or RFC3339). Expired messages are deleted without being
+	// processed, otherwise the deadline is applied to the ConsumerFnWithMeta context.
+	DeadlineAttribute string
+	// AdaptiveMaxNumberOfMessages makes the number of messages requested on each receive adapt to the
+	// processing speed, between MinNumberOfMessages (default 1) and MaxNumberOfMessages.
+	// It applies to Start and StartWithMeta, the current value is returned by SQS.MaxNumberOfMessages.
+	AdaptiveMaxNumberOfMessages bool
+	MinNumberOfMessages         int64
+	// AdaptiveConcurrency makes the number of active workers and of messages processed at once adapt to the
+	// error rate, between MinConcurrency (default 1) and Concurrency: every ConcurrencyWindow (default DefaultConcurrencyWindow)
+	// processed messages the workers are halved if more than ConcurrencyErrorRate (default DefaultConcurrencyErrorRate)
+	// of them failed, otherwise they grow by one. The current value is returned by SQS.Concurrency.
+	AdaptiveConcurrency  bool
+	MinConcurrency       int
+	ConcurrencyWindow    int
+	ConcurrencyErrorRate float64
+	// Autoscale scales the number of active workers between MinConcurrency (default 1) and Concurrency to the
+	// queue depth (ApproximateNumberOfMessages), one worker every ScaleTarget (default MaxNumberOfMessages)
+	// messages. The depth is checked every ScaleInterval (default DefaultScaleInterval) and two changes are at
+	// least ScaleCooldown (default DefaultScaleCooldown) apart. It can't be combined with AdaptiveConcurrency.
+	Autoscale     bool
+	ScaleTarget   int
+	ScaleInterval time.Duration
+	ScaleCooldown time.Duration
+	// RateLimit caps the messages processed per second, whatever the concurrency, allowing bursts of up to
+	// RateBurst messages (default 1). RateLimiter, when set, is used instead, e.g. to share a limit among consumers.
+	// Messages wait for their turn with their visibility extended by the heartbeat, if enabled.
+	RateLimit   float64
+	RateBurst   int
+	RateLimiter RateLimiter
+	// CircuitBreaker stops receiving messages for a while when the consumer function keeps failing, the changes
+	// of its state are notified to Hooks.OnCircuitChange. Disabled by default.
+	CircuitBreaker CircuitBreaker
+	// GroupAttribute is the name of a message attribute grouping messages (e.g. per tenant): when both it
+	// and MaxConcurrencyPerGroup are set, at most MaxConcurrencyPerGroup messages of the same group are
+	// processed concurrently, while Concurrency still bounds the total.
+	GroupAttribute         string
+	MaxConcurrencyPerGroup int
+	// FIFO serializes the processing of the messages sharing the same MessageGroupId, preserving their order,
+	// while different groups are still processed concurrently. Set by default for queues ending in ".fifo".
+	FIFO bool
+	// UnwrapSNS detects the messages delivered by an SNS subscription without RawMessageDelivery, invoking the
+	// consumer function with the notification payload: the SNS message attributes are merged into the message
+	// attributes and the envelope metadata is exposed in Message.SNS.
+	UnwrapSNS bool
+	// S3Client enables the support of the SQS Extended Client: the payloads offloaded to S3 are fetched and
+	// passed to the consumer function in place of their pointer, then deleted from S3 once their message is
+	// processed and deleted, unless KeepS3Payloads is set (e.g. when other consumers read them too).
+	S3Client       S3Client
+	KeepS3Payloads bool
+	// Decompress decompresses the bodies of the messages having a ContentEncodingAttribute (e.g. gzip) before
+	// passing them to the consumer function. Codecs adds encodings to the built-in gzip one, e.g. zstd.
+	// MaxDecompressedBytes, defaulting to DefaultMaxDecompressedBytes, bounds the decompressed bodies: the larger
+	// ones fail their message with a 400 status, sending it to the DeadLetterQueue when set.
+	Decompress           bool
+	Codecs               map[string]Codec
+	MaxDecompressedBytes int64
+	// DeleteRetries is the number of times a failed deletion is retried before giving up and reporting the
+	// message to Hooks.OnDeleteFailed, defaults to DefaultDeleteRetries. Negative values disable retries.
+	DeleteRetries int
+	// DeleteFlushInterval, when set, buffers the deletions of the messages processed by all the workers and
+	// flushes them with full DeleteMessageBatch requests of 10 entries, or after DeleteFlushInterval elapsed
+	// since the first buffered one, cutting the API calls at high throughput when each receive returns few
+	// messages. The workers wait for the flush of their messages, so it bounds the added latency.
+	DeleteFlushInterval time.Duration
+	// SendRetries is the number of times forwarding a message to another queue (e.g. the DeadLetterQueue)
+	// is retried, defaults to DefaultSendRetries. Negative values disable retries.
+	SendRetries int
+	// LogMessageOnFailure logs the whole failed messages (body and attributes) each time the consumer
+	// function fails, bodies are truncated to MaxLoggedBodyBytes (DefaultMaxLoggedBodyBytes when 0).
+	LogMessageOnFailure bool
+	MaxLoggedBodyBytes  int
+	// Redactor is applied to every message before its content is logged, e.g. MaskFields("email") to keep
+	// PII out of the logs.
+	Redactor Redactor
+	// Logger receives the consumer logs, defaults to the logrus standard logger. NoopLogger silences them.
+	Logger Logger
+	// Metrics collects the consumer metrics, defaults to NoopMetrics
+	Metrics MetricsCollector
+	// EMAAlpha is the smoothing factor, between 0 and 1, of the latency and throughput moving averages
+	// exposed by Stats and Metrics: higher values react faster. Defaults to DefaultEMAAlpha.
+	EMAAlpha float64
+	// MirrorQueue is the url of a queue receiving a copy (body and attributes) of every message before it is
+	// processed, e.g. to feed a shadow pipeline. Mirroring failures are just logged unless MirrorFatal is set,
+	// in that case the message is not processed and left in the queue.
+	MirrorQueue string
+	MirrorFatal bool
+	// DeadLetterQueue is the url of a queue where the messages failed with an error classified as DeadLetter
+	// by ErrorClassifier (DefaultErrorClassifier when nil) are forwarded, before being deleted from the queue.
+	// When not set failed messages are always left in the queue.
+	DeadLetterQueue string
+	ErrorClassifier ErrorClassifier
+	// MaxReceiveCount routes the poison messages at application level: once a message has been received
+	// MaxReceiveCount times (ApproximateReceiveCount) and fails again it is forwarded to the DeadLetterQueue,
+	// whatever the error, or dropped when there is no DeadLetterQueue. 0 (default) redelivers it indefinitely.
+	MaxReceiveCount int
+	// RetryBackoff makes the failed messages visible again after an exponential backoff driven by their
+	// ApproximateReceiveCount, instead of after VisibilityTimeout: Min on the first receive, doubled on
+	// every following one up to Max (MaxVisibilityTimeout when not set). Messages failed with an error
+	// asking for a specific delay (e.g. RetryAfterError) or classified as DeadLetter are not affected.
+	RetryBackoff Backoff
+	// DurationAttribute is the name of a message attribute holding the estimated processing duration of the
+	// message (seconds or a go duration): on receive the message visibility timeout is set accordingly,
+	// rounded up to seconds and clamped to MaxVisibilityTimeout, so that long jobs don't need a high
+	// VisibilityTimeout for all the messages. Durations that are not positive are ignored.
+	DurationAttribute string
+	// BatchSize and BatchWait drive the aggregation of StartBuffered: the consumer function is invoked
+	// as soon as BatchSize messages are buffered or BatchWait elapsed since the first one was received.
+	// BatchWait is capped to half of the VisibilityTimeout, so that buffered messages don't become visible again.
+	BatchSize int
+	BatchWait time.Duration
+	// DedupeStore enables deduplication: messages whose key has been marked as processed within DedupeTTL
+	// (DefaultDedupeTTL when 0) are deleted without being processed. The key is the MessageId, or the
+	// concatenated values of the DedupeKeyAttributes message attributes when set. DedupeKey, when set,
+	// returns the key instead, messages with an empty key are always processed.
+	DedupeStore         DedupeStore
+	DedupeTTL           time.Duration
+	DedupeKeyAttributes []string
+	DedupeKey           IdempotencyKeyFn
+	// AuditSink receives an AuditRecord for every processed message once its final outcome is known,
+	// e.g. JSONLinesAuditSink to keep a durable and replayable processing log.
+	AuditSink AuditSink
+	// NextQueue is the url of the queue receiving the follow-up messages of StartWithFollowUp
+	NextQueue string
+	// MaxRuntime bounds the wall-clock time the consumer runs for, counted from the first start: once elapsed
+	// the consumer stops receiving, completes the processing of the in flight messages and returns nil.
+	// Useful for scheduled drain jobs with a time budget, 0 means no limit.
+	MaxRuntime time.Duration
+	// RequestOptions are applied to every SQS request issued by the consumer, exposing the SDK request
+	// handlers: e.g. request.WithAppendUserAgent, or options pushing handlers to tag or trace the requests.
+	RequestOptions []request.Option
+	// InitialDelay is waited before the first receive, e.g. to stagger the startup of many consumers
+	InitialDelay time.Duration
+	// HealthReceiveErrors is the number of consecutive failed receives making the consumer unhealthy, defaults
+	// to DefaultHealthReceiveErrors. HealthReceiveTimeout, when set, makes the consumer unhealthy when no
+	// receive succeeded for that long while it has idle workers, e.g. because its loops silently stopped.
+	HealthReceiveErrors  int
+	HealthReceiveTimeout time.Duration
+	// EmptyReceiveBackoff is waited before polling again after an empty receive or a transient receive error,
+	// doubling on every consecutive one up to Max and resetting as soon as messages arrive. Min defaults to
+	// DefaultEmptyReceiveBackoff and Max to Min, i.e. a constant wait.
+	EmptyReceiveBackoff Backoff
+	// ReceiveBackoff is the jittered exponential backoff retrying the transient receive errors, i.e. throttling,
+	// expired credentials and network errors, until the receive succeeds. Min defaults to DefaultReceiveBackoff
+	// and Max to DefaultMaxReceiveBackoff. Fatal errors (e.g. AccessDenied) are reported to Hooks.OnFatal instead.
+	ReceiveBackoff Backoff
+	// HandlerTimeout cancels the context of the consumer function after the given duration, or after the
+	// VisibilityTimeout when set to VisibilityHandlerTimeout. Exceeding it fails the message with ErrHandlerTimeout,
+	// retried or dead lettered like any other error. It doesn't apply to the batched and buffered consumers.
+	HandlerTimeout time.Duration
+	// DrainTimeout bounds the time Close and RunWithSignals wait for the in flight messages to be processed,
+	// see Shutdown. 0 means no limit.
+	DrainTimeout time.Duration
+	// Middlewares wrap, in order, the consumer function invoked for every message, e.g. RecoverMiddleware
+	// and TimeoutMiddleware. They don't apply to the batched and buffered consumers.
+	Middlewares []Middleware
+	// Tracer starts a span around every invocation of the consumer function, ended once the outcome of
+	// the message is known. The trace context of the message can be extracted from MessageCarrier.
+	Tracer Tracer
+	// Supervise restarts the consumer loops when they die unexpectedly (panic), waiting RestartBackoff
+	// (doubled on every consecutive restart up to MaxRestartBackoff) and firing Hooks.OnRestart.
+	// When disabled (default) a panic in a loop crashes the process.
+	Supervise      bool
+	RestartBackoff time.Duration
+	Hooks          Hooks
 }
 
 type SQS struct {
 	config *SQSConf
-	sqs    *sqs.SQS
+	sqs    SQSClient
+
+	// ready is lazily created and closed after the first successful receive
+	ready     chan struct{}
+	readyInit sync.Once
+	readyMark sync.Once
+
+	// inFlight maps the ReceiptHandles being processed to the time they have been received
+	inFlight     map[string]time.Time
+	inFlightLock sync.Mutex
+
+	// idle is set to 1 after an empty receive
+	idle int32
+
+	// maxNumberOfMessages is the adapted MaxNumberOfMessages, 0 until the first adaptation
+	maxNumberOfMessages int64
+	adaptLock           sync.Mutex
+
+	// concurrency is the adapted Concurrency, 0 until the first adaptation
+	concurrency     int32
+	concurrencyLock sync.Mutex
+	windowProcessed int
+	windowFailed    int
+
+	groups     groupLimiter
+	fifoGroups groupLimiter
+
+	slots handlerSlots
+
+	circuit circuit
+
+	pause pauser
+
+	deletes deleteBuffer
+
+	queue queueURL
+
+	// payloads are the payloads fetched from S3 by message, see S3Client
+	payloads sync.Map
+
+	stats statsCollector
+
+	// backingOff is the number of loops currently backing off
+	backingOff int32
+	// busyWorkers is the number of workers processing messages
+	busyWorkers int32
+
+	// lifecycle guards closed and running, closing is lazily created and closed by Close, aborting
+	// is lazily created and closed by Shutdown when the drain times out
+	lifecycle sync.Mutex
+	closed    bool
+	closing   chan struct{}
+	aborting  chan struct{}
+	running   sync.WaitGroup
+	abortOnce sync.Once
+	closeOnce sync.Once
+	closeErr  error
+
+	// startedAt is set once by the first start, see MaxRuntime
+	startedAt time.Time
+	startOnce sync.Once
 }
 
 type DeletionPolicy string
 
-func NewSQSConsumer(conf *SQSConf, svc *sqs.SQS) (*SQS, error) {
+func NewSQSConsumer(conf *SQSConf, svc SQSClient) (*SQS, error) {
 
 	if conf.Queue == "" {
 		return nil, errors.New("queue not set")
@@ -58,24 +343,230 @@ func NewSQSConsumer(conf *SQSConf, svc *sqs.SQS) (*SQS, error) {
 		conf.MaxNumberOfMessages = DefaultMaxNumberOfMessages
 	}
 
+	if conf.ExtendVisibility && conf.HeartbeatInterval == 0 {
+		conf.HeartbeatInterval = time.Duration(conf.VisibilityTimeout) * time.Second / 2
+	}
+
+	if err := validate(conf); err != nil {
+		return nil, err
+	}
+
+	if isFIFO(conf.Queue) {
+		conf.FIFO = true
+	}
+
+	if conf.PollTimeout == 0 {
+		conf.PollTimeout = time.Duration(conf.WaitTimeSeconds)*time.Second + DefaultPollTimeoutSlack
+	}
+
+	if conf.HealthReceiveErrors == 0 {
+		conf.HealthReceiveErrors = DefaultHealthReceiveErrors
+	}
+
+	if conf.AdaptiveMaxNumberOfMessages && conf.MinNumberOfMessages == 0 {
+		conf.MinNumberOfMessages = 1
+	}
+
+	if (conf.AdaptiveConcurrency || conf.Autoscale) && conf.MinConcurrency == 0 {
+		conf.MinConcurrency = 1
+	}
+
+	if conf.Autoscale && conf.ScaleTarget == 0 {
+		conf.ScaleTarget = int(conf.MaxNumberOfMessages)
+	}
+
+	if conf.Autoscale && conf.ScaleInterval == 0 {
+		conf.ScaleInterval = DefaultScaleInterval
+	}
+
+	if conf.Autoscale && conf.ScaleCooldown == 0 {
+		conf.ScaleCooldown = DefaultScaleCooldown
+	}
+
+	if conf.AdaptiveConcurrency && conf.ConcurrencyWindow == 0 {
+		conf.ConcurrencyWindow = DefaultConcurrencyWindow
+	}
+
+	if conf.AdaptiveConcurrency && conf.ConcurrencyErrorRate == 0 {
+		conf.ConcurrencyErrorRate = DefaultConcurrencyErrorRate
+	}
+
+	if conf.DeleteRetries == 0 {
+		conf.DeleteRetries = DefaultDeleteRetries
+	}
+
+	if conf.SendRetries == 0 {
+		conf.SendRetries = DefaultSendRetries
+	}
+
+	if conf.Decompress && conf.MaxDecompressedBytes == 0 {
+		conf.MaxDecompressedBytes = DefaultMaxDecompressedBytes
+	}
+
+	if conf.LogMessageOnFailure && conf.MaxLoggedBodyBytes == 0 {
+		conf.MaxLoggedBodyBytes = DefaultMaxLoggedBodyBytes
+	}
+
+	if conf.BatchSize == 0 {
+		conf.BatchSize = DefaultBatchSize
+	}
+
+	if conf.BatchWait == 0 {
+		conf.BatchWait = DefaultBatchWait
+	}
+
+	if conf.DedupeStore != nil && conf.DedupeTTL == 0 {
+		conf.DedupeTTL = DefaultDedupeTTL
+	}
+
+	if conf.CircuitBreaker.enabled() && conf.CircuitBreaker.Window == 0 {
+		conf.CircuitBreaker.Window = DefaultCircuitWindow
+	}
+
+	if conf.CircuitBreaker.enabled() && conf.CircuitBreaker.OpenTimeout == 0 {
+		conf.CircuitBreaker.OpenTimeout = DefaultCircuitOpenTimeout
+	}
+
+	if conf.CircuitBreaker.enabled() && conf.CircuitBreaker.ProbeMessages == 0 {
+		conf.CircuitBreaker.ProbeMessages = DefaultCircuitProbeMessages
+	}
+
+	if conf.RateLimiter == nil && conf.RateLimit > 0 {
+		conf.RateLimiter = NewRateLimiter(conf.RateLimit, conf.RateBurst)
+	}
+
+	if conf.Logger == nil {
+		conf.Logger = defaultLogger()
+	}
+
+	if conf.Metrics == nil {
+		conf.Metrics = NoopMetrics{}
+	}
+
+	if conf.EMAAlpha == 0 {
+		conf.EMAAlpha = DefaultEMAAlpha
+	}
+
+	if conf.EmptyReceiveBackoff.Min == 0 {
+		conf.EmptyReceiveBackoff.Min = DefaultEmptyReceiveBackoff
+	}
+
+	if conf.EmptyReceiveBackoff.Max < conf.EmptyReceiveBackoff.Min {
+		conf.EmptyReceiveBackoff.Max = conf.EmptyReceiveBackoff.Min
+	}
+
+	if conf.ReceiveBackoff.Min == 0 {
+		conf.ReceiveBackoff.Min = DefaultReceiveBackoff
+	}
+
+	if conf.ReceiveBackoff.Max == 0 {
+		conf.ReceiveBackoff.Max = DefaultMaxReceiveBackoff
+	}
+
+	if conf.ReceiveBackoff.Max < conf.ReceiveBackoff.Min {
+		conf.ReceiveBackoff.Max = conf.ReceiveBackoff.Min
+	}
+
+	if conf.RetryBackoff.Min > 0 && conf.RetryBackoff.Max == 0 {
+		conf.RetryBackoff.Max = MaxVisibilityTimeout
+	}
+
+	if conf.Supervise && conf.RestartBackoff == 0 {
+		conf.RestartBackoff = DefaultRestartBackoff
+	}
+
 	return &SQS{config: conf, sqs: svc}, nil
 }
 
 func (s *SQS) Start(ctx context.Context, consumeFn ConsumerFn) error {
-	ctx, cancel := context.WithCancel(ctx)
+	return s.StartWithMeta(ctx, withMeta(consumeFn))
+}
+
+// RunWithSignals starts consuming like Start, stopping gracefully when one of the signals
+// (SIGINT and SIGTERM when none is given) is received: the consumer is closed, draining the in flight
+// messages within DrainTimeout, and the error of Close is returned.
+func (s *SQS) RunWithSignals(consumeFn ConsumerFn, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+
+	stopped := make(chan error, 1)
 
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt)
-		_ = <-c
-		cancel()
+		select {
+		case sig := <-c:
+			s.logger(EventShutdown, nil, nil).Infof("received %s, stopping consumer", sig)
+			stopped <- s.Close()
+		case <-ctx.Done():
+			stopped <- nil
+		}
 	}()
 
+	err := s.Start(ctx, consumeFn)
+	cancel()
+
+	if closeErr := <-stopped; err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (s *SQS) StartWithMeta(ctx context.Context, consumeFn ConsumerFnWithMeta) error {
+	return s.start(ctx, func(ctx context.Context, messages []*sqs.Message) error {
+		return s.processMessages(ctx, messages, consumeFn)
+	})
+}
+
+// start runs the workers polling the queue, each one handling the received messages with process.
+func (s *SQS) start(ctx context.Context, process func(ctx context.Context, messages []*sqs.Message) error) error {
+	return s.launch(ctx, process, func(_ context.Context, loop func() error) error {
+		return loop()
+	})
+}
+
+// launch runs the workers and, when enabled, the autoscaler and the pipeline pollers: every polling loop is run
+// by keepPolling, e.g. to survive its errors.
+func (s *SQS) launch(ctx context.Context, process func(ctx context.Context, messages []*sqs.Message) error, keepPolling func(ctx context.Context, loop func() error) error) error {
+	ctx, done, err := s.run(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if !sleep(ctx, s.config.InitialDelay) {
+		return nil
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 
+	if s.config.Autoscale {
+		g.Go(func() error {
+			s.autoscale(ctx)
+			return nil
+		})
+	}
+
+	if s.config.PollerCount > 0 {
+		s.pipeline(ctx, g, process, keepPolling)
+		return g.Wait()
+	}
+
 	for i := 0; i < s.config.Concurrency; i++ {
+		worker := i
 		g.Go(func() error {
-			return s.handleMessages(ctx, consumeFn)
+			return s.supervise(ctx, "consumer", func() error {
+				return keepPolling(ctx, func() error {
+					return s.poll(ctx, process, worker)
+				})
+			})
 		})
 	}
 
@@ -83,33 +574,63 @@ func (s *SQS) Start(ctx context.Context, consumeFn ConsumerFn) error {
 }
 
 func (s *SQS) handleMessages(ctx context.Context, consumeFn ConsumerFn) error {
+	return s.handleMessagesWithMeta(ctx, withMeta(consumeFn), 0)
+}
+
+func (s *SQS) handleMessagesWithMeta(ctx context.Context, consumeFn ConsumerFnWithMeta, worker int) error {
+	return s.poll(ctx, func(ctx context.Context, messages []*sqs.Message) error {
+		return s.processMessages(ctx, messages, consumeFn)
+	}, worker)
+}
+
+// poll is the loop of a worker, workers not active because of AdaptiveConcurrency or Autoscale are parked
+// and, while the CircuitBreaker is not closed, the workers don't receive unless probing.
+func (s *SQS) poll(ctx context.Context, process func(ctx context.Context, messages []*sqs.Message) error, worker int) error {
+	empties := 0
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			result, err := s.sqs.ReceiveMessage(s.pullMessagesRequest())
+			if s.expired() {
+				return nil
+			}
 
-			if err != nil {
-				return err
+			if !s.active(worker) {
+				sleep(ctx, ParkedWorkerPoll)
+				continue
 			}
 
-			if len(result.Messages) == 0 {
-				time.Sleep(1 * time.Second)
+			wait, probe := s.circuitWait()
+			if wait > 0 {
+				s.backoff(ctx, wait)
 				continue
 			}
 
-			toDelete := make([]*sqs.Message, 0)
+			messages, err := s.receiveMessages(ctx)
 
-			for _, msg := range result.Messages {
-				if err := consumeFn([]byte(*msg.Body)); err != nil {
-					logrus.Errorf("error %s", err.Error())
-					continue
+			if err != nil {
+				if probe {
+					s.circuitProbeFailed()
 				}
-				toDelete = append(toDelete, msg)
+				return err
 			}
 
-			if err := s.deleteSqsMessages(toDelete); err != nil {
+			acquired := s.acquire(messages)
+
+			if probe {
+				s.circuitProbing(acquired)
+			}
+
+			if len(messages) == 0 {
+				empties++
+				sleep(ctx, s.config.EmptyReceiveBackoff.delay(empties))
+				continue
+			}
+			empties = 0
+
+			if err := process(handlerContext(ctx), acquired); err != nil {
 				return err
 			}
 
@@ -117,134 +638,924 @@ func (s *SQS) handleMessages(ctx context.Context, consumeFn ConsumerFn) error {
 	}
 }
 
-func (s *SQS) StartBatched(ctx context.Context, batcher *batcher.Batcher, consumeFn ConsumerBatchFn) error {
-	ctx, cancel := context.WithCancel(ctx)
+func (s *SQS) processMessages(ctx context.Context, messages []*sqs.Message, consumeFn ConsumerFnWithMeta) error {
+	atomic.AddInt32(&s.busyWorkers, 1)
+	defer atomic.AddInt32(&s.busyWorkers, -1)
+
+	spans := s.newSpanTrail()
+	consumeFn = spans.trace(s.middleware(consumeFn))
+
+	return s.settle(messages, spans, func(prepared []*sqs.Message) []error {
+		return s.consumeAll(ctx, prepared, consumeFn)
+	})
+}
+
+// settle prepares the messages and processes them with consume, returning an error per message, then it
+// deletes, retries or dead letters each message according to its error and ends the spans.
+func (s *SQS) settle(messages []*sqs.Message, spans *spanTrail, consume func(prepared []*sqs.Message) []error) error {
+	defer s.release(messages)
+
+	toDelete := make([]*sqs.Message, 0)
+
+	toRetry := make(map[*sqs.Message]time.Duration)
+
+	toDeadLetter := make([]*sqs.Message, 0)
+
+	toDrop := make([]*sqs.Message, 0)
+
+	failures := make(map[*sqs.Message]error)
+
+	trail := s.newAuditTrail()
+
+	failed := 0
+
+	start := time.Now()
+	defer func() {
+		s.adaptMaxNumberOfMessages(len(messages), time.Since(start))
+		s.adaptConcurrency(len(messages), failed)
+		s.recordCircuit(messages, failed)
+	}()
+
+	prepared := s.prepare(messages)
+	errs := consume(prepared)
+
+	for i, msg := range prepared {
+		if err := errs[i]; err != nil {
+			s.logger(EventHandlerError, msg, err).Errorf("%s", s.messageError(msg, err))
+			s.logFailedMessage(msg, err)
+			s.failed(msg, err)
+			failed++
+			failures[msg] = err
+			if s.poisoned(msg) {
+				if s.config.Hooks.OnPoisoned != nil {
+					s.config.Hooks.OnPoisoned(s.message(msg), err)
+				}
+				if s.config.DeadLetterQueue != "" {
+					toDeadLetter = append(toDeadLetter, msg)
+				} else {
+					s.dropPoisoned(msg)
+					toDrop = append(toDrop, msg)
+				}
+				s.outcome(trail, AuditFailed, msg)
+				continue
+			}
+			if delay, retry := s.redeliveryDelay(msg, err); retry {
+				toRetry[msg] = delay
+				s.outcome(trail, AuditRetried, msg)
+				continue
+			}
+			if s.deadLettered(err) {
+				toDeadLetter = append(toDeadLetter, msg)
+			}
+			s.outcome(trail, AuditFailed, msg)
+			continue
+		}
+		toDelete = append(toDelete, msg)
+		s.succeeded(msg)
+		s.outcome(trail, AuditProcessed, msg)
+	}
+
+	s.markProcessed(toDelete)
+
+	// the retried messages show up again after their visibility timeout anyway, the others must be settled
+	if err := s.retryMessages(toRetry); err != nil {
+		s.logger(EventVisibilityError, nil, err).Errorf("%s", err)
+	}
+
+	deadLettered := s.deadLetterMessages(toDeadLetter, failures)
+	s.outcome(trail, AuditDeadLettered, deadLettered...)
+
+	deleted := s.deleteSqsMessages(append(append(toDelete, deadLettered...), toDrop...))
+	s.deletePayloads(toDelete, deleted)
+	s.audit(trail, deleted)
+	spans.end(deleted)
+
+	return nil
+}
+
+// prepare filters out the messages that must not be processed (expired, duplicated or not mirrored),
+// deleting them when needed.
+func (s *SQS) prepare(messages []*sqs.Message) []*sqs.Message {
+	return s.mirrorMessages(s.skipDuplicates(s.skipExpired(messages)))
+}
+
+func (s *SQS) consume(ctx context.Context, msg *sqs.Message, consumeFn ConsumerFnWithMeta) error {
+	// malformed deadlines have already been filtered out by skipExpired
+	if deadline, _ := s.deadline(msg); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// messages of a FIFO group received by different workers, e.g. after a visibility timeout, are serialized too
+	if group := s.fifoGroup(msg); group != "" {
+		release, err := s.acquireGroup(ctx, &s.fifoGroups, group, 1)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	if group := s.group(msg); group != "" {
+		release, err := s.acquireGroup(ctx, &s.groups, group, s.config.MaxConcurrencyPerGroup)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	stopHeartbeat := s.heartbeat(ctx, []*sqs.Message{msg})
+
+	if err := s.decodeBodies(ctx, []*sqs.Message{msg}); err != nil {
+		stopHeartbeat()
+		return err
+	}
+
+	if err := s.limit(ctx, 1); err != nil {
+		stopHeartbeat()
+		return err
+	}
+
+	start := time.Now()
+	err := s.recovering([]*sqs.Message{msg}, func() error {
+		return s.withHandlerTimeout(ctx, func(ctx context.Context) error {
+			return consumeFn(ctx, s.message(msg))
+		})
+	})
+	s.observeProcessing(time.Since(start), 1)
+
+	stopHeartbeat()
+
+	return err
+}
+
+// group returns the value of the GroupAttribute of msg, empty when per group concurrency is disabled.
+func (s *SQS) group(msg *sqs.Message) string {
+	if s.config.GroupAttribute == "" || s.config.MaxConcurrencyPerGroup <= 0 {
+		return ""
+	}
+
+	if attribute, found := msg.MessageAttributes[s.config.GroupAttribute]; found && attribute != nil {
+		return aws.StringValue(attribute.StringValue)
+	}
+
+	return ""
+}
+
+// failed counts the failure of msg and notifies Hooks.OnError and Hooks.OnFailure that the consumer function
+// failed processing it with err.
+func (s *SQS) failed(msg *sqs.Message, err error) {
+	s.config.Metrics.IncFailed()
+
+	if s.config.Hooks.OnError != nil {
+		s.config.Hooks.OnError(s.message(msg), err)
+	}
+
+	if s.config.Hooks.OnFailure != nil {
+		s.config.Hooks.OnFailure(s.message(msg), err, s.sinceReceived(msg))
+	}
+}
+
+func (s *SQS) malformed(msg *sqs.Message, err error) {
+	s.config.Logger.Errorf("%s", s.messageError(msg, fmt.Errorf("malformed message: %w", err)))
+
+	if s.config.Hooks.OnMalformed != nil {
+		s.config.Hooks.OnMalformed(s.message(msg), err)
+	}
+}
+
+// run derives from ctx a context cancelled on interrupt or Close, tracking the consumption as running
+// until the returned function is invoked. The context carries the one of the consumer functions, see
+// handlerContext, that is not cancelled along with it so that the in flight messages are drained.
+func (s *SQS) run(ctx context.Context) (context.Context, func(), error) {
+	if err := s.resolveQueue(ctx, false); err != nil {
+		return nil, nil, err
+	}
+
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if s.closed {
+		return nil, nil, ErrClosed
+	}
+
+	closing := s.closingCh()
+	aborting := s.abortingCh()
+	s.running.Add(1)
+	s.markStarted()
+
+	handlerCtx, cancelHandlers := context.WithCancel(detachedContext{parent: ctx})
 
 	go func() {
-		c := make(chan os.Signal)
+		select {
+		case <-aborting:
+		case <-handlerCtx.Done():
+		}
+		cancelHandlers()
+	}()
+
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, handlerContextKey{}, handlerCtx))
+
+	go func() {
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
-		_ = <-c
+		defer signal.Stop(c)
+
+		select {
+		case <-c:
+		case <-closing:
+		case <-ctx.Done():
+		}
 		cancel()
 	}()
 
-	go func() {
+	return ctx, func() {
+		cancel()
+		cancelHandlers()
+		s.running.Done()
+	}, nil
+}
+
+// Close stops the running consumption waiting for it to return, then releases the consumer resources:
+// the Metrics collector is closed when it implements io.Closer, so that it can flush pending metrics.
+// Close is idempotent, the consumer can't be started anymore once closed. The in flight messages are
+// drained within DrainTimeout, see Shutdown.
+func (s *SQS) Close() error {
+	ctx := context.Background()
+
+	if s.config.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.DrainTimeout)
+		defer cancel()
+	}
+
+	return s.Shutdown(ctx)
+}
+
+// closingCh must be invoked holding the lifecycle lock
+func (s *SQS) closingCh() chan struct{} {
+	if s.closing == nil {
+		s.closing = make(chan struct{})
+	}
+	return s.closing
+}
+
+// abortingCh must be invoked holding the lifecycle lock
+func (s *SQS) abortingCh() chan struct{} {
+	if s.aborting == nil {
+		s.aborting = make(chan struct{})
+	}
+	return s.aborting
+}
+
+func withMeta(consumeFn ConsumerFn) ConsumerFnWithMeta {
+	return func(_ context.Context, msg Message) error {
+		return consumeFn(msg.Body)
+	}
+}
+
+// StartBatched consumes the queue invoking consumeFn with the batches of messages flushed by batcher. The receive
+// errors are retried, the fatal ones (e.g. the queue does not exist) stop the consumer and are returned.
+func (s *SQS) StartBatched(ctx context.Context, batcher *batcher.Batcher, consumeFn ConsumerBatchFn) error {
+	ctx, done, err := s.run(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// the batcher is stopped, flushing the accumulated messages, once MaxRuntime elapsed or receiving failed
+	batchCtx, stopBatcher := context.WithCancel(ctx)
+	defer stopBatcher()
+
+	receiveErr := make(chan error, 1)
+
+	go s.supervise(ctx, "receiver", func() error {
+		if !sleep(ctx, s.config.InitialDelay) {
+			return nil
+		}
+
+		empties, failures := 0, 0
+
 		for {
 			select {
 			case <-ctx.Done():
-				return
+				return nil
 			default:
-				result, err := s.sqs.ReceiveMessage(s.pullMessagesRequest())
+				if s.expired() {
+					stopBatcher()
+					return nil
+				}
+
+				messages, acquired, err := s.receiveAcquired(ctx)
+
+				// the transient errors have already been retried by receiveMessages
+				if err != nil && fatal(err) {
+					receiveErr <- err
+					stopBatcher()
+					return nil
+				}
 
 				if err != nil {
-					panic(err)
+					failures++
+					wait := s.config.EmptyReceiveBackoff.delay(failures)
+					s.logger(EventReceiveError, nil, err).Warnf("receive error, receiving again in %s: %s", wait, err)
+					s.backoff(ctx, wait)
+					continue
 				}
+				failures = 0
 
-				if len(result.Messages) == 0 {
-					time.Sleep(1 * time.Second)
+				if len(messages) == 0 {
+					empties++
+					sleep(ctx, s.config.EmptyReceiveBackoff.delay(empties))
 					continue
 				}
+				empties = 0
 
-				for _, msg := range result.Messages {
+				for _, msg := range acquired {
 					batcher.Accumulate(msg)
 				}
 
 			}
 		}
+	})
 
-	}()
-
-	return batcher.Start(ctx, func(batch []interface{}) error {
+	err = batcher.Start(batchCtx, func(batch []interface{}) error {
 		msgBatch := make([]*sqs.Message, len(batch))
-		dataBatch := make([][]byte, len(batch))
 
 		for i := range batch {
 			msgBatch[i] = batch[i].(*sqs.Message)
-			dataBatch[i] = []byte(*batch[i].(*sqs.Message).Body)
 		}
 
-		err := consumeFn(dataBatch)
-		if err != nil {
-			logrus.Error("error processing batch: ", err)
-			return nil
-		}
+		return s.consumeBatch(msgBatch, consumeFn)
+	})
 
-		err = s.deleteSqsMessages(msgBatch)
-		if err != nil {
-			return err
+	select {
+	case fatalErr := <-receiveErr:
+		if err == nil {
+			err = fatalErr
 		}
+	default:
+	}
+
+	return err
+}
+
+// consumeBatch processes the acquired msgBatch with consumeFn, deleting the messages on success.
+func (s *SQS) consumeBatch(msgBatch []*sqs.Message, consumeFn ConsumerBatchFn) error {
+	defer s.release(msgBatch)
+
+	failed := 0
+	defer func() {
+		s.recordCircuit(msgBatch, failed)
+	}()
+
+	atomic.AddInt32(&s.busyWorkers, 1)
+	defer atomic.AddInt32(&s.busyWorkers, -1)
+
+	trail := s.newAuditTrail()
+
+	stopHeartbeat := s.heartbeat(context.Background(), msgBatch)
+
+	err := s.decodeBodies(context.Background(), msgBatch)
+
+	dataBatch := make([][]byte, len(msgBatch))
+
+	for i, msg := range msgBatch {
+		dataBatch[i] = s.message(msg).Body
+	}
+
+	if err == nil {
+		err = s.limit(context.Background(), len(msgBatch))
+	}
+
+	start := time.Now()
+	if err == nil {
+		err = s.recovering(msgBatch, func() error {
+			return consumeFn(dataBatch)
+		})
+	}
+	s.observeProcessing(time.Since(start), len(dataBatch))
+
+	stopHeartbeat()
 
+	if err != nil {
+		s.logger(EventHandlerError, nil, err).Errorf("%s", s.queueError("error processing batch", err))
+		failed = len(msgBatch)
+		failures := make(map[*sqs.Message]error, len(msgBatch))
+		for _, msg := range msgBatch {
+			s.logFailedMessage(msg, err)
+			s.failed(msg, err)
+			failures[msg] = err
+		}
+		if delay, retry := retryDelay(err); retry {
+			s.outcome(trail, AuditRetried, msgBatch...)
+			if err := s.changeSqsMessagesVisibility(msgBatch, visibilitySeconds(delay)); err != nil {
+				s.logger(EventVisibilityError, nil, err).Errorf("%s", err)
+			}
+			s.audit(trail, nil)
+			return nil
+		}
+		s.outcome(trail, AuditFailed, msgBatch...)
+		if s.deadLettered(err) {
+			deadLettered := s.deadLetterMessages(msgBatch, failures)
+			s.outcome(trail, AuditDeadLettered, deadLettered...)
+			s.audit(trail, s.deleteSqsMessages(deadLettered))
+			return nil
+		}
+		s.audit(trail, nil)
 		return nil
-	})
+	}
+
+	for _, msg := range msgBatch {
+		s.succeeded(msg)
+	}
+
+	s.outcome(trail, AuditProcessed, msgBatch...)
+	s.markProcessed(msgBatch)
+	deleted := s.deleteSqsMessages(msgBatch)
+	s.deletePayloads(msgBatch, deleted)
+	s.audit(trail, deleted)
+
+	return nil
 }
 
 func (s *SQS) handleMessagesBatched(ctx context.Context, batch *batcher.Batcher) error {
+	empties := 0
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			result, err := s.sqs.ReceiveMessage(s.pullMessagesRequest())
+			messages, err := s.receiveMessages(ctx)
 
 			if err != nil {
 				return err
 			}
 
-			if len(result.Messages) == 0 {
-				time.Sleep(1 * time.Second)
+			if len(messages) == 0 {
+				empties++
+				sleep(ctx, s.config.EmptyReceiveBackoff.delay(empties))
 				continue
 			}
+			empties = 0
 
-			for _, msg := range result.Messages {
+			for _, msg := range messages {
 				batch.Accumulate(msg)
 			}
 
 		}
 	}
 }
+
+// acquire marks the messages ReceiptHandles as in flight, filtering out the messages whose
+// handle is already being processed: deleting one of them could make the other one fail.
+func (s *SQS) acquire(messages []*sqs.Message) []*sqs.Message {
+	acquired := s.acquireHandles(messages)
+	s.received(acquired)
+	return acquired
+}
+
+func (s *SQS) acquireHandles(messages []*sqs.Message) []*sqs.Message {
+	s.inFlightLock.Lock()
+	defer s.inFlightLock.Unlock()
+
+	if s.inFlight == nil {
+		s.inFlight = make(map[string]time.Time)
+	}
+
+	acquired := make([]*sqs.Message, 0, len(messages))
+	now := time.Now()
+
+	for _, msg := range messages {
+		handle := aws.StringValue(msg.ReceiptHandle)
+
+		if _, found := s.inFlight[handle]; found {
+			s.config.Logger.Warnf("message %s received while already in flight, skipping it", aws.StringValue(msg.MessageId))
+			continue
+		}
+
+		s.inFlight[handle] = now
+		acquired = append(acquired, msg)
+	}
+
+	return acquired
+}
+
+// release removes the messages ReceiptHandles from the in flight ones.
+func (s *SQS) release(messages []*sqs.Message) {
+	s.forgetPayloads(messages)
+	s.circuitReleased(messages)
+
+	s.inFlightLock.Lock()
+	defer s.inFlightLock.Unlock()
+
+	for _, msg := range messages {
+		delete(s.inFlight, aws.StringValue(msg.ReceiptHandle))
+	}
+}
+
+// receivedAt returns the time msg has been acquired, zero when it is not in flight.
+func (s *SQS) receivedAt(msg *sqs.Message) time.Time {
+	s.inFlightLock.Lock()
+	defer s.inFlightLock.Unlock()
+
+	return s.inFlight[aws.StringValue(msg.ReceiptHandle)]
+}
+
+// supervise runs loop and, when supervision is enabled, restarts it with an exponential backoff
+// every time it panics. Without supervision loop is just invoked.
+func (s *SQS) supervise(ctx context.Context, name string, loop func() error) error {
+	if !s.config.Supervise {
+		return loop()
+	}
+
+	backoff := s.config.RestartBackoff
+
+	for {
+		recovered, err := runRecovering(loop)
+
+		if recovered == nil {
+			return err
+		}
+
+		s.config.Logger.Errorf("%s loop died: %v, restarting in %s", name, recovered, backoff)
+
+		if s.config.Hooks.OnRestart != nil {
+			s.config.Hooks.OnRestart(name, recovered)
+		}
+
+		if !s.backoff(ctx, backoff) {
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > MaxRestartBackoff {
+			backoff = MaxRestartBackoff
+		}
+	}
+}
+
+// backoff sleeps for d flagging the consumer as backing off, so that a degraded consumer can be told apart
+// from an idle one.
+func (s *SQS) backoff(ctx context.Context, d time.Duration) bool {
+	if atomic.AddInt32(&s.backingOff, 1) == 1 {
+		s.config.Metrics.SetBackingOff(true)
+	}
+
+	defer func() {
+		if atomic.AddInt32(&s.backingOff, -1) == 0 {
+			s.config.Metrics.SetBackingOff(false)
+		}
+	}()
+
+	return sleep(ctx, d)
+}
+
+// sleep waits for d, returning false if ctx is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func runRecovering(fn func() error) (recovered interface{}, err error) {
+	defer func() {
+		recovered = recover()
+	}()
+
+	return nil, fn()
+}
+
+func (s *SQS) receiveMessages(ctx context.Context) ([]*sqs.Message, error) {
+	var messages []*sqs.Message
+
+	if !s.waitResumed(ctx) {
+		return nil, nil
+	}
+
+	refreshed := false
+	failures := 0
+
+	for {
+		result, err := s.receive(ctx, s.pullMessagesRequest())
+
+		if err != nil && !refreshed && s.refreshQueue(ctx, err) {
+			refreshed = true
+			continue
+		}
+
+		if err != nil && transient(err) {
+			failures++
+			wait := s.config.ReceiveBackoff.jittered(failures)
+			s.logger(EventReceiveError, nil, err).Warnf("transient receive error, receiving again in %s: %s", wait, err)
+
+			if !s.backoff(ctx, wait) {
+				return nil, nil
+			}
+			continue
+		}
+
+		if err != nil {
+			err = s.queueError("error receiving messages", err)
+			if fatal(err) && s.config.Hooks.OnFatal != nil {
+				s.config.Hooks.OnFatal(err)
+			}
+			return nil, err
+		}
+
+		if result != nil {
+			messages = result.Messages
+			break
+		}
+
+		// the poll has been abandoned, retry it unless we are shutting down
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+	}
+
+	maxNumberOfMessages := s.receiveSize()
+
+	for i := 0; i < s.config.MaxGatherReceives && len(messages) > 0 && int64(len(messages)) < maxNumberOfMessages; i++ {
+		req := s.pullMessagesRequest()
+		req.MaxNumberOfMessages = aws.Int64(maxNumberOfMessages - int64(len(messages)))
+		req.WaitTimeSeconds = aws.Int64(0)
+
+		result, err := s.receive(ctx, req)
+
+		if err != nil {
+			// already received messages must be processed anyway, the error will show up on the next cycle
+			s.logger(EventReceiveError, nil, err).Errorf("%s", s.queueError("error gathering messages", err))
+			break
+		}
+
+		if result == nil || len(result.Messages) == 0 {
+			break
+		}
+
+		messages = append(messages, result.Messages...)
+	}
+
+	s.trackActivity(len(messages) > 0)
+
+	s.applyDurationVisibility(messages)
+
+	return messages, nil
+}
+
+// trackActivity fires Hooks.OnActivity the first time a non-empty receive follows empty ones,
+// the swap makes sure that concurrent receivers fire it only once per transition.
+func (s *SQS) trackActivity(active bool) {
+	if !active {
+		atomic.StoreInt32(&s.idle, 1)
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&s.idle, 1, 0) && s.config.Hooks.OnActivity != nil {
+		s.config.Hooks.OnActivity()
+	}
+}
+
+// receive issues a single ReceiveMessage bounded by PollTimeout. A nil output without error means
+// that the poll has been abandoned, because PollTimeout elapsed or ctx has been cancelled.
+func (s *SQS) receive(ctx context.Context, req *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	pollCtx, cancel := context.WithTimeout(ctx, s.config.PollTimeout)
+	defer cancel()
+
+	result, err := s.sqs.ReceiveMessageWithContext(pollCtx, req, s.config.RequestOptions...)
+
+	if err != nil && pollCtx.Err() != nil {
+		if ctx.Err() == nil {
+			s.config.Logger.Warnf("receive abandoned after %s, retrying", s.config.PollTimeout)
+		}
+		return nil, nil
+	}
+
+	if err != nil {
+		s.stats.observeReceive(err, time.Now())
+		return nil, err
+	}
+
+	s.stats.observeReceive(nil, time.Now())
+
+	result = s.sanitizeOutput(result)
+
+	s.readyMark.Do(func() {
+		close(s.readyCh())
+	})
+
+	s.stats.observeReceiveBatchSize(len(result.Messages))
+	s.config.Metrics.ObserveReceiveBatchSize(len(result.Messages))
+	s.config.Metrics.IncReceived(len(result.Messages))
+
+	if len(result.Messages) == 0 {
+		s.config.Metrics.IncEmptyReceive()
+	}
+
+	return result, nil
+}
+
+// sanitizeOutput guards against malformed SDK responses: a nil output is turned into an empty one
+// and messages without receipt handle, that could not be deleted anyway, are dropped.
+func (s *SQS) sanitizeOutput(result *sqs.ReceiveMessageOutput) *sqs.ReceiveMessageOutput {
+	if result == nil {
+		s.config.Logger.Warnf("nil ReceiveMessage output, considering it empty")
+		return &sqs.ReceiveMessageOutput{}
+	}
+
+	messages := make([]*sqs.Message, 0, len(result.Messages))
+
+	for _, msg := range result.Messages {
+		if msg == nil || msg.ReceiptHandle == nil {
+			s.config.Logger.Warnf("malformed ReceiveMessage output, skipping message without receipt handle")
+			continue
+		}
+
+		if msg.Body == nil {
+			msg.Body = aws.String("")
+		}
+
+		messages = append(messages, msg)
+	}
+
+	result.Messages = messages
+
+	return result
+}
+
+// Ready reports whether the consumer completed at least one successful receive,
+// proving connectivity and permissions on the queue.
+func (s *SQS) Ready() bool {
+	select {
+	case <-s.readyCh():
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitReady blocks until the consumer completed its first successful receive or ctx is done.
+func (s *SQS) WaitReady(ctx context.Context) error {
+	select {
+	case <-s.readyCh():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SQS) readyCh() chan struct{} {
+	s.readyInit.Do(func() {
+		s.ready = make(chan struct{})
+	})
+	return s.ready
+}
+
 func (s *SQS) pullMessagesRequest() *sqs.ReceiveMessageInput {
 	return &sqs.ReceiveMessageInput{
 		AttributeNames: []*string{
 			aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount),
+			aws.String(sqs.MessageSystemAttributeNameMessageGroupId),
+			aws.String(sqs.MessageSystemAttributeNameAwstraceHeader),
 		},
-		MessageAttributeNames: []*string{
-			aws.String(sqs.QueueAttributeNameAll),
-		},
-		QueueUrl:            &s.config.Queue,
-		MaxNumberOfMessages: aws.Int64(s.config.MaxNumberOfMessages),
-		VisibilityTimeout:   aws.Int64(s.config.VisibilityTimeout),
-		WaitTimeSeconds:     aws.Int64(s.config.WaitTimeSeconds),
+		MessageAttributeNames: s.messageAttributeNames(),
+		QueueUrl:              aws.String(s.queueURL()),
+		MaxNumberOfMessages:   aws.Int64(s.receiveSize()),
+		VisibilityTimeout:     aws.Int64(s.config.VisibilityTimeout),
+		WaitTimeSeconds:       aws.Int64(s.config.WaitTimeSeconds),
+	}
+}
+
+// deleteSqsMessages deletes msg retrying the failed deletions up to DeleteRetries times, messages
+// still not deleted are reported to Hooks.OnDeleteFailed and will be redelivered once visible again.
+// It returns the messages actually deleted.
+func (s *SQS) deleteSqsMessages(msg []*sqs.Message) []*sqs.Message {
+	if s.config.DeleteFlushInterval > 0 {
+		return s.bufferDeletes(msg)
 	}
+
+	return s.deleteNow(msg)
 }
 
-func (s *SQS) deleteSqsMessages(msg []*sqs.Message) error {
+// deleteNow deletes msg right away, see deleteSqsMessages.
+func (s *SQS) deleteNow(msg []*sqs.Message) []*sqs.Message {
 
 	if len(msg) == 0 {
 		return nil
 	}
 
-	chunks := chunk(msg, 10) //max batch size for sqs is 10
+	deleted := make([]*sqs.Message, 0, len(msg))
+
+	chunks := chunk(s.beforeDelete(msg), maxDeleteBatch)
 
 	for _, chunk := range chunks {
-		batch := make([]*sqs.DeleteMessageBatchRequestEntry, len(chunk))
+		done, pending, err := s.deleteBatch(chunk)
+		deleted = append(deleted, done...)
 
-		for i, v := range chunk {
-			batch[i] = &sqs.DeleteMessageBatchRequestEntry{
-				Id:            v.MessageId,
-				ReceiptHandle: v.ReceiptHandle,
-			}
+		for attempt := 1; len(pending) > 0 && attempt <= s.config.DeleteRetries; attempt++ {
+			time.Sleep(time.Duration(attempt) * DeleteRetryBackoff)
+			done, pending, err = s.deleteBatch(pending)
+			deleted = append(deleted, done...)
 		}
 
-		_, err := s.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
-			Entries:  batch,
-			QueueUrl: &s.config.Queue,
-		})
+		for _, v := range pending {
+			s.deleteExhausted(v, err)
+		}
+	}
 
-		if err != nil {
-			return err
+	s.config.Metrics.IncDeleted(len(deleted))
+	s.deletedMessages(deleted)
+
+	return deleted
+}
+
+// beforeDelete invokes Hooks.BeforeDelete on the messages, returning the ones whose deletion has not been vetoed.
+func (s *SQS) beforeDelete(messages []*sqs.Message) []*sqs.Message {
+	if s.config.Hooks.BeforeDelete == nil {
+		return messages
+	}
+
+	kept := make([]*sqs.Message, 0, len(messages))
+
+	for _, msg := range messages {
+		if err := s.config.Hooks.BeforeDelete(msg); err != nil {
+			err = s.messageError(msg, fmt.Errorf("deletion vetoed: %w", err))
+			s.logger(EventDeleteError, msg, err).Warnf("%s", err)
+			continue
 		}
+		kept = append(kept, msg)
 	}
 
-	return nil
+	return kept
+}
+
+// deleteBatch deletes up to 10 messages and returns the deleted ones and the ones worth retrying along with
+// the error that made them fail. Entries failed because of the sender (e.g. an expired receipt handle) are not retried.
+func (s *SQS) deleteBatch(msg []*sqs.Message) ([]*sqs.Message, []*sqs.Message, error) {
+	batch := make([]*sqs.DeleteMessageBatchRequestEntry, len(msg))
+
+	for i, v := range msg {
+		batch[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: v.ReceiptHandle,
+		}
+	}
+
+	out, err := s.sqs.DeleteMessageBatchWithContext(aws.BackgroundContext(), &sqs.DeleteMessageBatchInput{
+		Entries:  batch,
+		QueueUrl: aws.String(s.queueURL()),
+	}, s.config.RequestOptions...)
+
+	if err != nil {
+		return nil, msg, s.queueError("error deleting messages", err)
+	}
+
+	retry := make([]*sqs.Message, 0)
+	failures := make(map[int]struct{}, len(out.Failed))
+
+	for _, failed := range out.Failed {
+		i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+		failures[i] = struct{}{}
+		err = s.messageError(msg[i], fmt.Errorf("error deleting message: %s %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message)))
+
+		if aws.BoolValue(failed.SenderFault) {
+			s.logger(EventDeleteError, msg[i], err).Errorf("%s", err)
+			continue
+		}
+
+		retry = append(retry, msg[i])
+	}
+
+	deleted := make([]*sqs.Message, 0, len(msg)-len(failures))
+	for i, v := range msg {
+		if _, failed := failures[i]; !failed {
+			deleted = append(deleted, v)
+		}
+	}
+
+	return deleted, retry, err
+}
+
+func (s *SQS) deleteExhausted(msg *sqs.Message, err error) {
+	s.logger(EventDeleteError, msg, err).Errorf("%s", s.messageError(msg, fmt.Errorf("giving up deleting message after %d retries: %w", s.config.DeleteRetries, err)))
+
+	s.config.Metrics.IncDeleteExhausted()
+
+	if s.config.Hooks.OnDeleteFailed != nil {
+		s.config.Hooks.OnDeleteFailed(msg, err)
+	}
 }
 
 func chunk(rows []*sqs.Message, chunkSize int) [][]*sqs.Message {
@@ -1,9 +1,15 @@
 package consumer
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/The-Data-Appeal-Company/batcher-go"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
@@ -11,10 +17,18 @@ import (
 	"github.com/mitchelldavis/go_localstack/pkg/localstack"
 	"github.com/stretchr/testify/assert"
 	"log"
+	"math"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 var LOCALSTACK *localstack.Localstack
@@ -104,12 +118,41 @@ func TestNewSQSWorker(t *testing.T) {
 					MaxNumberOfMessages: DefaultMaxNumberOfMessages,
 					VisibilityTimeout:   DefaultVisibilityTimeout,
 					WaitTimeSeconds:     DefaultWaitTimeSeconds,
+					PollTimeout:         DefaultWaitTimeSeconds*time.Second + DefaultPollTimeoutSlack,
+					DeleteRetries:       DefaultDeleteRetries,
+					SendRetries:         DefaultSendRetries,
+					BatchSize:           DefaultBatchSize,
+					BatchWait:           DefaultBatchWait,
+					Logger:              defaultLogger(),
+					Metrics:             NoopMetrics{},
+					EMAAlpha:            DefaultEMAAlpha,
+					EmptyReceiveBackoff: Backoff{Min: DefaultEmptyReceiveBackoff, Max: DefaultEmptyReceiveBackoff},
+					ReceiveBackoff:      Backoff{Min: DefaultReceiveBackoff, Max: DefaultMaxReceiveBackoff},
+					HealthReceiveErrors: DefaultHealthReceiveErrors,
 				},
 				sqs: svc,
 			},
 
 			wantErr: false,
 		},
+
+		{
+			name: "shouldFailWithTooManyMessages",
+			args: args{
+				conf: &SQSConf{Queue: "queue", MaxNumberOfMessages: 11},
+				svc:  svc,
+			},
+			wantErr: true,
+		},
+
+		{
+			name: "shouldFailWithTooLongWaitTime",
+			args: args{
+				conf: &SQSConf{Queue: "queue", WaitTimeSeconds: 21},
+				svc:  svc,
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -135,7 +178,8 @@ func TestSQS_handleMessages(t *testing.T) {
 		t.Errorf("error during stack creation %v", err)
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 
 	var actual []string
 
@@ -292,3 +336,3219 @@ func fillQueue(svc *sqs.SQS, queue *string, err error) error {
 	}
 	return nil
 }
+
+func TestSQS_handleMessagesDuplicateReceiptHandle(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	consumed := make([]string, 0)
+
+	err = s.handleMessages(ctx, func(data []byte) error {
+		consumed = append(consumed, string(data))
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"msg1", "msg2"}, consumed)
+	assert.Equal(t, []string{"handle1", "handle2"}, svc.deletedHandles())
+	assert.Empty(t, s.inFlight)
+}
+
+func TestSQS_StartWithMaxConcurrencyPerGroup(t *testing.T) {
+	// a backlog of tenant a, followed by a single message of tenant b
+	svc := newMockSQS([]*sqs.Message{
+		withAttribute(mockMessage("a1", "a1", "a1"), "tenant", "a"),
+		withAttribute(mockMessage("a2", "a2", "a2"), "tenant", "a"),
+		withAttribute(mockMessage("a3", "a3", "a3"), "tenant", "a"),
+		withAttribute(mockMessage("b1", "b1", "b1"), "tenant", "b"),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:                  "queue",
+		Concurrency:            2,
+		GroupAttribute:         "tenant",
+		MaxConcurrencyPerGroup: 1,
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var lock sync.Mutex
+	running := make(map[string]int)
+	peak := make(map[string]int)
+	handledB := make(chan struct{})
+	blockedA := false
+
+	err = s.StartWithMeta(ctx, func(ctx context.Context, msg Message) error {
+		tenant := msg.Attributes["tenant"]
+
+		lock.Lock()
+		running[tenant]++
+		if running[tenant] > peak[tenant] {
+			peak[tenant] = running[tenant]
+		}
+		lock.Unlock()
+
+		defer func() {
+			lock.Lock()
+			running[tenant]--
+			lock.Unlock()
+		}()
+
+		if tenant == "b" {
+			lock.Lock()
+			blockedA = running["a"] > 0
+			lock.Unlock()
+			close(handledB)
+			return nil
+		}
+
+		// tenant a is blocked until b is handled
+		select {
+		case <-handledB:
+			return nil
+		case <-time.After(500 * time.Millisecond):
+			return errors.New("b not handled")
+		}
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, blockedA)
+	assert.Equal(t, 1, peak["a"])
+	assert.ElementsMatch(t, []string{"a1", "a2", "a3", "b1"}, svc.deletedHandles())
+}
+
+func TestSQS_processMessagesDeadLetterPartialFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		sendFailures map[string]int
+		wantSent     []string
+		wantDeleted  []string
+	}{
+		{
+			name:         "shouldDeleteAllForwardedMessages",
+			sendFailures: map[string]int{},
+			wantSent:     []string{"msg1", "msg2", "msg3"},
+			wantDeleted:  []string{"handle1", "handle2", "handle3"},
+		},
+		{
+			name:         "shouldRetryFailedEntries",
+			sendFailures: map[string]int{"msg2": 2},
+			wantSent:     []string{"msg1", "msg3", "msg2"},
+			wantDeleted:  []string{"handle1", "handle3", "handle2"},
+		},
+		{
+			name:         "shouldNotDeleteMessagesNotForwarded",
+			sendFailures: map[string]int{"msg2": DefaultSendRetries + 1},
+			wantSent:     []string{"msg1", "msg3"},
+			wantDeleted:  []string{"handle1", "handle3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS()
+			svc.sendFailures = tt.sendFailures
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", DeadLetterQueue: "dlq"}, svc)
+			assert.NoError(t, err)
+
+			err = s.processMessages(context.Background(), []*sqs.Message{
+				mockMessage("msg1", "handle1", "msg1"),
+				mockMessage("msg2", "handle2", "msg2"),
+				mockMessage("msg3", "handle3", "msg3"),
+			}, func(ctx context.Context, msg Message) error {
+				return WithStatus(400, errors.New("invalid payload"))
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSent, svc.sentBodies("dlq"))
+			assert.Equal(t, tt.wantDeleted, svc.deletedHandles())
+		})
+	}
+}
+
+func TestSQS_forward(t *testing.T) {
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue.fifo", Logger: NoopLogger{}}, svc)
+	assert.NoError(t, err)
+
+	large := strings.Repeat("x", 100*1024)
+	messages := []*sqs.Message{
+		mockMessage("msg1", "handle1", large),
+		mockMessage("msg2", "handle2", large),
+		mockMessage("msg3", "handle3", large),
+		mockMessage("msg4", "handle4", "small"),
+	}
+	messages[0].Attributes = map[string]*string{sqs.MessageSystemAttributeNameMessageGroupId: aws.String("group")}
+
+	forwarded := s.forward("dlq.fifo", messages)
+	assert.Equal(t, messages, forwarded)
+
+	// batches are split to stay within 256KB
+	assert.Len(t, svc.sendBatches, 2)
+	assert.Len(t, svc.sendBatches[0].Entries, 2)
+	assert.Len(t, svc.sendBatches[1].Entries, 2)
+
+	first := svc.sendBatches[0].Entries[0]
+	assert.Equal(t, "group", aws.StringValue(first.MessageGroupId))
+	assert.Equal(t, "msg1", aws.StringValue(first.MessageDeduplicationId))
+
+	// messages without group are sent to a group of their own
+	second := svc.sendBatches[0].Entries[1]
+	assert.Equal(t, "msg2", aws.StringValue(second.MessageGroupId))
+
+	svc.sendBatches = nil
+	s.forward("dlq", messages[3:])
+	assert.Nil(t, svc.sendBatches[0].Entries[0].MessageGroupId)
+	assert.Nil(t, svc.sendBatches[0].Entries[0].MessageDeduplicationId)
+}
+
+func TestSQS_processMessagesDeadLetterAttributes(t *testing.T) {
+	full := mockMessage("msg2", "handle2", "msg2")
+	for i := 0; i < maxMessageAttributes; i++ {
+		withAttribute(full, fmt.Sprintf("attr%d", i), "value")
+	}
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", DeadLetterQueue: "dlq"}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		withAttribute(mockMessage("msg1", "handle1", "msg1"), "tenant", "acme"),
+		full,
+	}, func(ctx context.Context, msg Message) error {
+		return fmt.Errorf("unknown customer: %w", ErrPermanent)
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"msg1", "msg2"}, svc.sentBodies("dlq"))
+	assert.Equal(t, []string{"handle1", "handle2"}, svc.deletedHandles())
+
+	entries := svc.sendBatches[0].Entries
+	assert.Equal(t, "acme", aws.StringValue(entries[0].MessageAttributes["tenant"].StringValue))
+	assert.Equal(t, "unknown customer: permanent failure", aws.StringValue(entries[0].MessageAttributes[FailureReasonAttribute].StringValue))
+	assert.Equal(t, "queue", aws.StringValue(entries[0].MessageAttributes[SourceQueueAttribute].StringValue))
+	assert.Len(t, entries[1].MessageAttributes, maxMessageAttributes)
+	assert.NotContains(t, entries[1].MessageAttributes, FailureReasonAttribute)
+
+	assert.Len(t, full.MessageAttributes, maxMessageAttributes)
+}
+
+func TestSQS_annotateFailureTruncatesOnRunes(t *testing.T) {
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", DeadLetterQueue: "dlq"}, newMockSQS())
+	assert.NoError(t, err)
+
+	// "é" is two bytes long: the limit falls in the middle of the last one
+	reason := "a" + strings.Repeat("é", maxFailureReasonBytes)
+
+	annotated := s.annotateFailure(mockMessage("msg1", "handle1", "msg1"), errors.New(reason))
+	truncated := aws.StringValue(annotated.MessageAttributes[FailureReasonAttribute].StringValue)
+
+	assert.True(t, utf8.ValidString(truncated))
+	assert.Equal(t, maxFailureReasonBytes-1, len(truncated))
+	assert.True(t, strings.HasPrefix(reason, truncated))
+}
+
+func TestSQS_StartBuffered(t *testing.T) {
+	svc := newMockSQS(
+		[]*sqs.Message{mockMessage("msg1", "handle1", "msg1")},
+		[]*sqs.Message{mockMessage("msg2", "handle2", "msg2")},
+		[]*sqs.Message{mockMessage("msg3", "handle3", "msg3"), mockMessage("msg4", "handle4", "msg4")},
+	)
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:     "queue",
+		BatchSize: 3,
+		BatchWait: 200 * time.Millisecond,
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	batches := make([][]string, 0)
+
+	err = s.StartBuffered(ctx, func(data [][]byte) error {
+		batch := make([]string, len(data))
+		for i := range data {
+			batch[i] = string(data[i])
+		}
+		batches = append(batches, batch)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"msg1", "msg2", "msg3"}, {"msg4"}}, batches)
+	assert.Equal(t, []string{"handle1", "handle2", "handle3", "handle4"}, svc.deletedHandles())
+}
+
+func TestLRUDedupeStore(t *testing.T) {
+	now := time.Now()
+	store := NewLRUDedupeStore(2)
+	store.now = func() time.Time { return now }
+
+	assert.NoError(t, store.Mark("a", time.Minute))
+	assert.NoError(t, store.Mark("b", time.Minute))
+	assert.NoError(t, store.Mark("c", time.Minute))
+
+	// a has been evicted being the least recently marked
+	seen, _ := store.Seen("a")
+	assert.False(t, seen)
+	seen, _ = store.Seen("c")
+	assert.True(t, seen)
+
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, store.Mark("d", time.Minute))
+
+	// b and c expired and have been pruned
+	assert.Equal(t, 1, store.Len())
+	seen, _ = store.Seen("d")
+	assert.True(t, seen)
+
+	// a recently seen key survives the eviction of an older one
+	assert.NoError(t, store.Mark("e", time.Minute))
+	seen, _ = store.Seen("d")
+	assert.True(t, seen)
+	assert.NoError(t, store.Mark("f", time.Minute))
+
+	seen, _ = store.Seen("d")
+	assert.True(t, seen)
+	seen, _ = store.Seen("e")
+	assert.False(t, seen)
+}
+
+func TestSQS_processMessagesDedupeKey(t *testing.T) {
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:       "queue",
+		Logger:      NoopLogger{},
+		DedupeStore: NewMemoryDedupeStore(),
+		DedupeKey: func(msg Message) string {
+			return string(msg.Body)
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	consumed := make([]string, 0)
+	consumeFn := func(ctx context.Context, msg Message) error {
+		consumed = append(consumed, msg.MessageId)
+		return nil
+	}
+
+	err = s.processMessages(context.Background(), []*sqs.Message{mockMessage("msg1", "handle1", "order1"), mockMessage("msg2", "handle2", "")}, consumeFn)
+	assert.NoError(t, err)
+
+	// same body of msg1, empty keys are always processed
+	err = s.processMessages(context.Background(), []*sqs.Message{mockMessage("msg3", "handle3", "order1"), mockMessage("msg4", "handle4", "")}, consumeFn)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"msg1", "msg2", "msg4"}, consumed)
+	assert.ElementsMatch(t, []string{"handle1", "handle2", "handle3", "handle4"}, svc.deletedHandles())
+}
+
+func TestSQS_processMessagesDedupeKeyAttributes(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryDedupeStore()
+	store.now = func() time.Time { return now }
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		DedupeStore:         store,
+		DedupeTTL:           time.Minute,
+		DedupeKeyAttributes: []string{"tenant", "order"},
+	}, svc)
+	assert.NoError(t, err)
+
+	order := func(id, tenant, order string) *sqs.Message {
+		return withAttribute(withAttribute(mockMessage(id, id, id), "tenant", tenant), "order", order)
+	}
+
+	consumed := make([]string, 0)
+	consumeFn := func(ctx context.Context, msg Message) error {
+		consumed = append(consumed, msg.MessageId)
+		return nil
+	}
+
+	err = s.processMessages(context.Background(), []*sqs.Message{order("msg1", "a", "1"), order("msg2", "a", "2")}, consumeFn)
+	assert.NoError(t, err)
+
+	// same tenant and order of msg1, different tenant with the order of msg2
+	err = s.processMessages(context.Background(), []*sqs.Message{order("msg3", "a", "1"), order("msg4", "b", "2")}, consumeFn)
+	assert.NoError(t, err)
+
+	now = now.Add(2 * time.Minute)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{order("msg5", "a", "1")}, consumeFn)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"msg1", "msg2", "msg4", "msg5"}, consumed)
+	assert.Equal(t, []string{"msg1", "msg2", "msg3", "msg4", "msg5"}, svc.deletedHandles())
+}
+
+func TestSQS_receiveMessagesMalformedOutput(t *testing.T) {
+	svc := newMockSQS().withOutputs(
+		nil,
+		&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{nil, {MessageId: aws.String("msg1")}}},
+	)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		messages, err := s.receiveMessages(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+	}
+
+	assert.True(t, s.Ready())
+}
+
+func TestSQS_processMessagesAudit(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONLinesAuditSink(&out, NoopLogger{})
+
+	svc := newMockSQS()
+	svc.sendFailures = map[string]int{"msg4": DefaultSendRetries + 1}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", DeadLetterQueue: "dlq", AuditSink: sink}, svc)
+	assert.NoError(t, err)
+
+	messages := s.acquire([]*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+		mockMessage("msg3", "handle3", "msg3"),
+		mockMessage("msg4", "handle4", "msg4"),
+	})
+
+	err = s.processMessages(context.Background(), messages, func(ctx context.Context, msg Message) error {
+		switch msg.MessageId {
+		case "msg2":
+			return RetryAfterError(time.Minute)
+		case "msg3", "msg4":
+			return WithStatus(400, errors.New("invalid payload"))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Close())
+
+	records := make(map[string]AuditRecord)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var record AuditRecord
+		assert.NoError(t, decoder.Decode(&record))
+		records[record.MessageId] = record
+	}
+
+	assert.Len(t, records, 4)
+	assert.Equal(t, AuditProcessed, records["msg1"].Outcome)
+	assert.NotNil(t, records["msg1"].DeletedAt)
+	assert.False(t, records["msg1"].ReceivedAt.IsZero())
+	assert.Equal(t, AuditRetried, records["msg2"].Outcome)
+	assert.Nil(t, records["msg2"].DeletedAt)
+	assert.Equal(t, AuditDeadLettered, records["msg3"].Outcome)
+	assert.NotNil(t, records["msg3"].DeletedAt)
+	assert.Equal(t, AuditFailed, records["msg4"].Outcome)
+	assert.Nil(t, records["msg4"].DeletedAt)
+}
+
+func TestJSONLinesAuditSink_RecordAfterClose(t *testing.T) {
+	var out bytes.Buffer
+	logger := &recordingLogger{}
+	sink := NewJSONLinesAuditSink(&out, logger)
+
+	sink.Record(AuditRecord{MessageId: "msg1", Outcome: AuditProcessed})
+	assert.NoError(t, sink.Close())
+	assert.NoError(t, sink.Close())
+
+	assert.NotPanics(t, func() {
+		sink.Record(AuditRecord{MessageId: "msg2", Outcome: AuditProcessed})
+	})
+
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+	assert.Contains(t, out.String(), `"message_id":"msg1"`)
+	assert.Equal(t, []string{"audit sink closed, dropping record of message msg2"}, logger.warnings)
+}
+
+func TestSQS_adaptConcurrency(t *testing.T) {
+	var changes []int
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		Concurrency:         8,
+		AdaptiveConcurrency: true,
+		ConcurrencyWindow:   10,
+		Hooks: Hooks{
+			OnConcurrencyChange: func(n int, errorRate float64) {
+				changes = append(changes, n)
+			},
+		},
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 8, s.Concurrency())
+
+	// the window is not complete yet
+	s.adaptConcurrency(5, 5)
+	assert.Equal(t, 8, s.Concurrency())
+
+	s.adaptConcurrency(5, 5)
+	assert.Equal(t, 4, s.Concurrency())
+
+	for i := 0; i < 3; i++ {
+		s.adaptConcurrency(10, 10)
+	}
+	assert.Equal(t, 1, s.Concurrency())
+
+	s.adaptConcurrency(10, 2)
+	assert.Equal(t, 2, s.Concurrency())
+	assert.True(t, s.active(1))
+	assert.False(t, s.active(2))
+
+	for i := 0; i < 10; i++ {
+		s.adaptConcurrency(10, 0)
+	}
+	assert.Equal(t, 8, s.Concurrency())
+
+	assert.Equal(t, []int{4, 2, 1, 2, 3, 4, 5, 6, 7, 8}, changes)
+}
+
+func TestSQS_StartWithCircuitBreaker(t *testing.T) {
+	svc := newMockSQS(
+		[]*sqs.Message{mockMessage("msg1", "handle1", "fail"), mockMessage("msg2", "handle2", "fail"), mockMessage("msg3", "handle3", "fail")},
+		[]*sqs.Message{mockMessage("msg4", "handle4", "fail")},
+		[]*sqs.Message{mockMessage("msg5", "handle5", "ok")},
+		[]*sqs.Message{mockMessage("msg6", "handle6", "ok")},
+	)
+
+	var lock sync.Mutex
+	var changes []CircuitState
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		EmptyReceiveBackoff: Backoff{Min: 10 * time.Millisecond},
+		CircuitBreaker:      CircuitBreaker{Failures: 3, OpenTimeout: 100 * time.Millisecond},
+		Hooks: Hooks{
+			OnCircuitChange: func(state CircuitState) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes = append(changes, state)
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+
+	err = s.Start(ctx, func(data []byte) error {
+		if string(data) == "fail" {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}, changes)
+	assert.Equal(t, CircuitClosed, s.CircuitState())
+	assert.Equal(t, []int64{DefaultMaxNumberOfMessages, 1, 1, DefaultMaxNumberOfMessages}, svc.receiveSizes[:4])
+	assert.Equal(t, []string{"handle5", "handle6"}, svc.deletedHandles())
+}
+
+func TestSQS_circuitProbeDropped(t *testing.T) {
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:          "queue",
+		Logger:         NoopLogger{},
+		CircuitBreaker: CircuitBreaker{Failures: 1, OpenTimeout: time.Millisecond},
+	}, svc)
+	assert.NoError(t, err)
+
+	halfOpen := func() bool {
+		s.recordCircuit([]*sqs.Message{mockMessage("failed", "failed", "failed")}, 1)
+		assert.Equal(t, CircuitOpen, s.CircuitState())
+		time.Sleep(5 * time.Millisecond)
+
+		_, probe := s.circuitWait()
+		return probe
+	}
+
+	// the probe is received while already in flight: nothing acquired, nothing can fail
+	inFlight := s.acquire([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+	assert.True(t, halfOpen())
+	s.circuitProbing(s.acquire([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")}))
+	assert.Equal(t, CircuitClosed, s.CircuitState())
+	s.release(inFlight)
+
+	// the probe is released without being settled, e.g. on shutdown
+	assert.True(t, halfOpen())
+	probe := s.acquire([]*sqs.Message{mockMessage("msg2", "handle2", "msg2")})
+	s.circuitProbing(probe)
+	s.release(probe)
+	assert.Equal(t, CircuitOpen, s.CircuitState())
+
+	// the first message of the probe is dropped by prepare, the others settle the probe
+	expired := withAttribute(mockMessage("msg3", "handle3", "msg3"), "deadline", "2000-01-01T00:00:00Z")
+	time.Sleep(5 * time.Millisecond)
+	_, isProbe := s.circuitWait()
+	assert.True(t, isProbe)
+	probe = s.acquire([]*sqs.Message{expired, mockMessage("msg4", "handle4", "msg4")})
+	s.circuitProbing(probe)
+	s.config.DeadlineAttribute = "deadline"
+	assert.NoError(t, s.processMessages(context.Background(), probe, func(ctx context.Context, msg Message) error {
+		return nil
+	}))
+	assert.Equal(t, CircuitClosed, s.CircuitState())
+}
+
+func TestSQS_StartBufferedWithCircuitBreaker(t *testing.T) {
+	svc := newMockSQS(
+		[]*sqs.Message{mockMessage("msg1", "handle1", "fail"), mockMessage("msg2", "handle2", "fail")},
+		[]*sqs.Message{mockMessage("msg3", "handle3", "ok")},
+	)
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		Logger:              NoopLogger{},
+		BatchSize:           2,
+		EmptyReceiveBackoff: Backoff{Min: 10 * time.Millisecond},
+		CircuitBreaker:      CircuitBreaker{Failures: 2, OpenTimeout: time.Hour},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	err = s.StartBuffered(ctx, func(batch [][]byte) error {
+		if string(batch[0]) == "fail" {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// the receiver stopped once the circuit opened, instead of polling every 10ms
+	assert.Equal(t, CircuitOpen, s.CircuitState())
+	assert.Less(t, len(svc.receiveSizes), 5)
+}
+
+func TestSQS_recordCircuitFailureRate(t *testing.T) {
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:          "queue",
+		CircuitBreaker: CircuitBreaker{FailureRate: 0.5, Window: 10},
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	batch := func(n int) []*sqs.Message {
+		return make([]*sqs.Message, n)
+	}
+
+	s.recordCircuit(batch(5), 4)
+	assert.Equal(t, CircuitClosed, s.CircuitState())
+
+	s.recordCircuit(batch(5), 2)
+	assert.Equal(t, CircuitOpen, s.CircuitState())
+
+	_, err = NewSQSConsumer(&SQSConf{Queue: "queue", CircuitBreaker: CircuitBreaker{FailureRate: 2}}, newMockSQS())
+	assert.EqualError(t, err, "circuit breaker failure rate must be between 0 and 1, got 2.000000")
+}
+
+func TestSQS_PauseResume(t *testing.T) {
+	svc := newMockSQS(
+		[]*sqs.Message{mockMessage("msg1", "handle1", "msg1")},
+		[]*sqs.Message{mockMessage("msg2", "handle2", "msg2")},
+	)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	var lock sync.Mutex
+	var processed []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.Start(ctx, func(data []byte) error {
+			lock.Lock()
+			defer lock.Unlock()
+			processed = append(processed, string(data))
+			// in flight messages are completed once paused
+			s.Pause()
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	lock.Lock()
+	assert.Equal(t, []string{"msg1"}, processed)
+	lock.Unlock()
+	assert.True(t, s.Paused())
+	assert.True(t, s.Stats().Paused)
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+
+	s.Resume()
+	assert.False(t, s.Paused())
+
+	assert.NoError(t, <-stopped)
+	assert.Equal(t, []string{"msg1", "msg2"}, processed)
+	assert.Equal(t, []string{"handle1", "handle2"}, svc.deletedHandles())
+}
+
+func TestSQS_StartWithPollers(t *testing.T) {
+	receives := make([][]*sqs.Message, 6)
+	for i := range receives {
+		receives[i] = []*sqs.Message{mockMessage(fmt.Sprintf("msg%d", i), fmt.Sprintf("handle%d", i), "body")}
+	}
+
+	svc := newMockSQS(receives...)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Concurrency: 3, PollerCount: 2}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var running, maxRunning, processed int32
+
+	err = s.Start(ctx, func(data []byte) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&processed, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(6), processed)
+	assert.LessOrEqual(t, maxRunning, int32(3))
+	assert.Len(t, svc.deletedHandles(), 6)
+
+	_, err = NewSQSConsumer(&SQSConf{Queue: "queue", PollerCount: -1}, svc)
+	assert.EqualError(t, err, "poller count must be positive, got -1")
+}
+
+func TestSQS_StartWithRateLimit(t *testing.T) {
+	messages := make([]*sqs.Message, 5)
+	for i := range messages {
+		messages[i] = mockMessage(fmt.Sprintf("msg%d", i), fmt.Sprintf("handle%d", i), "body")
+	}
+
+	svc := newMockSQS(messages)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Concurrency: 5, RateLimit: 20}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var lock sync.Mutex
+	var processed []time.Time
+
+	err = s.Start(ctx, func(data []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		processed = append(processed, time.Now())
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, processed, 5)
+	sort.Slice(processed, func(i, j int) bool {
+		return processed[i].Before(processed[j])
+	})
+	// a message every 50ms after the first one
+	assert.GreaterOrEqual(t, processed[4].Sub(processed[0]).Milliseconds(), int64(190))
+	assert.Len(t, svc.deletedHandles(), 5)
+}
+
+func TestSQS_autoscale(t *testing.T) {
+	tests := []struct {
+		name        string
+		depths      []int
+		cooldown    time.Duration
+		wantChanges []int
+	}{
+		{
+			name:        "shouldFollowTheQueueDepth",
+			depths:      []int{25, 100, 0},
+			cooldown:    time.Nanosecond,
+			wantChanges: []int{3, 5, 1},
+		},
+		{
+			name:        "shouldWaitTheCooldownBetweenChanges",
+			depths:      []int{25, 100, 0},
+			cooldown:    time.Minute,
+			wantChanges: []int{3},
+		},
+		{
+			name:     "shouldNotChangeTheConcurrencyAlreadyScaled",
+			depths:   []int{45, 50},
+			cooldown: time.Nanosecond,
+			// starting from the configured Concurrency
+			wantChanges: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var changes []int
+
+			svc := newMockSQS()
+			svc.depths = tt.depths
+
+			s, err := NewSQSConsumer(&SQSConf{
+				Queue:         "queue",
+				Concurrency:   5,
+				Autoscale:     true,
+				ScaleInterval: 10 * time.Millisecond,
+				ScaleCooldown: tt.cooldown,
+				Hooks: Hooks{
+					OnAutoscale: func(n int, depth int) {
+						lock.Lock()
+						defer lock.Unlock()
+						changes = append(changes, n)
+					},
+				},
+			}, svc)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, s.config.MinConcurrency)
+			assert.Equal(t, 10, s.config.ScaleTarget)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			s.autoscale(ctx)
+
+			assert.Equal(t, tt.wantChanges, changes)
+		})
+	}
+
+	_, err := NewSQSConsumer(&SQSConf{Queue: "queue", Autoscale: true, AdaptiveConcurrency: true}, newMockSQS())
+	assert.EqualError(t, err, "adaptive concurrency and autoscale can't be combined")
+}
+
+func TestSQS_RunWithAutoscale(t *testing.T) {
+	svc := newMockSQS()
+	svc.depths = []int{30}
+
+	var lock sync.Mutex
+	var changes []int
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:         "queue",
+		Concurrency:   5,
+		Autoscale:     true,
+		ScaleInterval: 10 * time.Millisecond,
+		Hooks: Hooks{
+			OnAutoscale: func(n int, depth int) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes = append(changes, n)
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, s.Run(ctx, func(data []byte) error {
+		return nil
+	}))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []int{3}, changes)
+}
+
+func TestSQS_StartWithMaxRuntime(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", MaxRuntime: 100 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var handlerErr error
+
+	start := time.Now()
+	err = s.StartWithMeta(ctx, func(ctx context.Context, msg Message) error {
+		// still in flight when MaxRuntime elapses
+		time.Sleep(300 * time.Millisecond)
+		handlerErr = ctx.Err()
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, handlerErr)
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+}
+
+func TestSQS_processMessagesRequestOptions(t *testing.T) {
+	var lock sync.Mutex
+	operations := make(map[string]int)
+
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1"), mockMessage("msg2", "handle2", "msg2")})
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:           "queue",
+		DeadLetterQueue: "dlq",
+		RequestOptions: []request.Option{func(r *request.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			operations[r.Operation.Name]++
+		}},
+	}, svc)
+	assert.NoError(t, err)
+
+	messages, err := s.receiveMessages(context.Background())
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), messages, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "msg2" {
+			return WithStatus(400, errors.New("invalid payload"))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"ReceiveMessage": 1, "SendMessageBatch": 1, "DeleteMessageBatch": 1}, operations)
+}
+
+func TestSQS_observeProcessing(t *testing.T) {
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", EMAAlpha: 0.5}, newMockSQS())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1.0, s.stats.observeLatency(s.config.EMAAlpha, 1*time.Second))
+	assert.Equal(t, 2.0, s.stats.observeLatency(s.config.EMAAlpha, 3*time.Second))
+
+	start := time.Now()
+
+	_, changed := s.stats.observeProcessed(s.config.EMAAlpha, 10, start)
+	assert.False(t, changed)
+
+	// the window is not elapsed yet
+	_, changed = s.stats.observeProcessed(s.config.EMAAlpha, 10, start.Add(ThroughputWindow/2))
+	assert.False(t, changed)
+
+	throughput, changed := s.stats.observeProcessed(s.config.EMAAlpha, 5, start.Add(2*ThroughputWindow))
+	assert.True(t, changed)
+	assert.Equal(t, 5.0, throughput)
+
+	throughput, changed = s.stats.observeProcessed(s.config.EMAAlpha, 0, start.Add(3*ThroughputWindow))
+	assert.True(t, changed)
+	assert.Equal(t, 5.0, throughput)
+
+	assert.Equal(t, 2.0, s.Stats().LatencyEMA)
+}
+
+func TestSQS_StartWithMetaReceiveCount(t *testing.T) {
+	msg := withAttribute(mockMessage("msg1", "handle1", "msg1"), "route", "billing")
+	msg.Attributes = map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3")}
+
+	svc := newMockSQS([]*sqs.Message{msg})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", MessageAttributeNames: []string{"route"}, GroupAttribute: "tenant"}, svc)
+	assert.NoError(t, err)
+
+	req := s.pullMessagesRequest()
+	assert.Contains(t, aws.StringValueSlice(req.AttributeNames), sqs.MessageSystemAttributeNameApproximateReceiveCount)
+	assert.Equal(t, []string{"route", "tenant"}, aws.StringValueSlice(req.MessageAttributeNames))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var got Message
+
+	err = s.StartWithMeta(ctx, func(ctx context.Context, msg Message) error {
+		got = msg
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, Message{
+		Body:             []byte("msg1"),
+		MessageId:        "msg1",
+		ReceiptHandle:    "handle1",
+		Attributes:       map[string]string{"route": "billing"},
+		ReceiveCount:     3,
+		SystemAttributes: map[string]string{sqs.MessageSystemAttributeNameApproximateReceiveCount: "3"},
+		Raw:              msg,
+	}, got)
+}
+
+func TestSQS_Run(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantErr     bool
+		wantDeleted []string
+	}{
+		{
+			name:        "shouldKeepPollingAfterTransientErrors",
+			err:         awserr.New(request.ErrCodeResponseTimeout, "timeout", nil),
+			wantDeleted: []string{"handle1"},
+		},
+		{
+			name:        "shouldReturnFatalErrors",
+			err:         awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil),
+			wantErr:     true,
+			wantDeleted: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+			svc.receiveErrors = []error{tt.err}
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			err = s.Run(ctx, func(data []byte) error {
+				return nil
+			})
+
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.wantDeleted, svc.deletedHandles())
+		})
+	}
+}
+
+func TestSQS_StartReceiveErrors(t *testing.T) {
+	throttled := awserr.New("ThrottlingException", "rate exceeded", nil)
+	expired := awserr.New("ExpiredToken", "token expired", nil)
+
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+	svc.receiveErrors = []error{throttled, expired, throttled}
+
+	var fatals []error
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:          "queue",
+		Logger:         NoopLogger{},
+		ReceiveBackoff: Backoff{Min: 10 * time.Millisecond, Max: 40 * time.Millisecond},
+		Hooks:          Hooks{OnFatal: func(err error) { fatals = append(fatals, err) }},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	// transient errors are retried, the consumer stays alive
+	err = s.Start(ctx, func(data []byte) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+	assert.Empty(t, fatals)
+
+	svc = newMockSQS()
+	svc.receiveErrors = []error{awserr.New("AccessDenied", "access denied", nil)}
+
+	s, err = NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, Hooks: Hooks{OnFatal: func(err error) { fatals = append(fatals, err) }}}, svc)
+	assert.NoError(t, err)
+
+	err = s.Start(context.Background(), func(data []byte) error {
+		return nil
+	})
+	assert.EqualError(t, err, "error receiving messages on queue queue: AccessDenied: access denied")
+	assert.Len(t, fatals, 1)
+	assert.True(t, errors.Is(err, fatals[0]))
+}
+
+func TestBackoff_jittered(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: 400 * time.Millisecond}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		wait := b.jittered(attempt)
+		assert.GreaterOrEqual(t, wait.Milliseconds(), b.delay(attempt).Milliseconds()/2)
+		assert.LessOrEqual(t, wait.Milliseconds(), b.delay(attempt).Milliseconds())
+	}
+}
+
+func TestSQS_StartEmptyReceiveBackoff(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		receives []time.Time
+	)
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		EmptyReceiveBackoff: Backoff{Min: 20 * time.Millisecond, Max: 80 * time.Millisecond},
+		RequestOptions: []request.Option{func(r *request.Request) {
+			if r.Operation.Name == "ReceiveMessage" {
+				lock.Lock()
+				defer lock.Unlock()
+				receives = append(receives, time.Now())
+			}
+		}},
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, s.Start(ctx, func(data []byte) error {
+		return nil
+	}))
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !assert.GreaterOrEqual(t, len(receives), 5) {
+		return
+	}
+
+	// 20ms, 40ms, 80ms, then capped at 80ms
+	for i, want := range []int64{20, 40, 80, 80} {
+		interval := receives[i+1].Sub(receives[i]).Milliseconds()
+		assert.GreaterOrEqual(t, interval, want)
+		assert.Less(t, interval, want+60)
+	}
+}
+
+func TestSQS_StartWithConcurrencyBound(t *testing.T) {
+	messages := make([]*sqs.Message, 10)
+	for i := range messages {
+		id := fmt.Sprintf("msg%d", i)
+		messages[i] = mockMessage(id, "handle-"+id, id)
+	}
+
+	svc := newMockSQS(messages)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Concurrency: 2}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var running, peak int32
+
+	err = s.Start(ctx, func(data []byte) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			current := atomic.LoadInt32(&peak)
+			if n <= current || atomic.CompareAndSwapInt32(&peak, current, n) {
+				break
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+	assert.Len(t, svc.deletedHandles(), 10)
+}
+
+func TestSQS_processMessagesHeartbeat(t *testing.T) {
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", HeartbeatInterval: 50 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{mockMessage("msg1", "handle1", "msg1")}, func(ctx context.Context, msg Message) error {
+		time.Sleep(180 * time.Millisecond)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	svc.lock.Lock()
+	extensions := len(svc.visibility)
+	for _, in := range svc.visibility {
+		assert.Equal(t, "handle1", aws.StringValue(in.Entries[0].ReceiptHandle))
+		assert.Equal(t, int64(DefaultVisibilityTimeout), aws.Int64Value(in.Entries[0].VisibilityTimeout))
+	}
+	svc.lock.Unlock()
+
+	assert.GreaterOrEqual(t, extensions, 2)
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+
+	// the heartbeat stops with the handler
+	time.Sleep(100 * time.Millisecond)
+	svc.lock.Lock()
+	assert.Len(t, svc.visibility, extensions)
+	svc.lock.Unlock()
+}
+
+func TestSQS_StartWithResult(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{
+		mockMessage("msg1", "handle1", "ack"),
+		mockMessage("msg2", "handle2", "nack"),
+		mockMessage("msg3", "handle3", "retry"),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", VisibilityTimeout: 30}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	err = s.StartWithResult(ctx, func(ctx context.Context, msg Message) Result {
+		switch string(msg.Body) {
+		case "nack":
+			return Result{}
+		case "retry":
+			return Result{RetryAfter: 60 * time.Second}
+		}
+		return Result{Ack: true}
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	visibility := make(map[string]int64)
+	for _, in := range svc.visibility {
+		for _, entry := range in.Entries {
+			visibility[aws.StringValue(entry.ReceiptHandle)] = aws.Int64Value(entry.VisibilityTimeout)
+		}
+	}
+
+	// plain rejections are left in the queue, only the delayed ones change visibility
+	assert.Equal(t, map[string]int64{"handle3": 60}, visibility)
+}
+
+func TestSQS_StartWithResultRejectionClassified(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "nack")})
+
+	var classified []error
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:           "queue",
+		Logger:          NoopLogger{},
+		DeadLetterQueue: "dlq",
+		ErrorClassifier: func(err error) ErrorAction {
+			classified = append(classified, err)
+			if errors.Is(err, ErrRejected) {
+				return DeadLetter
+			}
+			return Retry
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = s.StartWithResult(ctx, func(ctx context.Context, msg Message) Result {
+		return Result{}
+	})
+	assert.NoError(t, err)
+
+	assert.NotEmpty(t, classified)
+	assert.Equal(t, []string{"nack"}, svc.sentBodies("dlq"))
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+	assert.Empty(t, svc.visibility)
+}
+
+func TestSQS_processMessagesMiddlewares(t *testing.T) {
+	metrics := &fakeMetrics{}
+	failures := make(map[string]error)
+	var calls []string
+
+	trace := func(name string) Middleware {
+		return func(next ConsumerFnWithMeta) ConsumerFnWithMeta {
+			return func(ctx context.Context, msg Message) error {
+				calls = append(calls, name+":"+msg.MessageId)
+				return next(ctx, msg)
+			}
+		}
+	}
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:       "queue",
+		Metrics:     metrics,
+		Middlewares: []Middleware{trace("outer"), RecoverMiddleware, trace("inner"), TimeoutMiddleware(50 * time.Millisecond)},
+		Hooks: Hooks{
+			OnError: func(msg Message, err error) {
+				failures[msg.MessageId] = err
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "panic"),
+		mockMessage("msg2", "handle2", "slow"),
+		mockMessage("msg3", "handle3", "ok"),
+	}, func(ctx context.Context, msg Message) error {
+		switch string(msg.Body) {
+		case "panic":
+			panic("boom")
+		case "slow":
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"outer:msg1", "inner:msg1", "outer:msg2", "inner:msg2", "outer:msg3", "inner:msg3"}, calls)
+	assert.EqualError(t, failures["msg1"], "consumer function panicked: boom")
+	assert.True(t, errors.Is(failures["msg2"], context.DeadlineExceeded))
+	assert.Len(t, failures, 2)
+	assert.Equal(t, 2, metrics.failed)
+	assert.Equal(t, []string{"handle3"}, svc.deletedHandles())
+}
+
+func TestSQS_processMessagesRecoversPanics(t *testing.T) {
+	var panics []string
+	failures := make(map[string]error)
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue: "queue",
+		Hooks: Hooks{
+			OnPanic: func(msg Message, recovered interface{}) {
+				panics = append(panics, fmt.Sprintf("%s:%v", msg.MessageId, recovered))
+			},
+			OnError: func(msg Message, err error) {
+				failures[msg.MessageId] = err
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "panic"),
+		mockMessage("msg2", "handle2", "ok"),
+	}, func(ctx context.Context, msg Message) error {
+		if string(msg.Body) == "panic" {
+			panic("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"msg1:boom"}, panics)
+	var panicErr *PanicError
+	assert.True(t, errors.As(failures["msg1"], &panicErr))
+	assert.Equal(t, "boom", panicErr.Recovered)
+	assert.NotEmpty(t, panicErr.Stack)
+	assert.Len(t, failures, 1)
+	assert.Equal(t, []string{"handle2"}, svc.deletedHandles())
+
+	err = s.consumeBatch([]*sqs.Message{mockMessage("msg3", "handle3", "batch")}, func(data [][]byte) error {
+		panic("batch boom")
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"msg1:boom", "msg3:batch boom"}, panics)
+	assert.True(t, errors.As(failures["msg3"], &panicErr))
+	assert.Equal(t, []string{"handle2"}, svc.deletedHandles())
+}
+
+func TestSQS_processMessagesUnwrapSNS(t *testing.T) {
+	envelope := `{"Type":"Notification","MessageId":"sns1","TopicArn":"arn:aws:sns:eu-west-1:123:topic","Subject":"order",` +
+		`"Message":"{\"id\":1}","Timestamp":"2021-01-01T00:00:00.000Z",` +
+		`"MessageAttributes":{"tenant":{"Type":"String","Value":"acme"},"blob":{"Type":"Binary","Value":"AQI="}}}`
+
+	tests := []struct {
+		name       string
+		unwrap     bool
+		body       string
+		wantBody   string
+		wantTenant string
+		wantSNS    *SNSNotification
+	}{
+		{
+			name:       "shouldUnwrapTheNotifications",
+			unwrap:     true,
+			body:       envelope,
+			wantBody:   `{"id":1}`,
+			wantTenant: "acme",
+			wantSNS: &SNSNotification{
+				MessageId: "sns1",
+				TopicArn:  "arn:aws:sns:eu-west-1:123:topic",
+				Subject:   "order",
+				Timestamp: "2021-01-01T00:00:00.000Z",
+			},
+		},
+		{
+			name:     "shouldLeaveTheOtherBodiesUntouched",
+			unwrap:   true,
+			body:     `{"Type":"order"}`,
+			wantBody: `{"Type":"order"}`,
+		},
+		{
+			name:     "shouldNotUnwrapWhenDisabled",
+			body:     envelope,
+			wantBody: envelope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", UnwrapSNS: tt.unwrap}, newMockSQS())
+			assert.NoError(t, err)
+
+			var got Message
+			err = s.processMessages(context.Background(), []*sqs.Message{mockMessage("msg1", "handle1", tt.body)}, func(ctx context.Context, msg Message) error {
+				got = msg
+				return nil
+			})
+			assert.NoError(t, err)
+
+			assert.Equal(t, tt.wantBody, string(got.Body))
+			assert.Equal(t, tt.wantTenant, got.Attributes["tenant"])
+			assert.NotContains(t, got.Attributes, "blob")
+			assert.Equal(t, tt.wantSNS, got.SNS)
+		})
+	}
+}
+
+func TestSQS_Use(t *testing.T) {
+	var calls []string
+
+	trace := func(name string) Middleware {
+		return func(next ConsumerFnWithMeta) ConsumerFnWithMeta {
+			return func(ctx context.Context, msg Message) error {
+				calls = append(calls, name+":"+msg.Attributes["tenant"])
+				return next(ctx, msg)
+			}
+		}
+	}
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:       "queue",
+		Middlewares: []Middleware{trace("conf")},
+	}, svc)
+	assert.NoError(t, err)
+
+	s.Use(trace("first"), trace("second"))
+
+	msg := mockMessage("msg1", "handle1", "body")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"tenant": {DataType: aws.String("String"), StringValue: aws.String("acme")},
+	}
+
+	err = s.processMessages(context.Background(), []*sqs.Message{msg}, func(ctx context.Context, msg Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"conf:acme", "first:acme", "second:acme", "handler"}, calls)
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+}
+
+func TestSQS_StartWithBatchResult(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantDeleted    int
+		wantRedelivery []string
+	}{
+		{
+			name:           "shouldRedeliverTheRejectedMessages",
+			wantDeleted:    9,
+			wantRedelivery: []string{"handle-msg3"},
+		},
+		{
+			name:           "shouldDeleteNoneOnError",
+			err:            errors.New("transaction failed"),
+			wantDeleted:    0,
+			wantRedelivery: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make([]*sqs.Message, 10)
+			for i := range messages {
+				id := fmt.Sprintf("msg%d", i)
+				messages[i] = mockMessage(id, "handle-"+id, id)
+			}
+
+			svc := newMockSQS(messages)
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			var batches [][]string
+			err = s.StartWithBatchResult(ctx, func(ctx context.Context, msgs []Message) ([]Result, error) {
+				ids := make([]string, len(msgs))
+				results := make([]Result, len(msgs))
+				for i, msg := range msgs {
+					ids[i] = msg.MessageId
+					results[i] = Result{Ack: i != 3, RetryAfter: 10 * time.Second}
+				}
+				batches = append(batches, ids)
+				return results, tt.err
+			})
+			assert.NoError(t, err)
+
+			assert.Len(t, batches, 1)
+			assert.Len(t, svc.deletedHandles(), tt.wantDeleted)
+			assert.NotContains(t, svc.deletedHandles(), "handle-msg3")
+
+			svc.lock.Lock()
+			defer svc.lock.Unlock()
+
+			redelivered := make([]string, 0)
+			for _, in := range svc.visibility {
+				for _, entry := range in.Entries {
+					redelivered = append(redelivered, aws.StringValue(entry.ReceiptHandle))
+					assert.Equal(t, int64(10), aws.Int64Value(entry.VisibilityTimeout))
+				}
+			}
+			assert.Equal(t, tt.wantRedelivery, redelivered)
+		})
+	}
+}
+
+func TestSQS_Shutdown(t *testing.T) {
+	tests := []struct {
+		name        string
+		drain       time.Duration
+		wantErr     string
+		wantDeleted int
+	}{
+		{
+			name:        "shouldWaitForTheInFlightMessages",
+			drain:       1 * time.Second,
+			wantDeleted: 3,
+		},
+		{
+			name:        "shouldCancelTheHandlersOnTimeout",
+			drain:       50 * time.Millisecond,
+			wantErr:     "shutdown with 3 messages still in flight: context deadline exceeded",
+			wantDeleted: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS([]*sqs.Message{
+				mockMessage("msg1", "handle1", "msg1"),
+				mockMessage("msg2", "handle2", "msg2"),
+				mockMessage("msg3", "handle3", "msg3"),
+			})
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Concurrency: 3}, svc)
+			assert.NoError(t, err)
+
+			var started sync.WaitGroup
+			started.Add(3)
+
+			stopped := make(chan error)
+			go func() {
+				stopped <- s.StartWithMeta(context.Background(), func(ctx context.Context, msg Message) error {
+					started.Done()
+					select {
+					case <-time.After(200 * time.Millisecond):
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				})
+			}()
+
+			started.Wait()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.drain)
+			defer cancel()
+
+			begin := time.Now()
+			err = s.Shutdown(ctx)
+
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				assert.Less(t, time.Since(begin).Milliseconds(), int64(200))
+			} else {
+				assert.NoError(t, err)
+				assert.GreaterOrEqual(t, time.Since(begin).Milliseconds(), int64(150))
+			}
+
+			assert.NoError(t, <-stopped)
+			assert.Len(t, svc.deletedHandles(), tt.wantDeleted)
+			assert.Equal(t, ErrClosed, s.Start(context.Background(), func(data []byte) error {
+				return nil
+			}))
+		})
+	}
+}
+
+func TestSQS_RunWithSignalsDrainTimeout(t *testing.T) {
+	// a ConsumerFn can't honor the cancellation requested after the timeout, its message is deleted anyway
+	tests := []struct {
+		name    string
+		drain   time.Duration
+		wantErr bool
+	}{
+		{
+			name:  "shouldDrainTheInFlightMessages",
+			drain: 1 * time.Second,
+		},
+		{
+			name:    "shouldReportTheDrainTimeout",
+			drain:   50 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", DrainTimeout: tt.drain}, svc)
+			assert.NoError(t, err)
+
+			started := make(chan struct{})
+			go func() {
+				<-started
+				assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+			}()
+
+			err = s.RunWithSignals(func(data []byte) error {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				return nil
+			}, syscall.SIGUSR1)
+
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+		})
+	}
+}
+
+func TestSQS_RunDrainsOnCancel(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err = s.Run(ctx, func(data []byte) error {
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+}
+
+func TestSQS_StartWithMaxReceiveCount(t *testing.T) {
+	tests := []struct {
+		name            string
+		deadLetterQueue string
+		wantDeadLetter  []string
+	}{
+		{
+			name:            "shouldForwardToTheDeadLetterQueue",
+			deadLetterQueue: "dlq",
+			wantDeadLetter:  []string{"poison"},
+		},
+		{
+			name: "shouldDropWithoutDeadLetterQueue",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receive := func(count int) []*sqs.Message {
+				msg := mockMessage("msg1", fmt.Sprintf("handle%d", count), "poison")
+				msg.Attributes = map[string]*string{
+					sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(strconv.Itoa(count)),
+				}
+				return []*sqs.Message{msg}
+			}
+
+			svc := newMockSQS(receive(1), receive(2), receive(3))
+
+			s, err := NewSQSConsumer(&SQSConf{
+				Queue:           "queue",
+				MaxReceiveCount: 3,
+				DeadLetterQueue: tt.deadLetterQueue,
+			}, svc)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			attempts := 0
+			err = s.Start(ctx, func(data []byte) error {
+				attempts++
+				return errors.New("always failing")
+			})
+			assert.NoError(t, err)
+
+			assert.Equal(t, 3, attempts)
+			assert.Equal(t, tt.wantDeadLetter, svc.sentBodies("dlq"))
+			assert.Equal(t, []string{"handle3"}, svc.deletedHandles())
+		})
+	}
+}
+
+func TestSQS_heartbeat(t *testing.T) {
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", ExtendVisibility: true, VisibilityTimeout: 30}, newMockSQS())
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Second, s.config.HeartbeatInterval)
+
+	svc := newMockSQS()
+	s, err = NewSQSConsumer(&SQSConf{Queue: "queue", ExtendVisibility: true, HeartbeatInterval: 20 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := s.heartbeat(ctx, []*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+
+	time.Sleep(70 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	svc.lock.Lock()
+	extensions := len(svc.visibility)
+	svc.lock.Unlock()
+	assert.GreaterOrEqual(t, extensions, 2)
+
+	// the heartbeat stops with the context
+	time.Sleep(60 * time.Millisecond)
+	stop()
+
+	svc.lock.Lock()
+	assert.Len(t, svc.visibility, extensions)
+	svc.lock.Unlock()
+}
+
+func TestSQS_StartWithBatchFailures(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+		mockMessage("msg3", "handle3", "msg3"),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	err = s.StartWithBatchFailures(ctx, func(ctx context.Context, msgs []Message) ([]string, error) {
+		return []string{"msg2"}, nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"handle1", "handle3"}, svc.deletedHandles())
+}
+
+func TestSQS_processMessagesRetryBackoff(t *testing.T) {
+	received := func(id string, count int) *sqs.Message {
+		msg := mockMessage(id, "handle-"+id, id)
+		msg.Attributes = map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(strconv.Itoa(count)),
+		}
+		return msg
+	}
+
+	svc := newMockSQS()
+	var poisoned []string
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:           "queue",
+		RetryBackoff:    Backoff{Min: 10 * time.Second, Max: 60 * time.Second},
+		MaxReceiveCount: 5,
+		Hooks: Hooks{
+			OnPoisoned: func(msg Message, err error) {
+				poisoned = append(poisoned, msg.MessageId)
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		received("first", 1),
+		received("third", 3),
+		received("fourth", 4),
+		received("fifth", 5),
+		received("asked", 2),
+	}, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "asked" {
+			return RetryAfterError(5 * time.Second)
+		}
+		return errors.New("boom")
+	})
+	assert.NoError(t, err)
+
+	svc.lock.Lock()
+	visibility := make(map[string]int64)
+	for _, in := range svc.visibility {
+		for _, entry := range in.Entries {
+			visibility[aws.StringValue(entry.ReceiptHandle)] = aws.Int64Value(entry.VisibilityTimeout)
+		}
+	}
+	svc.lock.Unlock()
+
+	assert.Equal(t, map[string]int64{"handle-first": 10, "handle-third": 40, "handle-fourth": 60, "handle-asked": 5}, visibility)
+	assert.Equal(t, []string{"fifth"}, poisoned)
+	assert.Equal(t, []string{"handle-fifth"}, svc.deletedHandles())
+}
+
+// blockingSQS blocks the first blocked receives until their context is done
+type blockingSQS struct {
+	*mockSQS
+	blocked int32
+	calls   int32
+}
+
+func (b *blockingSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	atomic.AddInt32(&b.calls, 1)
+	if atomic.AddInt32(&b.blocked, -1) >= 0 {
+		<-ctx.Done()
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	return b.mockSQS.ReceiveMessageWithContext(ctx, in, opts...)
+}
+
+func TestSQS_StartPollTimeout(t *testing.T) {
+	svc := &blockingSQS{mockSQS: newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")}), blocked: 2}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, PollTimeout: 50 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var consumedAfter time.Duration
+	err = s.Start(ctx, func(data []byte) error {
+		consumedAfter = time.Since(start)
+		return nil
+	})
+
+	// the stuck receives are abandoned after PollTimeout and retried, without failing the consumer
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+	assert.GreaterOrEqual(t, consumedAfter.Milliseconds(), int64(100))
+	assert.Less(t, consumedAfter.Milliseconds(), int64(250))
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&svc.calls), int32(3))
+}
+
+func TestSQS_WaitReady(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}}, svc)
+	assert.NoError(t, err)
+	assert.False(t, s.Ready())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- s.Start(ctx, func(data []byte) error {
+			return nil
+		})
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+
+	assert.NoError(t, s.WaitReady(waitCtx))
+	assert.True(t, s.Ready())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestSQS_WaitReadyUnreachableQueue(t *testing.T) {
+	// every receive hangs until abandoned, e.g. because the endpoint is unreachable
+	svc := &blockingSQS{mockSQS: newMockSQS(), blocked: math.MaxInt32}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, PollTimeout: 20 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- s.Start(ctx, func(data []byte) error {
+			return nil
+		})
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer waitCancel()
+
+	assert.Equal(t, context.DeadlineExceeded, s.WaitReady(waitCtx))
+	assert.False(t, s.Ready())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestSQS_receiveMessagesOnActivity(t *testing.T) {
+	svc := newMockSQS(
+		[]*sqs.Message{mockMessage("msg1", "handle1", "msg1")},
+		[]*sqs.Message{},
+		[]*sqs.Message{},
+		[]*sqs.Message{mockMessage("msg2", "handle2", "msg2")},
+		[]*sqs.Message{mockMessage("msg3", "handle3", "msg3")},
+		[]*sqs.Message{},
+		[]*sqs.Message{mockMessage("msg4", "handle4", "msg4")},
+	)
+
+	activities := 0
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Hooks: Hooks{OnActivity: func() {
+		activities++
+	}}}, svc)
+	assert.NoError(t, err)
+
+	want := []int{0, 0, 0, 1, 1, 1, 2}
+	for i, activity := range want {
+		_, err := s.receiveMessages(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, activity, activities, "receive %d", i)
+	}
+}
+
+func TestSQS_processMessagesDeadline(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name          string
+		deadline      string
+		wantConsumed  bool
+		wantDeleted   []string
+		wantMalformed bool
+	}{
+		{name: "shouldDeleteExpiredUnixDeadlines", deadline: "946684800", wantDeleted: []string{"handle1"}},
+		{name: "shouldDeleteExpiredRFC3339Deadlines", deadline: "2000-01-01T00:00:00Z", wantDeleted: []string{"handle1"}},
+		{name: "shouldConsumeBeforeUnixDeadlines", deadline: strconv.FormatInt(future.Unix(), 10), wantConsumed: true, wantDeleted: []string{"handle1"}},
+		{name: "shouldConsumeBeforeRFC3339Deadlines", deadline: future.Format(time.RFC3339), wantConsumed: true, wantDeleted: []string{"handle1"}},
+		{name: "shouldConsumeWithoutDeadline", wantConsumed: true, wantDeleted: []string{"handle1"}},
+		{name: "shouldKeepMalformedDeadlines", deadline: "tomorrow", wantDeleted: []string{}, wantMalformed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS()
+
+			var malformed []string
+			s, err := NewSQSConsumer(&SQSConf{
+				Queue:             "queue",
+				Logger:            NoopLogger{},
+				DeadlineAttribute: "deadline",
+				Hooks: Hooks{OnMalformed: func(msg Message, err error) {
+					malformed = append(malformed, msg.MessageId)
+				}},
+			}, svc)
+			assert.NoError(t, err)
+
+			msg := mockMessage("msg1", "handle1", "msg1")
+			if tt.deadline != "" {
+				withAttribute(msg, "deadline", tt.deadline)
+			}
+
+			consumed := false
+			var consumedDeadline time.Time
+			err = s.processMessages(context.Background(), s.acquire([]*sqs.Message{msg}), func(ctx context.Context, msg Message) error {
+				consumed = true
+				consumedDeadline, _ = ctx.Deadline()
+				return nil
+			})
+			assert.NoError(t, err)
+
+			assert.Equal(t, tt.wantConsumed, consumed)
+			assert.Equal(t, tt.wantDeleted, svc.deletedHandles())
+			assert.Equal(t, tt.wantMalformed, len(malformed) == 1)
+
+			// the context of the consumer function expires with the message
+			if consumed && tt.deadline != "" {
+				assert.Equal(t, future.Unix(), consumedDeadline.Unix())
+			}
+		})
+	}
+}
+
+func TestSQS_adaptMaxNumberOfMessages(t *testing.T) {
+	var changes []int64
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:                       "queue",
+		VisibilityTimeout:           40,
+		MaxNumberOfMessages:         10,
+		MinNumberOfMessages:         2,
+		AdaptiveMaxNumberOfMessages: true,
+		Hooks: Hooks{OnMaxNumberOfMessagesChange: func(n int64) {
+			changes = append(changes, n)
+		}},
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(10), s.Stats().MaxNumberOfMessages)
+
+	// slower than half of the VisibilityTimeout: halved down to MinNumberOfMessages
+	s.adaptMaxNumberOfMessages(10, 25*time.Second)
+	assert.Equal(t, int64(5), s.Stats().MaxNumberOfMessages)
+	s.adaptMaxNumberOfMessages(5, 25*time.Second)
+	s.adaptMaxNumberOfMessages(2, 25*time.Second)
+	assert.Equal(t, int64(2), s.Stats().MaxNumberOfMessages)
+
+	// in between: unchanged
+	s.adaptMaxNumberOfMessages(2, 15*time.Second)
+	assert.Equal(t, int64(2), s.Stats().MaxNumberOfMessages)
+
+	// faster than a quarter: grows by one, only when receives are full
+	s.adaptMaxNumberOfMessages(1, time.Second)
+	assert.Equal(t, int64(2), s.Stats().MaxNumberOfMessages)
+	s.adaptMaxNumberOfMessages(2, time.Second)
+	assert.Equal(t, int64(3), s.Stats().MaxNumberOfMessages)
+	assert.Equal(t, int64(3), aws.Int64Value(s.pullMessagesRequest().MaxNumberOfMessages))
+
+	for i := 0; i < 10; i++ {
+		s.adaptMaxNumberOfMessages(int(s.MaxNumberOfMessages()), time.Second)
+	}
+	assert.Equal(t, int64(10), s.Stats().MaxNumberOfMessages)
+
+	assert.Equal(t, []int64{5, 2, 3, 4, 5, 6, 7, 8, 9, 10}, changes)
+}
+
+func TestSQS_processMessagesBeforeDelete(t *testing.T) {
+	svc := newMockSQS()
+
+	var lock sync.Mutex
+	var before []string
+	var deleted []string
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:  "queue",
+		Logger: NoopLogger{},
+		Hooks: Hooks{
+			BeforeDelete: func(msg *sqs.Message) error {
+				lock.Lock()
+				defer lock.Unlock()
+				before = append(before, aws.StringValue(msg.ReceiptHandle))
+				if aws.StringValue(msg.Body) == "keep" {
+					return errors.New("under investigation")
+				}
+				return nil
+			},
+			OnDelete: func(msg Message, elapsed time.Duration) {
+				lock.Lock()
+				defer lock.Unlock()
+				deleted = append(deleted, msg.ReceiptHandle)
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), s.acquire([]*sqs.Message{
+		mockMessage("msg1", "handle1", "ok"),
+		mockMessage("msg2", "handle2", "keep"),
+		mockMessage("msg3", "handle3", "fail"),
+	}), func(ctx context.Context, msg Message) error {
+		if string(msg.Body) == "fail" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// invoked for the processed messages only, the vetoed ones are kept in the queue
+	assert.ElementsMatch(t, []string{"handle1", "handle2"}, before)
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+	assert.Equal(t, []string{"handle1"}, deleted)
+}
+
+func TestSQS_processMessagesMirrorQueue(t *testing.T) {
+	tests := []struct {
+		name         string
+		mirrorFatal  bool
+		wantConsumed []string
+		wantDeleted  []string
+	}{
+		{
+			name:         "shouldProcessMessagesNotMirrored",
+			wantConsumed: []string{"mirrored", "unmirrorable"},
+			wantDeleted:  []string{"handle1", "handle2"},
+		},
+		{
+			name:         "shouldKeepMessagesNotMirroredWithMirrorFatal",
+			mirrorFatal:  true,
+			wantConsumed: []string{"mirrored"},
+			wantDeleted:  []string{"handle1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS()
+			svc.sendFailures = map[string]int{"unmirrorable": 1}
+
+			s, err := NewSQSConsumer(&SQSConf{
+				Queue:       "queue",
+				Logger:      NoopLogger{},
+				MirrorQueue: "mirror",
+				MirrorFatal: tt.mirrorFatal,
+				SendRetries: -1,
+			}, svc)
+			assert.NoError(t, err)
+
+			mirrored := withAttribute(mockMessage("msg1", "handle1", "mirrored"), "route", "billing")
+
+			var lock sync.Mutex
+			consumed := make([]string, 0)
+			err = s.processMessages(context.Background(), s.acquire([]*sqs.Message{
+				mirrored,
+				mockMessage("msg2", "handle2", "unmirrorable"),
+			}), func(ctx context.Context, msg Message) error {
+				lock.Lock()
+				defer lock.Unlock()
+				consumed = append(consumed, string(msg.Body))
+				return nil
+			})
+			assert.NoError(t, err)
+
+			assert.ElementsMatch(t, tt.wantConsumed, consumed)
+			assert.ElementsMatch(t, tt.wantDeleted, svc.deletedHandles())
+
+			// the copy keeps body and attributes
+			assert.Equal(t, []string{"mirrored"}, svc.sentBodies("mirror"))
+			assert.Equal(t, "billing", aws.StringValue(svc.sendBatches[0].Entries[0].MessageAttributes["route"].StringValue))
+		})
+	}
+}
+
+func TestSQS_StartInitialDelay(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+
+	var lock sync.Mutex
+	var firstReceive time.Time
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:        "queue",
+		InitialDelay: 100 * time.Millisecond,
+		RequestOptions: []request.Option{func(r *request.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.Operation.Name == "ReceiveMessage" && firstReceive.IsZero() {
+				firstReceive = time.Now()
+			}
+		}},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = s.Start(ctx, func(data []byte) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, firstReceive.Sub(start).Milliseconds(), int64(100))
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+
+	// cancelled while waiting: nothing is received
+	svc = newMockSQS()
+	s, err = NewSQSConsumer(&SQSConf{Queue: "queue", InitialDelay: time.Hour}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, s.Start(ctx, func(data []byte) error {
+		return nil
+	}))
+	assert.Empty(t, svc.receiveSizes)
+}
+
+func TestSQS_StartWithFollowUp(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+	})
+	svc.sendFailures = map[string]int{"next-msg2": 1}
+
+	var lock sync.Mutex
+	var operations []string
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:     "queue",
+		NextQueue: "next",
+		RequestOptions: []request.Option{func(r *request.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.Operation.Name == "SendMessage" || r.Operation.Name == "DeleteMessageBatch" {
+				operations = append(operations, r.Operation.Name)
+			}
+		}},
+		Logger: NoopLogger{},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = s.StartWithFollowUp(ctx, func(ctx context.Context, msg Message) (*FollowUp, error) {
+		return &FollowUp{Body: []byte("next-" + string(msg.Body))}, nil
+	})
+	assert.NoError(t, err)
+
+	// the follow-ups are sent before deleting, the failed one keeps its source message
+	assert.Equal(t, []string{"next-msg1"}, svc.sentBodies("next"))
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+	assert.Equal(t, "SendMessage", operations[0])
+	assert.Contains(t, operations, "DeleteMessageBatch")
+}
+
+func TestSQS_setConcurrencyWakesSlots(t *testing.T) {
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Concurrency: 2}, newMockSQS())
+	assert.NoError(t, err)
+
+	s.setConcurrency(1)
+	s.slots.acquire(s.Concurrency)
+
+	acquired := make(chan struct{})
+	go func() {
+		s.slots.acquire(s.Concurrency)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("slot acquired beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// increasing the limit lets the waiter in without any release
+	s.setConcurrency(2)
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("waiter not woken up by the increased limit")
+	}
+}
+
+func TestSQS_StartBatchedReceiveErrors(t *testing.T) {
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+	svc.receiveErrors = []error{awserr.New("InvalidParameterValue", "invalid parameter", nil)}
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		Logger:              NoopLogger{},
+		EmptyReceiveBackoff: Backoff{Min: 10 * time.Millisecond},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	// non fatal errors are survived
+	var consumed [][]byte
+	err = s.StartBatched(ctx, batcher.NewBatcher(), func(data [][]byte) error {
+		consumed = append(consumed, data...)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("msg1")}, consumed)
+
+	// fatal ones are returned, and reported to OnFatal
+	svc = newMockSQS()
+	svc.receiveErrors = []error{awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil)}
+
+	var fatalErr error
+	s, err = NewSQSConsumer(&SQSConf{
+		Queue:  "queue",
+		Logger: NoopLogger{},
+		Hooks:  Hooks{OnFatal: func(err error) { fatalErr = err }},
+	}, svc)
+	assert.NoError(t, err)
+
+	err = s.StartBatched(context.Background(), batcher.NewBatcher(), func(data [][]byte) error {
+		return nil
+	})
+	assert.True(t, fatal(err))
+	assert.Equal(t, err, fatalErr)
+}
+
+func TestSQS_StartBackingOff(t *testing.T) {
+	throttled := awserr.New("ThrottlingException", "rate exceeded", nil)
+
+	svc := newMockSQS([]*sqs.Message{mockMessage("msg1", "handle1", "msg1")})
+	svc.receiveErrors = []error{throttled, throttled}
+
+	metrics := &fakeMetrics{}
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:          "queue",
+		Logger:         NoopLogger{},
+		Metrics:        metrics,
+		ReceiveBackoff: Backoff{Min: 200 * time.Millisecond, Max: 200 * time.Millisecond},
+	}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	handled := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.Start(ctx, func(data []byte) error {
+			close(handled)
+			return nil
+		})
+	}()
+
+	// backing off while the receives are throttled
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, s.Stats().BackingOff)
+
+	<-handled
+	assert.False(t, s.Stats().BackingOff)
+
+	cancel()
+	assert.NoError(t, <-stopped)
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	assert.Equal(t, []bool{true, false, true, false}, metrics.backingOff[:4])
+}
+
+func TestSQS_StatsReceiveBatchSize(t *testing.T) {
+	svc := newMockSQS(
+		[]*sqs.Message{mockMessage("msg1", "handle1", "msg1"), mockMessage("msg2", "handle2", "msg2"), mockMessage("msg3", "handle3", "msg3")},
+		[]*sqs.Message{mockMessage("msg4", "handle4", "msg4")},
+	)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue"}, svc)
+	assert.NoError(t, err)
+
+	assert.Equal(t, BatchSizeStats{}, s.Stats().ReceiveBatchSize)
+
+	// the empty receive, once the outputs are exhausted, counts too
+	for i := 0; i < 3; i++ {
+		_, err := s.receiveMessages(context.Background())
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, BatchSizeStats{Count: 3, Min: 0, Max: 3, Avg: 4.0 / 3}, s.Stats().ReceiveBatchSize)
+}
+
+func TestSQS_supervise(t *testing.T) {
+	var restarts []time.Time
+	var recovered []interface{}
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:          "queue",
+		Logger:         NoopLogger{},
+		Supervise:      true,
+		RestartBackoff: 20 * time.Millisecond,
+		Hooks: Hooks{OnRestart: func(loop string, r interface{}) {
+			assert.Equal(t, "consumer", loop)
+			restarts = append(restarts, time.Now())
+			recovered = append(recovered, r)
+		}},
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	runs := 0
+	boom := errors.New("boom")
+	err = s.supervise(context.Background(), "consumer", func() error {
+		runs++
+		if runs <= 3 {
+			panic(fmt.Sprintf("panic %d", runs))
+		}
+		return boom
+	})
+
+	// errors are returned, only panics restart the loop
+	assert.Equal(t, boom, err)
+	assert.Equal(t, 4, runs)
+	assert.Equal(t, []interface{}{"panic 1", "panic 2", "panic 3"}, recovered)
+
+	// 20ms then 40ms between the restarts
+	assert.GreaterOrEqual(t, restarts[1].Sub(restarts[0]).Milliseconds(), int64(20))
+	assert.GreaterOrEqual(t, restarts[2].Sub(restarts[1]).Milliseconds(), int64(40))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	runs = 0
+	err = s.supervise(ctx, "consumer", func() error {
+		runs++
+		panic("always")
+	})
+
+	// restarted after 20ms, then ctx is done while waiting 40ms
+	assert.NoError(t, err)
+	assert.Equal(t, 2, runs)
+
+	s.config.Supervise = false
+	assert.Panics(t, func() {
+		_ = s.supervise(context.Background(), "consumer", func() error {
+			panic("unsupervised")
+		})
+	})
+}
+
+func TestSQS_receiveMessagesGather(t *testing.T) {
+	messages := func(ids ...string) []*sqs.Message {
+		batch := make([]*sqs.Message, 0, len(ids))
+		for _, id := range ids {
+			batch = append(batch, mockMessage(id, "handle-"+id, id))
+		}
+		return batch
+	}
+
+	tests := []struct {
+		name              string
+		maxGatherReceives int
+		receives          [][]*sqs.Message
+		wantIds           int
+		wantSizes         []int64
+	}{
+		{
+			name:              "shouldStopAfterMaxGatherReceives",
+			maxGatherReceives: 2,
+			receives:          [][]*sqs.Message{messages("1", "2"), messages("3", "4"), messages("5", "6"), messages("7", "8")},
+			wantIds:           6,
+			wantSizes:         []int64{10, 8, 6},
+		},
+		{
+			name:              "shouldStopOnEmptyGather",
+			maxGatherReceives: 3,
+			receives:          [][]*sqs.Message{messages("1", "2"), {}, messages("3")},
+			wantIds:           2,
+			wantSizes:         []int64{10, 8},
+		},
+		{
+			name:              "shouldStopOnceFull",
+			maxGatherReceives: 5,
+			receives:          [][]*sqs.Message{messages("1", "2", "3", "4", "5", "6"), messages("7", "8", "9", "10"), messages("11")},
+			wantIds:           10,
+			wantSizes:         []int64{10, 4},
+		},
+		{
+			name:      "shouldNotGatherByDefault",
+			receives:  [][]*sqs.Message{messages("1", "2"), messages("3", "4")},
+			wantIds:   2,
+			wantSizes: []int64{10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS(tt.receives...)
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", MaxNumberOfMessages: 10, MaxGatherReceives: tt.maxGatherReceives}, svc)
+			assert.NoError(t, err)
+
+			received, err := s.receiveMessages(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, received, tt.wantIds)
+			assert.Equal(t, tt.wantSizes, svc.receiveSizes)
+		})
+	}
+}
+
+func TestSQS_receiveMessagesDurationAttribute(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration string
+		want     int64
+		wantSet  bool
+	}{
+		{name: "shouldUseSeconds", duration: "90", want: 90, wantSet: true},
+		{name: "shouldUseGoDurations", duration: "1m30s", want: 90, wantSet: true},
+		{name: "shouldRoundUpSubSecondDurations", duration: "500ms", want: 1, wantSet: true},
+		{name: "shouldClampToMaxVisibilityTimeout", duration: "24h", want: int64(MaxVisibilityTimeout / time.Second), wantSet: true},
+		{name: "shouldIgnoreNegativeSeconds", duration: "-5"},
+		{name: "shouldIgnoreNegativeDurations", duration: "-1m"},
+		{name: "shouldIgnoreZero", duration: "0"},
+		{name: "shouldIgnoreMalformedDurations", duration: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newMockSQS([]*sqs.Message{
+				withAttribute(mockMessage("msg1", "handle1", "msg1"), "duration", tt.duration),
+				withAttribute(mockMessage("msg2", "handle2", "msg2"), "duration", "10"),
+			})
+
+			s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, DurationAttribute: "duration"}, svc)
+			assert.NoError(t, err)
+
+			messages, err := s.receiveMessages(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, messages, 2)
+
+			visibility := make(map[string]int64)
+			for _, in := range svc.visibility {
+				for _, entry := range in.Entries {
+					visibility[aws.StringValue(entry.ReceiptHandle)] = aws.Int64Value(entry.VisibilityTimeout)
+				}
+			}
+
+			want := map[string]int64{"handle2": 10}
+			if tt.wantSet {
+				want["handle1"] = tt.want
+			}
+			// invalid durations don't prevent the valid ones from being applied
+			assert.Equal(t, want, visibility)
+		})
+	}
+}
+
+func TestSQS_processMessagesVisibilityFailure(t *testing.T) {
+	svc := newMockSQS()
+	svc.visibilityErr = errors.New("visibility unavailable")
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "ok"),
+		mockMessage("msg2", "handle2", "retry"),
+		mockMessage("msg3", "handle3", "ok"),
+	}, func(ctx context.Context, msg Message) error {
+		if string(msg.Body) == "retry" {
+			return RetryAfterError(5 * time.Second)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"handle1", "handle3"}, svc.deletedHandles())
+
+	err = s.consumeBatch([]*sqs.Message{mockMessage("msg4", "handle4", "batch")}, func(data [][]byte) error {
+		return RetryNow
+	})
+	assert.NoError(t, err)
+	assert.Len(t, svc.visibility, 2)
+}
+
+type tracedSpan struct {
+	parent  string
+	err     error
+	deleted bool
+	ended   bool
+}
+
+// fakeTracer records a span per message, whose parent is the traceparent propagated by the message
+type fakeTracer struct {
+	lock  sync.Mutex
+	spans map[string]*tracedSpan
+}
+
+type spanKey struct{}
+
+func (f *fakeTracer) Start(ctx context.Context, msg Message) (context.Context, Span) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	span := &tracedSpan{parent: MessageCarrier(msg).Get("traceparent")}
+	f.spans[msg.MessageId] = span
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *tracedSpan) End(err error, deleted bool) {
+	s.err, s.deleted, s.ended = err, deleted, true
+}
+
+func TestSQS_processMessagesTracer(t *testing.T) {
+	tracer := &fakeTracer{spans: make(map[string]*tracedSpan)}
+	errBoom := errors.New("boom")
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Tracer: tracer, MessageAttributeNames: []string{"route"}}, newMockSQS())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"route", "traceparent", "tracestate", "baggage"}, aws.StringValueSlice(s.pullMessagesRequest().MessageAttributeNames))
+	assert.Contains(t, aws.StringValueSlice(s.pullMessagesRequest().AttributeNames), sqs.MessageSystemAttributeNameAwstraceHeader)
+
+	traced := withAttribute(mockMessage("msg1", "handle1", "msg1"), "traceparent", "00-trace-span-01")
+	traced.Attributes = map[string]*string{sqs.MessageSystemAttributeNameAwstraceHeader: aws.String("Root=1-trace")}
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		traced,
+		mockMessage("msg2", "handle2", "msg2"),
+	}, func(ctx context.Context, msg Message) error {
+		assert.NotNil(t, ctx.Value(spanKey{}))
+		if msg.MessageId == "msg2" {
+			return errBoom
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, &tracedSpan{parent: "00-trace-span-01", deleted: true, ended: true}, tracer.spans["msg1"])
+	assert.Equal(t, &tracedSpan{err: errBoom, ended: true}, tracer.spans["msg2"])
+
+	carrier := MessageCarrier(newMessage(traced))
+	assert.Equal(t, "Root=1-trace", carrier.Get(AWSTraceHeaderKey))
+	assert.ElementsMatch(t, []string{"traceparent", AWSTraceHeaderKey}, carrier.Keys())
+}
+
+func TestSQS_processMessagesBatchDelete(t *testing.T) {
+	messages := make([]*sqs.Message, 10)
+	for i := range messages {
+		id := fmt.Sprintf("msg%d", i)
+		messages[i] = mockMessage(id, "handle-"+id, id)
+	}
+
+	svc := newMockSQS()
+	svc.deleteFailures = map[string]bool{"handle-msg2": true}
+
+	var deleteFailures []string
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue: "queue",
+		Hooks: Hooks{
+			OnDeleteFailed: func(msg *sqs.Message, err error) {
+				deleteFailures = append(deleteFailures, aws.StringValue(msg.MessageId))
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), messages, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "msg5" || msg.MessageId == "msg7" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	svc.lock.Lock()
+	assert.Len(t, svc.deletes, 1)
+	svc.lock.Unlock()
+
+	assert.Equal(t, []string{
+		"handle-msg0", "handle-msg1", "handle-msg2", "handle-msg3", "handle-msg4", "handle-msg6", "handle-msg8", "handle-msg9",
+	}, svc.deletedHandles())
+
+	// sender faults are not retried, nor reported as exhausted
+	assert.Empty(t, deleteFailures)
+
+	deleted := s.deleteSqsMessages([]*sqs.Message{messages[1], messages[2]})
+	assert.Equal(t, []*sqs.Message{messages[1]}, deleted)
+}
+
+func TestSQS_processMessagesOnError(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	failures := make(map[string]error)
+	var lock sync.Mutex
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:       "queue",
+		Concurrency: 3,
+		Hooks: Hooks{
+			OnError: func(msg Message, err error) {
+				lock.Lock()
+				defer lock.Unlock()
+				_, found := failures[msg.MessageId]
+				assert.False(t, found, "hook fired twice for %s", msg.MessageId)
+				failures[msg.MessageId] = err
+			},
+		},
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+		mockMessage("msg3", "handle3", "msg3"),
+	}, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "msg2" {
+			return nil
+		}
+		return fmt.Errorf("processing %s: %w", msg.MessageId, errBoom)
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, failures, 2)
+	assert.True(t, errors.Is(failures["msg1"], errBoom))
+	assert.EqualError(t, failures["msg3"], "processing msg3: boom")
+}
+
+// fakeMetrics is a MetricsCollector counting the received, processed, failed and deleted messages
+type fakeMetrics struct {
+	NoopMetrics
+
+	lock      sync.Mutex
+	received  int
+	processed int
+	failed    int
+	deleted   int
+	durations []time.Duration
+	empties   int
+	extended  int
+	// backingOff are the SetBackingOff calls, in order
+	backingOff []bool
+}
+
+func (f *fakeMetrics) SetBackingOff(backingOff bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.backingOff = append(f.backingOff, backingOff)
+}
+
+func (f *fakeMetrics) IncReceived(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.received += n
+}
+
+func (f *fakeMetrics) IncProcessed() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.processed++
+}
+
+func (f *fakeMetrics) IncFailed() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failed++
+}
+
+func (f *fakeMetrics) IncDeleted(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.deleted += n
+}
+
+func (f *fakeMetrics) ObserveHandlerDuration(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.durations = append(f.durations, d)
+}
+
+func (f *fakeMetrics) IncEmptyReceive() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.empties++
+}
+
+func (f *fakeMetrics) IncVisibilityExtended(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.extended += n
+}
+
+func TestSQS_StartMetrics(t *testing.T) {
+	metrics := &fakeMetrics{}
+
+	svc := newMockSQS([]*sqs.Message{
+		mockMessage("msg1", "handle1", "ok"),
+		mockMessage("msg2", "handle2", "fail"),
+		mockMessage("msg3", "handle3", "ok"),
+	}, []*sqs.Message{
+		mockMessage("msg4", "handle4", "slow"),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Metrics: metrics, HeartbeatInterval: 20 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	err = s.Start(ctx, func(data []byte) error {
+		switch string(data) {
+		case "fail":
+			return errors.New("boom")
+		case "slow":
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	assert.Equal(t, 4, metrics.received)
+	assert.Equal(t, 3, metrics.processed)
+	assert.Equal(t, 1, metrics.failed)
+	assert.Equal(t, 3, metrics.deleted)
+	assert.Len(t, metrics.durations, 4)
+	assert.GreaterOrEqual(t, metrics.empties, 1)
+	assert.GreaterOrEqual(t, metrics.extended, 2)
+}
+
+func TestSQS_StartFIFO(t *testing.T) {
+	fifoMessage := func(id, group string) *sqs.Message {
+		msg := mockMessage(id, "handle-"+id, id)
+		msg.Attributes = map[string]*string{sqs.MessageSystemAttributeNameMessageGroupId: aws.String(group)}
+		return msg
+	}
+
+	svc := newMockSQS([]*sqs.Message{
+		fifoMessage("a1", "a"), fifoMessage("b1", "b"), fifoMessage("a2", "a"),
+		fifoMessage("a3", "a"), fifoMessage("b2", "b"), fifoMessage("b3", "b"),
+	})
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "https://sqs.eu-west-1.amazonaws.com/123/queue.fifo", Concurrency: 4}, svc)
+	assert.NoError(t, err)
+	assert.True(t, s.config.FIFO)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var lock sync.Mutex
+	observed := make(map[string][]string)
+	running := make(map[string]int)
+	peak := 0
+
+	err = s.Start(ctx, func(data []byte) error {
+		id := string(data)
+		group := id[:1]
+
+		lock.Lock()
+		running[group]++
+		assert.Equal(t, 1, running[group], "group %s processed concurrently", group)
+		if n := len(running); n > peak {
+			peak = n
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		observed[group] = append(observed[group], id)
+		if running[group]--; running[group] == 0 {
+			delete(running, group)
+		}
+		lock.Unlock()
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"a": {"a1", "a2", "a3"}, "b": {"b1", "b2", "b3"}}, observed)
+	assert.Equal(t, 2, peak)
+}
+
+func TestSQS_processMessagesFIFOGroupFailure(t *testing.T) {
+	fifoMessage := func(id, group string) *sqs.Message {
+		msg := mockMessage(id, "handle-"+id, id)
+		msg.Attributes = map[string]*string{sqs.MessageSystemAttributeNameMessageGroupId: aws.String(group)}
+		return msg
+	}
+
+	failures := make(map[string]error)
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue: "queue.fifo",
+		Hooks: Hooks{
+			OnError: func(msg Message, err error) {
+				failures[msg.MessageId] = err
+			},
+		},
+	}, svc)
+	assert.NoError(t, err)
+
+	var lock sync.Mutex
+	var processed []string
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		fifoMessage("a1", "a"), fifoMessage("a2", "a"), fifoMessage("b1", "b"), fifoMessage("a3", "a"),
+	}, func(ctx context.Context, msg Message) error {
+		lock.Lock()
+		processed = append(processed, msg.MessageId)
+		lock.Unlock()
+
+		if msg.MessageId == "a2" {
+			return errors.New("a2 failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"a1", "a2", "b1"}, processed)
+	assert.EqualError(t, failures["a2"], "a2 failed")
+	assert.True(t, errors.Is(failures["a3"], ErrGroupFailed))
+	assert.Len(t, failures, 2)
+	assert.ElementsMatch(t, []string{"handle-a1", "handle-b1"}, svc.deletedHandles())
+}
+
+func TestNewSQSConsumerWithOptions(t *testing.T) {
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumerWithOptions(svc,
+		WithQueue("queue"),
+		WithConcurrency(4),
+		WithMaxNumberOfMessages(5),
+		WithWaitTimeSeconds(20),
+		WithConf(func(conf *SQSConf) {
+			conf.DeadLetterQueue = "dlq"
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "queue", s.config.Queue)
+	assert.Equal(t, 4, s.config.Concurrency)
+	assert.Equal(t, int64(5), s.config.MaxNumberOfMessages)
+	assert.Equal(t, int64(20), s.config.WaitTimeSeconds)
+	assert.Equal(t, int64(DefaultVisibilityTimeout), s.config.VisibilityTimeout)
+	assert.Equal(t, "dlq", s.config.DeadLetterQueue)
+
+	_, err = NewSQSConsumerWithOptions(svc, WithMaxNumberOfMessages(5))
+	assert.EqualError(t, err, "queue not set")
+
+	_, err = NewSQSConsumerWithOptions(svc, WithQueue("queue"), WithMaxNumberOfMessages(20))
+	assert.EqualError(t, err, "max number of messages must be between 1 and 10, got 20")
+
+	_, err = NewSQSConsumerWithOptions(svc, WithQueue("queue"), WithWaitTimeSeconds(30))
+	assert.EqualError(t, err, "wait time seconds must be between 0 and 20, got 30")
+}
+
+type recordingLogger struct {
+	NoopLogger
+	lock     sync.Mutex
+	errors   []string
+	warnings []string
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+// fieldLogger records the fields of the logged events
+type fieldLogger struct {
+	NoopLogger
+	lock   *sync.Mutex
+	events *[]Fields
+	fields Fields
+}
+
+func (l fieldLogger) WithFields(fields Fields) Logger {
+	return fieldLogger{lock: l.lock, events: l.events, fields: fields}
+}
+
+func (l fieldLogger) Errorf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*l.events = append(*l.events, l.fields)
+}
+
+func TestSQS_processMessagesFieldLogger(t *testing.T) {
+	var events []Fields
+	logger := fieldLogger{lock: &sync.Mutex{}, events: &events}
+
+	svc := newMockSQS()
+	svc.deleteFailures = map[string]bool{"handle2": true}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: logger}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+	}, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "msg1" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, Fields{"event": EventHandlerError, "queue": "queue", "message_id": "msg1", "receive_count": 0, "error": "boom"}, events[0])
+	assert.Equal(t, EventDeleteError, events[1]["event"])
+	assert.Equal(t, "msg2", events[1]["message_id"])
+}
+
+func TestSQS_processMessagesLogMessageOnFailure(t *testing.T) {
+	logger := &recordingLogger{}
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		Logger:              logger,
+		LogMessageOnFailure: true,
+		MaxLoggedBodyBytes:  20,
+		Redactor:            MaskFields("email"),
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	msg := withAttribute(mockMessage("msg1", "handle1", `{"email":"a@b.c","id":1}`), "email", "x@y.z")
+
+	failing := func(ctx context.Context, msg Message) error {
+		return errors.New("boom")
+	}
+
+	assert.NoError(t, s.processMessages(context.Background(), []*sqs.Message{msg}, failing))
+
+	assert.Len(t, logger.errors, 2)
+	logged := logger.errors[1]
+	assert.Contains(t, logged, "failed message msg1 on queue queue: boom")
+	assert.Contains(t, logged, RedactedValue)
+	assert.Contains(t, logged, "...(truncated)")
+	assert.NotContains(t, logged, "a@b.c")
+	assert.NotContains(t, logged, "x@y.z")
+
+	// structured loggers get the fields of the handler error
+	var events []Fields
+	s.config.Logger = fieldLogger{lock: &sync.Mutex{}, events: &events}
+
+	assert.NoError(t, s.processMessages(context.Background(), []*sqs.Message{msg}, failing))
+
+	assert.Len(t, events, 2)
+	for _, fields := range events {
+		assert.Equal(t, EventHandlerError, fields["event"])
+		assert.Equal(t, "msg1", fields["message_id"])
+	}
+}
+
+func TestSQS_processMessagesLogMessageOnFailureDecoded(t *testing.T) {
+	logger := &recordingLogger{}
+
+	s, err := NewSQSConsumer(&SQSConf{
+		Queue:               "queue",
+		Logger:              logger,
+		LogMessageOnFailure: true,
+		MaxLoggedBodyBytes:  5,
+		Decompress:          true,
+	}, newMockSQS())
+	assert.NoError(t, err)
+
+	compressed, err := GzipCodec{}.Compress([]byte("ééé"))
+	assert.NoError(t, err)
+
+	msg := withAttribute(mockMessage("msg1", "handle1", base64.StdEncoding.EncodeToString(compressed)), ContentEncodingAttribute, "gzip")
+
+	err = s.processMessages(context.Background(), s.acquire([]*sqs.Message{msg}), func(ctx context.Context, msg Message) error {
+		return errors.New("boom")
+	})
+	assert.NoError(t, err)
+
+	// the decompressed body is logged, cut on a rune boundary
+	assert.Len(t, logger.errors, 2)
+	assert.Contains(t, logger.errors[1], `body="éé...(truncated)"`)
+	assert.True(t, utf8.ValidString(logger.errors[1]))
+}
+
+func TestSQS_processMessagesLifecycleHooks(t *testing.T) {
+	var lock sync.Mutex
+	events := make([]string, 0)
+	record := func(event string, msg Message, elapsed time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		assert.True(t, elapsed >= 0)
+		events = append(events, event+" "+msg.MessageId)
+	}
+
+	svc := newMockSQS()
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, Hooks: Hooks{
+		OnReceive: func(msg Message) {
+			record("receive", msg, 0)
+		},
+		OnSuccess: func(msg Message, elapsed time.Duration) {
+			record("success", msg, elapsed)
+		},
+		OnFailure: func(msg Message, err error, elapsed time.Duration) {
+			assert.EqualError(t, err, "boom")
+			record("failure", msg, elapsed)
+		},
+		OnDelete: func(msg Message, elapsed time.Duration) {
+			assert.True(t, elapsed > 0)
+			record("delete", msg, elapsed)
+		},
+	}}, svc)
+	assert.NoError(t, err)
+
+	messages := s.acquire([]*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+	})
+
+	err = s.processMessages(context.Background(), messages, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "msg1" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"receive msg1", "receive msg2", "failure msg1", "success msg2", "delete msg2"}, events)
+}
+
+func TestSQS_deleteSqsMessagesBuffered(t *testing.T) {
+	svc := newMockSQS()
+	svc.deleteFailures = map[string]bool{"handle11": true}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, DeleteFlushInterval: 50 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	deleted := make([]int, 12)
+	for i := range deleted {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := strconv.Itoa(i)
+			deleted[i] = len(s.deleteSqsMessages([]*sqs.Message{mockMessage("msg"+id, "handle"+id, id)}))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0}, deleted)
+	assert.Len(t, svc.deletes, 2)
+	assert.Len(t, svc.deletes[0].Entries, 10)
+	assert.Len(t, svc.deletes[1].Entries, 2)
+}
+
+func TestSQS_Healthy(t *testing.T) {
+	svc := newMockSQS()
+	boom := errors.New("boom")
+	svc.receiveErrors = []error{boom, boom, boom}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, HealthReceiveTimeout: 50 * time.Millisecond}, svc)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrNotStarted, s.Healthy())
+
+	s.markStarted()
+	assert.NoError(t, s.Healthy())
+
+	for i := 0; i < 3; i++ {
+		_, err = s.receive(context.Background(), s.pullMessagesRequest())
+		assert.Equal(t, boom, err)
+	}
+
+	assert.EqualError(t, s.Healthy(), "3 consecutive receive errors: boom")
+	assert.Equal(t, 3, s.Stats().ConsecutiveReceiveErrors)
+
+	_, err = s.receive(context.Background(), s.pullMessagesRequest())
+	assert.NoError(t, err)
+	assert.NoError(t, s.Healthy())
+	assert.Equal(t, 0, s.Stats().ConsecutiveReceiveErrors)
+	assert.False(t, s.Stats().LastReceive.IsZero())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualError(t, s.Healthy(), "no successful receive since 0s")
+
+	s.Pause()
+	assert.NoError(t, s.Healthy())
+
+	assert.NoError(t, s.Close())
+	assert.Equal(t, ErrClosed, s.Healthy())
+}
+
+func TestSQS_processMessagesHandlerTimeout(t *testing.T) {
+	svc := newMockSQS()
+
+	var lock sync.Mutex
+	failures := make(map[string]error)
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: NoopLogger{}, HandlerTimeout: 50 * time.Millisecond, Hooks: Hooks{
+		OnError: func(msg Message, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			failures[msg.MessageId] = err
+		},
+	}}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "fast"),
+		mockMessage("msg2", "handle2", "cancelled"),
+		mockMessage("msg3", "handle3", "ignoring"),
+	}, func(ctx context.Context, msg Message) error {
+		switch string(msg.Body) {
+		case "cancelled":
+			<-ctx.Done()
+			return ctx.Err()
+		case "ignoring":
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, failures, 2)
+	assert.True(t, errors.Is(failures["msg2"], ErrHandlerTimeout))
+	assert.EqualError(t, failures["msg3"], "handler timed out after 50ms")
+	assert.Equal(t, []string{"handle1"}, svc.deletedHandles())
+
+	s, err = NewSQSConsumer(&SQSConf{Queue: "queue", VisibilityTimeout: 30, HandlerTimeout: VisibilityHandlerTimeout}, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, (30 * time.Second).Milliseconds(), s.handlerTimeout().Milliseconds())
+
+	_, err = NewSQSConsumer(&SQSConf{Queue: "queue", HandlerTimeout: -2}, svc)
+	assert.EqualError(t, err, "handler timeout must be positive, got -2ns")
+}
+
+func TestSQS_processMessagesLogger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	svc := newMockSQS()
+	svc.deleteFailures = map[string]bool{"handle2": true}
+
+	s, err := NewSQSConsumer(&SQSConf{Queue: "queue", Logger: logger}, svc)
+	assert.NoError(t, err)
+
+	err = s.processMessages(context.Background(), []*sqs.Message{
+		mockMessage("msg1", "handle1", "msg1"),
+		mockMessage("msg2", "handle2", "msg2"),
+	}, func(ctx context.Context, msg Message) error {
+		if msg.MessageId == "msg1" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"message msg1 on queue queue: boom",
+		"message msg2 on queue queue: error deleting message: ReceiptHandleIsInvalid ",
+	}, logger.errors)
+}
@@ -0,0 +1,247 @@
+// Package sqsv2 runs the consumer on the SQS client of aws-sdk-go-v2, translating the requests issued by the
+// consumer to the v2 API. The context of every request is propagated to the v2 client.
+package sqsv2
+
+import (
+	"context"
+	"errors"
+	"github.com/The-Data-Appeal-Company/sqs-consumer/consumer"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	sqsv1 "github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/smithy-go"
+)
+
+// API is the subset of the v2 *sqs.Client used by the consumer.
+type API interface {
+	ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, in *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatch(ctx context.Context, in *sqs.ChangeMessageVisibilityBatchInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+	SendMessage(ctx context.Context, in *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	SendMessageBatch(ctx context.Context, in *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+	GetQueueAttributes(ctx context.Context, in *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+}
+
+// NewSQSConsumer returns a consumer of the queue issuing its requests with client. SQSConf.RequestOptions
+// don't apply to the v2 client, whose middlewares can be configured on the client itself.
+func NewSQSConsumer(conf *consumer.SQSConf, client API) (*consumer.SQS, error) {
+	return consumer.NewSQSConsumer(conf, NewAdapter(client))
+}
+
+// Adapter exposes a v2 client as the consumer.SQSClient of the consumer.
+type Adapter struct {
+	client API
+}
+
+// NewAdapter returns an Adapter of client.
+func NewAdapter(client API) *Adapter {
+	return &Adapter{client: client}
+}
+
+func (a *Adapter) ReceiveMessageWithContext(ctx aws.Context, in *sqsv1.ReceiveMessageInput, _ ...request.Option) (*sqsv1.ReceiveMessageOutput, error) {
+	attributeNames := make([]types.QueueAttributeName, 0, len(in.AttributeNames))
+	for _, name := range in.AttributeNames {
+		attributeNames = append(attributeNames, types.QueueAttributeName(aws.StringValue(name)))
+	}
+
+	out, err := a.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:                in.QueueUrl,
+		AttributeNames:          attributeNames,
+		MessageAttributeNames:   aws.StringValueSlice(in.MessageAttributeNames),
+		MaxNumberOfMessages:     int32(aws.Int64Value(in.MaxNumberOfMessages)),
+		VisibilityTimeout:       int32(aws.Int64Value(in.VisibilityTimeout)),
+		WaitTimeSeconds:         int32(aws.Int64Value(in.WaitTimeSeconds)),
+		ReceiveRequestAttemptId: in.ReceiveRequestAttemptId,
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	messages := make([]*sqsv1.Message, 0, len(out.Messages))
+	for _, msg := range out.Messages {
+		messages = append(messages, &sqsv1.Message{
+			Attributes:             aws.StringMap(msg.Attributes),
+			Body:                   msg.Body,
+			MD5OfBody:              msg.MD5OfBody,
+			MD5OfMessageAttributes: msg.MD5OfMessageAttributes,
+			MessageAttributes:      toV1Attributes(msg.MessageAttributes),
+			MessageId:              msg.MessageId,
+			ReceiptHandle:          msg.ReceiptHandle,
+		})
+	}
+
+	return &sqsv1.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (a *Adapter) DeleteMessageBatchWithContext(ctx aws.Context, in *sqsv1.DeleteMessageBatchInput, _ ...request.Option) (*sqsv1.DeleteMessageBatchOutput, error) {
+	entries := make([]types.DeleteMessageBatchRequestEntry, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		entries = append(entries, types.DeleteMessageBatchRequestEntry{Id: entry.Id, ReceiptHandle: entry.ReceiptHandle})
+	}
+
+	out, err := a.client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{QueueUrl: in.QueueUrl, Entries: entries})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	successful := make([]*sqsv1.DeleteMessageBatchResultEntry, 0, len(out.Successful))
+	for _, entry := range out.Successful {
+		successful = append(successful, &sqsv1.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+
+	return &sqsv1.DeleteMessageBatchOutput{Successful: successful, Failed: toV1Failures(out.Failed)}, nil
+}
+
+func (a *Adapter) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, in *sqsv1.ChangeMessageVisibilityBatchInput, _ ...request.Option) (*sqsv1.ChangeMessageVisibilityBatchOutput, error) {
+	entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		entries = append(entries, types.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                entry.Id,
+			ReceiptHandle:     entry.ReceiptHandle,
+			VisibilityTimeout: int32(aws.Int64Value(entry.VisibilityTimeout)),
+		})
+	}
+
+	out, err := a.client.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{QueueUrl: in.QueueUrl, Entries: entries})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	successful := make([]*sqsv1.ChangeMessageVisibilityBatchResultEntry, 0, len(out.Successful))
+	for _, entry := range out.Successful {
+		successful = append(successful, &sqsv1.ChangeMessageVisibilityBatchResultEntry{Id: entry.Id})
+	}
+
+	return &sqsv1.ChangeMessageVisibilityBatchOutput{Successful: successful, Failed: toV1Failures(out.Failed)}, nil
+}
+
+func (a *Adapter) SendMessageWithContext(ctx aws.Context, in *sqsv1.SendMessageInput, _ ...request.Option) (*sqsv1.SendMessageOutput, error) {
+	out, err := a.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:               in.QueueUrl,
+		MessageBody:            in.MessageBody,
+		DelaySeconds:           int32(aws.Int64Value(in.DelaySeconds)),
+		MessageAttributes:      toV2Attributes(in.MessageAttributes),
+		MessageDeduplicationId: in.MessageDeduplicationId,
+		MessageGroupId:         in.MessageGroupId,
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &sqsv1.SendMessageOutput{
+		MD5OfMessageAttributes: out.MD5OfMessageAttributes,
+		MD5OfMessageBody:       out.MD5OfMessageBody,
+		MessageId:              out.MessageId,
+		SequenceNumber:         out.SequenceNumber,
+	}, nil
+}
+
+func (a *Adapter) SendMessageBatchWithContext(ctx aws.Context, in *sqsv1.SendMessageBatchInput, _ ...request.Option) (*sqsv1.SendMessageBatchOutput, error) {
+	entries := make([]types.SendMessageBatchRequestEntry, 0, len(in.Entries))
+	for _, entry := range in.Entries {
+		entries = append(entries, types.SendMessageBatchRequestEntry{
+			Id:                     entry.Id,
+			MessageBody:            entry.MessageBody,
+			DelaySeconds:           int32(aws.Int64Value(entry.DelaySeconds)),
+			MessageAttributes:      toV2Attributes(entry.MessageAttributes),
+			MessageDeduplicationId: entry.MessageDeduplicationId,
+			MessageGroupId:         entry.MessageGroupId,
+		})
+	}
+
+	out, err := a.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{QueueUrl: in.QueueUrl, Entries: entries})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	successful := make([]*sqsv1.SendMessageBatchResultEntry, 0, len(out.Successful))
+	for _, entry := range out.Successful {
+		successful = append(successful, &sqsv1.SendMessageBatchResultEntry{
+			Id:               entry.Id,
+			MessageId:        entry.MessageId,
+			MD5OfMessageBody: entry.MD5OfMessageBody,
+			SequenceNumber:   entry.SequenceNumber,
+		})
+	}
+
+	return &sqsv1.SendMessageBatchOutput{Successful: successful, Failed: toV1Failures(out.Failed)}, nil
+}
+
+func (a *Adapter) GetQueueAttributesWithContext(ctx aws.Context, in *sqsv1.GetQueueAttributesInput, _ ...request.Option) (*sqsv1.GetQueueAttributesOutput, error) {
+	attributeNames := make([]types.QueueAttributeName, 0, len(in.AttributeNames))
+	for _, name := range in.AttributeNames {
+		attributeNames = append(attributeNames, types.QueueAttributeName(aws.StringValue(name)))
+	}
+
+	out, err := a.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: in.QueueUrl, AttributeNames: attributeNames})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &sqsv1.GetQueueAttributesOutput{Attributes: aws.StringMap(out.Attributes)}, nil
+}
+
+// translateError turns the API errors of the v2 client into awserr.Error, so that the consumer can tell
+// the fatal ones apart (e.g. in Run).
+func translateError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return awserr.New(apiErr.ErrorCode(), apiErr.ErrorMessage(), err)
+	}
+	return err
+}
+
+func toV1Failures(failed []types.BatchResultErrorEntry) []*sqsv1.BatchResultErrorEntry {
+	entries := make([]*sqsv1.BatchResultErrorEntry, 0, len(failed))
+	for _, entry := range failed {
+		entries = append(entries, &sqsv1.BatchResultErrorEntry{
+			Id:          entry.Id,
+			Code:        entry.Code,
+			Message:     entry.Message,
+			SenderFault: aws.Bool(entry.SenderFault),
+		})
+	}
+	return entries
+}
+
+func toV1Attributes(attributes map[string]types.MessageAttributeValue) map[string]*sqsv1.MessageAttributeValue {
+	if attributes == nil {
+		return nil
+	}
+
+	converted := make(map[string]*sqsv1.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		converted[name] = &sqsv1.MessageAttributeValue{
+			DataType:         value.DataType,
+			StringValue:      value.StringValue,
+			BinaryValue:      value.BinaryValue,
+			StringListValues: aws.StringSlice(value.StringListValues),
+			BinaryListValues: value.BinaryListValues,
+		}
+	}
+	return converted
+}
+
+func toV2Attributes(attributes map[string]*sqsv1.MessageAttributeValue) map[string]types.MessageAttributeValue {
+	if attributes == nil {
+		return nil
+	}
+
+	converted := make(map[string]types.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		if value == nil {
+			continue
+		}
+		converted[name] = types.MessageAttributeValue{
+			DataType:         value.DataType,
+			StringValue:      value.StringValue,
+			BinaryValue:      value.BinaryValue,
+			StringListValues: aws.StringValueSlice(value.StringListValues),
+			BinaryListValues: value.BinaryListValues,
+		}
+	}
+	return converted
+}
@@ -0,0 +1,115 @@
+package sqsv2
+
+import (
+	"context"
+	"errors"
+	"github.com/The-Data-Appeal-Company/sqs-consumer/consumer"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	sqsv1 "github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClient is an in memory v2 client returning the queued messages once
+type fakeClient struct {
+	lock       sync.Mutex
+	messages   []types.Message
+	receiveErr error
+	receives   []*sqs.ReceiveMessageInput
+	deleted    []string
+}
+
+func (f *fakeClient) ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.receives = append(f.receives, in)
+
+	if f.receiveErr != nil {
+		return nil, f.receiveErr
+	}
+
+	messages := f.messages
+	f.messages = nil
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (f *fakeClient) DeleteMessageBatch(ctx context.Context, in *sqs.DeleteMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		f.deleted = append(f.deleted, aws.StringValue(entry.ReceiptHandle))
+		out.Successful = append(out.Successful, types.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+func (f *fakeClient) ChangeMessageVisibilityBatch(ctx context.Context, in *sqs.ChangeMessageVisibilityBatchInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func (f *fakeClient) SendMessage(ctx context.Context, in *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (f *fakeClient) SendMessageBatch(ctx context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	return &sqs.SendMessageBatchOutput{}, nil
+}
+
+func (f *fakeClient) GetQueueAttributes(ctx context.Context, in *sqs.GetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"ApproximateNumberOfMessages": "3"}}, nil
+}
+
+func TestNewSQSConsumer(t *testing.T) {
+	client := &fakeClient{messages: []types.Message{{
+		MessageId:     aws.String("msg1"),
+		ReceiptHandle: aws.String("handle1"),
+		Body:          aws.String("body1"),
+		Attributes:    map[string]string{"ApproximateReceiveCount": "2"},
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"route": {DataType: aws.String("String"), StringValue: aws.String("billing")},
+		},
+	}}}
+
+	s, err := NewSQSConsumer(&consumer.SQSConf{Queue: "queue", MaxNumberOfMessages: 5}, client)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	var got consumer.Message
+	err = s.StartWithMeta(ctx, func(ctx context.Context, msg consumer.Message) error {
+		got = msg
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "body1", string(got.Body))
+	assert.Equal(t, 2, got.ReceiveCount)
+	assert.Equal(t, map[string]string{"route": "billing"}, got.Attributes)
+	assert.Equal(t, []string{"handle1"}, client.deleted)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	assert.Equal(t, "queue", aws.StringValue(client.receives[0].QueueUrl))
+	assert.Equal(t, int32(5), client.receives[0].MaxNumberOfMessages)
+	assert.Contains(t, client.receives[0].AttributeNames, types.QueueAttributeName("ApproximateReceiveCount"))
+}
+
+func TestAdapterTranslatesErrors(t *testing.T) {
+	client := &fakeClient{receiveErr: &smithy.GenericAPIError{Code: sqsv1.ErrCodeQueueDoesNotExist, Message: "no queue"}}
+
+	_, err := NewAdapter(client).ReceiveMessageWithContext(context.Background(), &sqsv1.ReceiveMessageInput{QueueUrl: aws.String("queue")})
+
+	var awsErr awserr.Error
+	assert.True(t, errors.As(err, &awsErr))
+	assert.Equal(t, sqsv1.ErrCodeQueueDoesNotExist, awsErr.Code())
+}
@@ -0,0 +1,175 @@
+package consumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThroughputWindow is the interval the throughput is sampled on before being smoothed
+const ThroughputWindow = 1 * time.Second
+
+// Stats is a snapshot of the consumer runtime statistics.
+type Stats struct {
+	// ReceiveBatchSize is the distribution of the number of messages returned by each ReceiveMessage
+	ReceiveBatchSize BatchSizeStats `json:"receive_batch_size"`
+	// BackingOff reports whether the consumer is paused because of errors, as opposed to being idle
+	BackingOff bool `json:"backing_off"`
+	// Paused reports whether the consumer has been paused with Pause
+	Paused bool `json:"paused"`
+	// LatencyEMA is the exponential moving average, in seconds, of the time taken by the consumer function
+	LatencyEMA float64 `json:"latency_ema_seconds"`
+	// ThroughputEMA is the exponential moving average of the messages processed per second
+	ThroughputEMA float64 `json:"throughput_ema"`
+	// BusyWorkers is the number of workers processing messages
+	BusyWorkers int `json:"busy_workers"`
+	// InFlight is the number of messages received and not settled yet
+	InFlight int `json:"in_flight"`
+	// LastReceive is the time of the last successful receive, zero when none succeeded yet
+	LastReceive time.Time `json:"last_receive"`
+	// ConsecutiveReceiveErrors is the number of receives failed since the last successful one
+	ConsecutiveReceiveErrors int `json:"consecutive_receive_errors"`
+	// MaxNumberOfMessages is the number of messages currently requested on each receive, see AdaptiveMaxNumberOfMessages
+	MaxNumberOfMessages int64 `json:"max_number_of_messages"`
+}
+
+// BatchSizeStats summarizes a distribution of batch sizes.
+type BatchSizeStats struct {
+	Count int64   `json:"count"`
+	Min   int     `json:"min"`
+	Max   int     `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+type statsCollector struct {
+	lock             sync.Mutex
+	receiveBatchSize BatchSizeStats
+	receiveBatchSum  int64
+
+	latencyEMA    float64
+	latencySeen   bool
+	throughputEMA float64
+	// windowStart and windowCount track the messages processed in the current ThroughputWindow
+	windowStart time.Time
+	windowCount int
+
+	lastReceive      time.Time
+	receiveErrors    int
+	lastReceiveError error
+}
+
+// observeReceive records the outcome of a receive, err being nil when it succeeded.
+func (c *statsCollector) observeReceive(err error, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		c.receiveErrors++
+		c.lastReceiveError = err
+		return
+	}
+
+	c.lastReceive, c.receiveErrors, c.lastReceiveError = now, 0, nil
+}
+
+func (c *statsCollector) observeReceiveBatchSize(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := &c.receiveBatchSize
+	if b.Count == 0 || n < b.Min {
+		b.Min = n
+	}
+	if n > b.Max {
+		b.Max = n
+	}
+	b.Count++
+	c.receiveBatchSum += int64(n)
+	b.Avg = float64(c.receiveBatchSum) / float64(b.Count)
+}
+
+// observeLatency smooths the processing latency with alpha, returning the updated average.
+func (c *statsCollector) observeLatency(alpha float64, latency time.Duration) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.latencySeen {
+		c.latencyEMA, c.latencySeen = latency.Seconds(), true
+		return c.latencyEMA
+	}
+
+	c.latencyEMA = alpha*latency.Seconds() + (1-alpha)*c.latencyEMA
+	return c.latencyEMA
+}
+
+// observeProcessed counts n processed messages and, once per ThroughputWindow, smooths the throughput
+// of the elapsed window with alpha. It returns the updated average and whether it changed.
+func (c *statsCollector) observeProcessed(alpha float64, n int, now time.Time) (float64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	rolled := c.roll(alpha, now)
+	c.windowCount += n
+
+	return c.throughputEMA, rolled
+}
+
+// roll closes the current throughput window if it lasted at least ThroughputWindow, including the idle
+// time since its start so that the average decays when no messages are processed. c.lock must be held.
+func (c *statsCollector) roll(alpha float64, now time.Time) bool {
+	if c.windowStart.IsZero() {
+		c.windowStart = now
+		return false
+	}
+
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < ThroughputWindow {
+		return false
+	}
+
+	c.throughputEMA = alpha*float64(c.windowCount)/elapsed.Seconds() + (1-alpha)*c.throughputEMA
+	c.windowStart, c.windowCount = now, 0
+
+	return true
+}
+
+// Stats returns a snapshot of the consumer runtime statistics.
+func (s *SQS) Stats() Stats {
+	s.stats.lock.Lock()
+	defer s.stats.lock.Unlock()
+
+	s.stats.roll(s.config.EMAAlpha, time.Now())
+
+	return Stats{
+		ReceiveBatchSize:         s.stats.receiveBatchSize,
+		BackingOff:               atomic.LoadInt32(&s.backingOff) > 0,
+		Paused:                   s.Paused(),
+		LatencyEMA:               s.stats.latencyEMA,
+		ThroughputEMA:            s.stats.throughputEMA,
+		BusyWorkers:              int(atomic.LoadInt32(&s.busyWorkers)),
+		InFlight:                 s.inFlightCount(),
+		LastReceive:              s.stats.lastReceive,
+		ConsecutiveReceiveErrors: s.stats.receiveErrors,
+		MaxNumberOfMessages:      s.MaxNumberOfMessages(),
+	}
+}
+
+// DebugHandler returns an http.Handler serving the consumer Stats as JSON.
+func (s *SQS) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Stats())
+	})
+}
+
+// observeProcessing records the latency of a consumer function invocation that processed n messages.
+func (s *SQS) observeProcessing(latency time.Duration, n int) {
+	s.config.Metrics.ObserveHandlerDuration(latency)
+	s.config.Metrics.SetLatencyEMA(s.stats.observeLatency(s.config.EMAAlpha, latency))
+
+	if throughput, changed := s.stats.observeProcessed(s.config.EMAAlpha, n, time.Now()); changed {
+		s.config.Metrics.SetThroughputEMA(throughput)
+	}
+}
@@ -0,0 +1,46 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// VisibilityHandlerTimeout, as HandlerTimeout, derives the timeout of the consumer function from the VisibilityTimeout.
+const VisibilityHandlerTimeout time.Duration = -1
+
+// ErrHandlerTimeout is wrapped by the error of the messages whose consumer function exceeded HandlerTimeout.
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// handlerTimeout returns the timeout of the consumer function, 0 when not set.
+func (s *SQS) handlerTimeout() time.Duration {
+	if s.config.HandlerTimeout == VisibilityHandlerTimeout {
+		return time.Duration(s.config.VisibilityTimeout) * time.Second
+	}
+
+	return s.config.HandlerTimeout
+}
+
+// withHandlerTimeout invokes fn with a context cancelled after HandlerTimeout. When the timeout is exceeded the
+// message fails with ErrHandlerTimeout, whatever fn returned, so that it goes through the retry and dead letter policy.
+func (s *SQS) withHandlerTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	timeout := s.handlerTimeout()
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(timeoutCtx)
+
+	if errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s", ErrHandlerTimeout, timeout)
+		}
+		return fmt.Errorf("%w after %s: %s", ErrHandlerTimeout, timeout, err)
+	}
+
+	return err
+}
@@ -0,0 +1,108 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"sync"
+)
+
+// AWSTraceHeaderKey is the key under which MessageCarrier exposes the AWSTraceHeader system attribute,
+// the header of the X-Ray propagation format.
+const AWSTraceHeaderKey = "X-Amzn-Trace-Id"
+
+// TraceAttributes are the message attributes carrying the W3C trace context, always received when a Tracer is set.
+var TraceAttributes = []string{"traceparent", "tracestate", "baggage"}
+
+// Tracer starts a span around every invocation of the consumer function, e.g. backed by OpenTelemetry:
+// the trace context propagated by the producer can be extracted from MessageCarrier(msg).
+type Tracer interface {
+	Start(ctx context.Context, msg Message) (context.Context, Span)
+}
+
+// Span is the span of the processing of a message.
+type Span interface {
+	// End ends the span once the outcome of the message is known: err is the error returned by
+	// the consumer function and deleted tells whether the message has been deleted from the queue.
+	End(err error, deleted bool)
+}
+
+// MessageCarrier exposes the trace context of a message, it satisfies the TextMapCarrier of OpenTelemetry:
+// keys are the message attributes plus AWSTraceHeaderKey for the AWSTraceHeader system attribute.
+type MessageCarrier Message
+
+func (c MessageCarrier) Get(key string) string {
+	if key == AWSTraceHeaderKey {
+		return c.SystemAttributes[sqs.MessageSystemAttributeNameAwstraceHeader]
+	}
+	return c.Attributes[key]
+}
+
+// Set is a no-op, received messages can't be modified.
+func (c MessageCarrier) Set(string, string) {}
+
+func (c MessageCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.Attributes)+1)
+	for key := range c.Attributes {
+		keys = append(keys, key)
+	}
+	if _, found := c.SystemAttributes[sqs.MessageSystemAttributeNameAwstraceHeader]; found {
+		keys = append(keys, AWSTraceHeaderKey)
+	}
+	return keys
+}
+
+type tracedMessage struct {
+	span Span
+	err  error
+}
+
+// spanTrail collects the spans of a batch of messages until their outcome is known, it is nil when tracing is disabled.
+type spanTrail struct {
+	tracer Tracer
+	lock   sync.Mutex
+	spans  map[*sqs.Message]tracedMessage
+}
+
+func (s *SQS) newSpanTrail() *spanTrail {
+	if s.config.Tracer == nil {
+		return nil
+	}
+	return &spanTrail{tracer: s.config.Tracer, spans: make(map[*sqs.Message]tracedMessage)}
+}
+
+// trace wraps consumeFn starting a span around each invocation.
+func (t *spanTrail) trace(consumeFn ConsumerFnWithMeta) ConsumerFnWithMeta {
+	if t == nil {
+		return consumeFn
+	}
+
+	return func(ctx context.Context, msg Message) error {
+		ctx, span := t.tracer.Start(ctx, msg)
+		err := consumeFn(ctx, msg)
+
+		t.lock.Lock()
+		t.spans[msg.Raw] = tracedMessage{span: span, err: err}
+		t.lock.Unlock()
+
+		return err
+	}
+}
+
+// end ends the spans, marking as deleted the messages in deleted.
+func (t *spanTrail) end(deleted []*sqs.Message) {
+	if t == nil {
+		return
+	}
+
+	isDeleted := make(map[*sqs.Message]bool, len(deleted))
+	for _, msg := range deleted {
+		isDeleted[msg] = true
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for msg, traced := range t.spans {
+		traced.span.End(traced.err, isDeleted[msg])
+	}
+}
@@ -0,0 +1,98 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"time"
+)
+
+// MaxVisibilityTimeout is the maximum visibility timeout allowed by SQS, 12 hours
+const MaxVisibilityTimeout = 12 * time.Hour
+
+func (s *SQS) changeSqsMessagesVisibility(msg []*sqs.Message, visibilityTimeout int64) error {
+	return s.changeVisibility(msg, func(*sqs.Message) int64 {
+		return visibilityTimeout
+	})
+}
+
+// changeVisibility sets the visibility timeout of each message to the seconds returned by timeout.
+func (s *SQS) changeVisibility(msg []*sqs.Message, timeout func(*sqs.Message) int64) error {
+
+	if len(msg) == 0 {
+		return nil
+	}
+
+	chunks := chunk(msg, 10) //max batch size for sqs is 10
+
+	for _, chunk := range chunks {
+		batch := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(chunk))
+
+		for i, v := range chunk {
+			batch[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                v.MessageId,
+				ReceiptHandle:     v.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(timeout(v)),
+			}
+		}
+
+		_, err := s.sqs.ChangeMessageVisibilityBatchWithContext(aws.BackgroundContext(), &sqs.ChangeMessageVisibilityBatchInput{
+			Entries:  batch,
+			QueueUrl: aws.String(s.queueURL()),
+		}, s.config.RequestOptions...)
+
+		if err != nil {
+			return s.queueError("error changing messages visibility", err)
+		}
+	}
+
+	return nil
+}
+
+// applyDurationVisibility sets the visibility timeout of the messages carrying the DurationAttribute
+// to their estimated duration, rounded up to seconds and clamped to MaxVisibilityTimeout. Durations that
+// are malformed or not positive are ignored.
+func (s *SQS) applyDurationVisibility(messages []*sqs.Message) {
+	if s.config.DurationAttribute == "" {
+		return
+	}
+
+	durations := make(map[*sqs.Message]time.Duration)
+	estimated := make([]*sqs.Message, 0)
+
+	for _, msg := range messages {
+		attribute, found := msg.MessageAttributes[s.config.DurationAttribute]
+		if !found || attribute == nil || attribute.StringValue == nil {
+			continue
+		}
+
+		duration, err := parseDuration(*attribute.StringValue)
+		if err == nil && duration <= 0 {
+			err = fmt.Errorf("invalid duration %s", *attribute.StringValue)
+		}
+		if err != nil {
+			s.config.Logger.Warnf("%s", s.messageError(msg, err))
+			continue
+		}
+
+		durations[msg] = duration
+		estimated = append(estimated, msg)
+	}
+
+	err := s.changeVisibility(estimated, func(msg *sqs.Message) int64 {
+		return visibilitySeconds(durations[msg])
+	})
+
+	if err != nil {
+		s.logger(EventVisibilityError, nil, err).Errorf("%s", err)
+	}
+}
+
+// parseDuration parses either a number of seconds or a go duration (e.g. "1m30s").
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}